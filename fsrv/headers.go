@@ -0,0 +1,139 @@
+// Copyright (c) 2016 David R. Jenni. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// policy describes the response headers for paths matching a glob.
+type policy struct {
+	Path            string   `json:"path"`            // glob as in path.Match
+	Origins         []string `json:"origins"`         // allowed CORS origins, "*" allows any
+	Methods         []string `json:"methods"`         // allowed CORS methods
+	PreflightMaxAge int      `json:"preflightMaxAge"` // Access-Control-Max-Age in seconds
+	MaxAge          int      `json:"maxAge"`          // Cache-Control max-age in seconds
+	Immutable       bool     `json:"immutable"`       // marks the responses as immutable, needs maxAge
+	CSP             string   `json:"csp"`             // Content-Security-Policy
+	HSTS            string   `json:"hsts"`            // Strict-Transport-Security
+}
+
+// readPolicies reads a JSON list of policies from the given file.
+func readPolicies(name string) ([]policy, error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var policies []policy
+	if err := json.Unmarshal(b, &policies); err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	for _, p := range policies {
+		if _, err := path.Match(p.Path, "/"); err != nil {
+			return nil, fmt.Errorf("%s: %q: %v", name, p.Path, err)
+		}
+		if p.Immutable && p.MaxAge <= 0 {
+			return nil, fmt.Errorf("%s: %q: immutable needs a maxAge", name, p.Path)
+		}
+	}
+	return policies, nil
+}
+
+// match returns the first policy whose glob matches the given path.
+func match(policies []policy, p string) *policy {
+	for i := range policies {
+		if ok, _ := path.Match(policies[i].Path, p); ok {
+			return &policies[i]
+		}
+	}
+	return nil
+}
+
+// allowOrigin returns the value of Access-Control-Allow-Origin
+// for the given origin, or "" if the origin is not allowed.
+func (p *policy) allowOrigin(origin string) string {
+	for _, o := range p.Origins {
+		if o == "*" {
+			return "*"
+		}
+		if o == origin {
+			return origin
+		}
+	}
+	return ""
+}
+
+// set sets the headers of the policy on a response to r. Responses
+// which depend on the origin vary by it, whether the request has an
+// allowed origin, another one or none, so that caches keep them apart.
+func (p *policy) set(h http.Header, r *http.Request) {
+	switch {
+	case slices.Contains(p.Origins, "*"):
+		h.Set("Access-Control-Allow-Origin", "*")
+	case len(p.Origins) != 0:
+		h.Add("Vary", "Origin")
+		if o := p.allowOrigin(r.Header.Get("Origin")); o != "" {
+			h.Set("Access-Control-Allow-Origin", o)
+		}
+	}
+	if p.MaxAge > 0 {
+		cc := "max-age=" + strconv.Itoa(p.MaxAge)
+		if p.Immutable {
+			cc += ", immutable"
+		}
+		h.Set("Cache-Control", cc)
+	}
+	if p.CSP != "" {
+		h.Set("Content-Security-Policy", p.CSP)
+	}
+	if p.HSTS != "" {
+		h.Set("Strict-Transport-Security", p.HSTS)
+	}
+}
+
+// headers sets the response headers according to the policies
+// and answers CORS preflight requests without calling h.
+func headers(policies []policy, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := match(policies, r.URL.Path)
+		if p == nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+		p.set(w.Header(), r)
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			preflight(w, r, p)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// preflight answers a CORS preflight request.
+func preflight(w http.ResponseWriter, r *http.Request, p *policy) {
+	if p.allowOrigin(r.Header.Get("Origin")) == "" {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	methods := p.Methods
+	if len(methods) == 0 {
+		methods = []string{http.MethodGet, http.MethodHead}
+	}
+	w.Header().Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+	if req := r.Header.Get("Access-Control-Request-Headers"); req != "" {
+		w.Header().Set("Access-Control-Allow-Headers", req)
+	}
+	if p.PreflightMaxAge > 0 {
+		w.Header().Set("Access-Control-Max-Age", strconv.Itoa(p.PreflightMaxAge))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,148 @@
+// Copyright (c) 2016 David R. Jenni. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var testPolicies = []policy{
+	{Path: "/assets/*", Origins: []string{"https://example.com"}, Methods: []string{"GET", "PUT"}, PreflightMaxAge: 600, MaxAge: 86400, Immutable: true},
+	{Path: "/public/*", Origins: []string{"*"}},
+	{Path: "/*", CSP: "default-src 'self'", HSTS: "max-age=63072000"},
+}
+
+// serve sends a request with the origin through the test policies.
+func serve(method, path, origin string) *httptest.ResponseRecorder {
+	h := headers(testPolicies, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	r := httptest.NewRequest(method, path, nil)
+	if origin != "" {
+		r.Header.Set("Origin", origin)
+	}
+	if method == http.MethodOptions {
+		r.Header.Set("Access-Control-Request-Method", "PUT")
+		r.Header.Set("Access-Control-Request-Headers", "X-Token")
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		path string
+		want string // glob of the policy
+	}{
+		{"/assets/app.js", "/assets/*"},
+		{"/public/a.txt", "/public/*"},
+		{"/index.html", "/*"},
+		{"/assets/js/app.js", ""},
+	}
+	for _, test := range tests {
+		got := ""
+		if p := match(testPolicies, test.path); p != nil {
+			got = p.Path
+		}
+		if got != test.want {
+			t.Errorf("%s: expected %q, got %q", test.path, test.want, got)
+		}
+	}
+}
+
+func TestHeaders(t *testing.T) {
+	tests := []struct {
+		path, origin string
+		allow, vary  string
+		cache        string
+	}{
+		{"/assets/app.js", "https://example.com", "https://example.com", "Origin", "max-age=86400, immutable"},
+		{"/assets/app.js", "https://evil.example", "", "Origin", "max-age=86400, immutable"},
+		{"/assets/app.js", "", "", "Origin", "max-age=86400, immutable"},
+		{"/public/a.txt", "https://evil.example", "*", "", ""},
+		{"/public/a.txt", "", "*", "", ""},
+		{"/index.html", "https://example.com", "", "", ""},
+	}
+	for _, test := range tests {
+		w := serve("GET", test.path, test.origin)
+		h := w.Header()
+		if got := h.Get("Access-Control-Allow-Origin"); got != test.allow {
+			t.Errorf("%s from %q: expected Access-Control-Allow-Origin %q, got %q", test.path, test.origin, test.allow, got)
+		}
+		if got := h.Get("Vary"); got != test.vary {
+			t.Errorf("%s from %q: expected Vary %q, got %q", test.path, test.origin, test.vary, got)
+		}
+		if got := h.Get("Cache-Control"); got != test.cache {
+			t.Errorf("%s from %q: expected Cache-Control %q, got %q", test.path, test.origin, test.cache, got)
+		}
+		if w.Body.String() != "ok" {
+			t.Errorf("%s: expected the file, got %q", test.path, w.Body.String())
+		}
+	}
+
+	w := serve("GET", "/index.html", "")
+	if got := w.Header().Get("Content-Security-Policy"); got != "default-src 'self'" {
+		t.Errorf("Expected the CSP, got %q", got)
+	}
+	if got := w.Header().Get("Strict-Transport-Security"); got != "max-age=63072000" {
+		t.Errorf("Expected HSTS, got %q", got)
+	}
+}
+
+func TestPreflight(t *testing.T) {
+	w := serve("OPTIONS", "/assets/app.js", "https://example.com")
+	if w.Code != http.StatusNoContent || w.Body.Len() != 0 {
+		t.Errorf("Expected 204 without body, got %d %q", w.Code, w.Body.String())
+	}
+	want := map[string]string{
+		"Access-Control-Allow-Origin":  "https://example.com",
+		"Access-Control-Allow-Methods": "GET, PUT",
+		"Access-Control-Allow-Headers": "X-Token",
+		"Access-Control-Max-Age":       "600",
+	}
+	for k, v := range want {
+		if got := w.Header().Get(k); got != v {
+			t.Errorf("Expected %s %q, got %q", k, v, got)
+		}
+	}
+
+	if w := serve("OPTIONS", "/assets/app.js", "https://evil.example"); w.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 for another origin, got %d", w.Code)
+	}
+	w = serve("OPTIONS", "/public/a.txt", "https://evil.example")
+	if got := w.Header().Get("Access-Control-Allow-Methods"); got != "GET, HEAD" {
+		t.Errorf("Expected the default methods, got %q", got)
+	}
+	if got := w.Header().Get("Access-Control-Max-Age"); got != "" {
+		t.Errorf("Expected no Access-Control-Max-Age, got %q", got)
+	}
+}
+
+func TestReadPolicies(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		json string
+		ok   bool
+	}{
+		{`[{"path": "/assets/*", "maxAge": 60, "immutable": true}]`, true},
+		{`[{"path": "/assets/*", "immutable": true}]`, false},
+		{`[{"path": "/[", "maxAge": 60}]`, false},
+		{`{"path": "/"}`, false},
+	}
+	for i, test := range tests {
+		name := filepath.Join(dir, "policies.json")
+		if err := os.WriteFile(name, []byte(test.json), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := readPolicies(name); (err == nil) != test.ok {
+			t.Errorf("%d: expected ok %v, got %v", i, test.ok, err)
+		}
+	}
+}
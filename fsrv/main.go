@@ -16,6 +16,16 @@ Options:
 	-auth	credentials for basic auth (default: none)
 		example: fsrv -auth="user:pw"
 	-dir	directory (default: .)
+	-stats	append-only log of download statistics (default: none)
+		the counts are shown in listings and served as JSON at /.stats
+	-compact	interval of the statistics log compaction (default: 1h)
+	-headers	JSON file with response header policies (default: none)
+		example: [{"path": "/assets/*", "origins": ["https://example.com"],
+			"methods": ["GET"], "preflightMaxAge": 600,
+			"maxAge": 86400, "immutable": true,
+			"csp": "default-src 'self'", "hsts": "max-age=63072000"}]
+		the first policy whose glob matches the path applies;
+		immutable needs a maxAge
 */
 package main
 
@@ -25,6 +35,7 @@ import (
 	"log"
 	"net/http"
 	"strings"
+	"time"
 )
 
 func main() {
@@ -34,12 +45,31 @@ func main() {
 	addr := flag.String("http", ":8080", "HTTP listen address")
 	auth := flag.String("auth", "", "colon separated credentials for basic auth")
 	dir := flag.String("dir", ".", "directory")
+	statsFile := flag.String("stats", "", "append-only log of download statistics")
+	compact := flag.Duration("compact", time.Hour, "interval of the statistics log compaction")
+	policyFile := flag.String("headers", "", "JSON file with response header policies")
 	flag.Parse()
 
-	h := http.FileServer(http.Dir(*dir))
+	fs := http.Dir(*dir)
+	h := http.FileServer(fs)
+	if *statsFile != "" {
+		s, err := openStats(*statsFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go s.compactEvery(*compact)
+		h = s.handler(fs, h)
+	}
 	if pair := strings.Split(*auth, ":"); len(pair) == 2 {
 		h = basicAuth(pair[0], pair[1], h)
 	}
+	if *policyFile != "" {
+		policies, err := readPolicies(*policyFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		h = headers(policies, h)
+	}
 	http.Handle("/", h)
 	log.Fatal(http.ListenAndServe(*addr, nil))
 }
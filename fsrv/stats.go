@@ -0,0 +1,250 @@
+// Copyright (c) 2016 David R. Jenni. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// statsPath is the path of the JSON statistics endpoint.
+const statsPath = "/.stats"
+
+// entry is a record in the statistics log. Every download is
+// appended with Count 1; compaction merges the records of a path.
+type entry struct {
+	Path  string    `json:"path"`
+	Count int       `json:"count"`
+	Last  time.Time `json:"last"`
+	User  string    `json:"user,omitempty"`
+}
+
+// stats keeps per-path download statistics in an append-only log.
+type stats struct {
+	mu      sync.Mutex
+	name    string // filename of the log
+	f       *os.File
+	entries map[string]*entry
+}
+
+// openStats reads the log with the given filename and opens it for appending.
+func openStats(name string) (*stats, error) {
+	s := &stats{name: name, entries: make(map[string]*entry)}
+	f, err := os.Open(name)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		defer f.Close()
+		sc := bufio.NewScanner(f)
+		for sc.Scan() {
+			var e entry
+			if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+				// A partially written last line is dropped.
+				log.Printf("skipping stats record: %v", err)
+				continue
+			}
+			s.merge(e)
+		}
+		if err := sc.Err(); err != nil {
+			return nil, err
+		}
+	}
+	s.f, err = os.OpenFile(name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// merge adds a record to the in-memory statistics.
+func (s *stats) merge(e entry) {
+	old, ok := s.entries[e.Path]
+	if !ok {
+		s.entries[e.Path] = &e
+		return
+	}
+	old.Count += e.Count
+	if e.Last.After(old.Last) {
+		old.Last = e.Last
+		old.User = e.User
+	}
+}
+
+// record appends a download of the given path by the given user to the log.
+func (s *stats) record(p, user string) error {
+	e := entry{Path: p, Count: 1, Last: time.Now().UTC(), User: user}
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.merge(e)
+	_, err = s.f.Write(append(b, '\n'))
+	return err
+}
+
+// count returns the number of downloads of the given path.
+func (s *stats) count(p string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, ok := s.entries[p]; ok {
+		return e.Count
+	}
+	return 0
+}
+
+// compact rewrites the log with one record per path.
+func (s *stats) compact() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tmp := s.name + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, e := range s.entries {
+		if err := enc.Encode(e); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.name); err != nil {
+		return err
+	}
+	s.f.Close()
+	s.f, err = os.OpenFile(s.name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	return err
+}
+
+// compactEvery compacts the log periodically.
+func (s *stats) compactEvery(d time.Duration) {
+	for range time.Tick(d) {
+		if err := s.compact(); err != nil {
+			log.Printf("compacting stats: %v", err)
+		}
+	}
+}
+
+// handler records downloads served by h, shows the download counts
+// in directory listings and serves the statistics as JSON.
+func (s *stats) handler(fs http.FileSystem, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == statsPath {
+			s.serveJSON(w)
+			return
+		}
+		if strings.HasSuffix(r.URL.Path, "/") && s.serveDir(w, r, fs) {
+			return
+		}
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		h.ServeHTTP(sw, r)
+		if r.Method == http.MethodGet && sw.status == http.StatusOK && !strings.HasSuffix(r.URL.Path, "/") {
+			user, _, _ := r.BasicAuth()
+			if err := s.record(path.Clean(r.URL.Path), user); err != nil {
+				log.Printf("recording download: %v", err)
+			}
+		}
+	})
+}
+
+// serveJSON writes the statistics of all paths.
+func (s *stats) serveJSON(w http.ResponseWriter) {
+	s.mu.Lock()
+	list := make([]entry, 0, len(s.entries))
+	for _, e := range s.entries {
+		list = append(list, *e)
+	}
+	s.mu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Path < list[j].Path })
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// serveDir writes a directory listing with download counts.
+// It reports false if the request is not for a listing.
+func (s *stats) serveDir(w http.ResponseWriter, r *http.Request, fs http.FileSystem) bool {
+	dir := path.Clean(r.URL.Path)
+	f, err := fs.Open(dir)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	if fi, err := f.Stat(); err != nil || !fi.IsDir() {
+		return false
+	}
+	if index, err := fs.Open(path.Join(dir, "index.html")); err == nil {
+		index.Close()
+		return false
+	}
+	list, err := f.Readdir(-1)
+	if err != nil {
+		http.Error(w, "Error reading directory", http.StatusInternalServerError)
+		return true
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name() < list[j].Name() })
+
+	width := 0
+	for _, fi := range list {
+		if n := len(fi.Name()) + 1; n > width {
+			width = n
+		}
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintf(w, "<!doctype html>\n")
+	fmt.Fprintf(w, "<meta name=\"viewport\" content=\"width=device-width\">\n")
+	fmt.Fprintf(w, "<pre>\n")
+	for _, fi := range list {
+		name := fi.Name()
+		if fi.IsDir() {
+			name += "/"
+		}
+		u := url.URL{Path: name}
+		fmt.Fprintf(w, "<a href=\"%s\">%s</a>", u.String(), html.EscapeString(name))
+		if !fi.IsDir() {
+			fmt.Fprintf(w, "%*d", width-len(name)+8, s.count(path.Join(dir, name)))
+		}
+		fmt.Fprintf(w, "\n")
+	}
+	fmt.Fprintf(w, "</pre>\n")
+	return true
+}
+
+// statusWriter records the status code of a response.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+// WriteHeader records the status code and writes it.
+func (w *statusWriter) WriteHeader(code int) {
+	w.status = code
+	w.ResponseWriter.WriteHeader(code)
+}
@@ -0,0 +1,120 @@
+// Copyright (c) 2016 David R. Jenni. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+)
+
+func TestStatsLog(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "stats.log")
+	s, err := openStats(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range []struct{ path, user string }{{"/a", ""}, {"/b", "bob"}, {"/a", "alice"}} {
+		if err := s.record(d.path, d.user); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.f.Close()
+
+	// A partially written last record is dropped.
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"path":"/a","cou`)
+	f.Close()
+
+	check := func(when string, s *stats) {
+		if got := s.count("/a"); got != 2 {
+			t.Errorf("%s: expected 2 downloads of /a, got %d", when, got)
+		}
+		if got := s.count("/b"); got != 1 {
+			t.Errorf("%s: expected 1 download of /b, got %d", when, got)
+		}
+		if got := s.entries["/a"].User; got != "alice" {
+			t.Errorf("%s: expected the last user of /a to be alice, got %q", when, got)
+		}
+	}
+	if s, err = openStats(name); err != nil {
+		t.Fatal(err)
+	}
+	check("reopened", s)
+
+	if err := s.compact(); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := bytes.Count(b, []byte("\n")); n != 2 {
+		t.Errorf("Expected 2 records after compaction, got %d", n)
+	}
+	if err := s.record("/b", ""); err != nil {
+		t.Fatal(err)
+	}
+	s.f.Close()
+	if s, err = openStats(name); err != nil {
+		t.Fatal(err)
+	}
+	defer s.f.Close()
+	if got := s.count("/b"); got != 2 {
+		t.Errorf("Expected 2 downloads of /b after compaction, got %d", got)
+	}
+}
+
+func TestStatsHandler(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "a.txt"), []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	s, err := openStats(filepath.Join(t.TempDir(), "stats.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.f.Close()
+	fs := http.Dir(dir)
+	h := s.handler(fs, http.FileServer(fs))
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w
+	}
+
+	get("/a.txt")
+	get("/a.txt")
+	get("/missing.txt")
+	get("/sub/")
+
+	w := get("/")
+	if !regexp.MustCompile(`<a href="a.txt">a.txt</a> +2\n`).MatchString(w.Body.String()) {
+		t.Errorf("Expected 2 downloads of a.txt in the listing, got %q", w.Body.String())
+	}
+	if !regexp.MustCompile(`<a href="sub/">sub/</a>\n`).MatchString(w.Body.String()) {
+		t.Errorf("Expected the directory without count in the listing, got %q", w.Body.String())
+	}
+
+	w = get(statsPath)
+	var list []entry
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].Path != "/a.txt" || list[0].Count != 2 {
+		t.Errorf("Expected 2 downloads of /a.txt only, got %+v", list)
+	}
+}
@@ -6,9 +6,11 @@ require (
 	github.com/mortdeus/go9p v0.0.0-20140728043115-6a1d8ce8ea9a
 	github.com/nsf/termbox-go v1.1.1
 	github.com/ravernkoh/deepl v0.0.0-20181202110119-7133d0be96af
+	golang.org/x/crypto v0.45.0
 	golang.org/x/oauth2 v0.33.0
 	golang.org/x/term v0.37.0
 	google.golang.org/api v0.257.0
+	google.golang.org/grpc v1.77.0
 )
 
 require (
@@ -31,11 +33,9 @@ require (
 	go.opentelemetry.io/otel v1.38.0 // indirect
 	go.opentelemetry.io/otel/metric v1.38.0 // indirect
 	go.opentelemetry.io/otel/trace v1.38.0 // indirect
-	golang.org/x/crypto v0.45.0 // indirect
 	golang.org/x/net v0.47.0 // indirect
 	golang.org/x/sys v0.38.0 // indirect
 	golang.org/x/text v0.31.0 // indirect
 	google.golang.org/genproto/googleapis/rpc v0.0.0-20251202230838-ff82c1b0f217 // indirect
-	google.golang.org/grpc v1.77.0 // indirect
 	google.golang.org/protobuf v1.36.10 // indirect
 )
@@ -0,0 +1,158 @@
+// Copyright (c) 2014 David R. Jenni. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+)
+
+// accessRule allows or denies the requests which match all its conditions.
+type accessRule struct {
+	allow   bool
+	nets    []netip.Prefix // client networks
+	methods []string
+	path    *regexp.Regexp
+	headers map[string]string
+	status  int // answered to denied requests
+}
+
+// newAccessRules returns the rules described by cs.
+func newAccessRules(cs []*accessRuleConfig) ([]*accessRule, error) {
+	var rules []*accessRule
+	for i, c := range cs {
+		a := &accessRule{methods: c.Methods, headers: c.Headers, status: c.Status}
+		switch c.Action {
+		case "allow":
+			a.allow = true
+		case "deny":
+		default:
+			return nil, fmt.Errorf("access rule %d: unknown action %q", i+1, c.Action)
+		}
+		for _, s := range c.CIDRs {
+			nets, err := parseCIDRs(s)
+			if err != nil {
+				return nil, fmt.Errorf("access rule %d: %v", i+1, err)
+			}
+			a.nets = append(a.nets, nets...)
+		}
+		if c.Path != "" {
+			var err error
+			if a.path, err = regexp.Compile(c.Path); err != nil {
+				return nil, fmt.Errorf("access rule %d: %v", i+1, err)
+			}
+		}
+		if a.status == 0 {
+			a.status = http.StatusForbidden
+		}
+		if a.status < 400 || a.status > 599 {
+			return nil, fmt.Errorf("access rule %d: invalid status %d", i+1, a.status)
+		}
+		rules = append(rules, a)
+	}
+	return rules, nil
+}
+
+// match reports whether the request of the client ip matches the rule.
+func (a *accessRule) match(r *http.Request, ip netip.Addr) bool {
+	if a.nets != nil && !slices.ContainsFunc(a.nets, func(n netip.Prefix) bool { return n.Contains(ip) }) {
+		return false
+	}
+	if len(a.methods) != 0 && !slices.Contains(a.methods, r.Method) {
+		return false
+	}
+	if a.path != nil && !a.path.MatchString(r.URL.Path) {
+		return false
+	}
+	for k, v := range a.headers {
+		if r.Header.Get(k) != v {
+			return false
+		}
+	}
+	return true
+}
+
+// access returns the status answered to a request which the rules
+// deny, or 0 if they allow it. The first matching rule decides;
+// a request which matches no rule is allowed.
+func access(rules []*accessRule, r *http.Request) int {
+	if len(rules) == 0 {
+		return 0
+	}
+	ip, _ := netip.ParseAddr(clientIP(r))
+	for _, a := range rules {
+		if !a.match(r, ip.Unmap()) {
+			continue
+		}
+		if a.allow {
+			return 0
+		}
+		return a.status
+	}
+	return 0
+}
+
+// errorPage is answered instead of a plain error message.
+type errorPage struct {
+	contentType string
+	body        []byte
+}
+
+// loadErrorPages reads the error pages given as files by status.
+func loadErrorPages(files map[string]string) (map[int]*errorPage, error) {
+	pages := make(map[int]*errorPage)
+	for s, name := range files {
+		status, err := strconv.Atoi(s)
+		if err != nil || status < 400 || status > 599 {
+			return nil, fmt.Errorf("error page %s: invalid status %q", name, s)
+		}
+		b, err := os.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		ct := mime.TypeByExtension(filepath.Ext(name))
+		if ct == "" {
+			ct = "text/html; charset=utf-8"
+		}
+		pages[status] = &errorPage{contentType: ct, body: b}
+	}
+	return pages, nil
+}
+
+// errorPageFiles returns the files named after a status, like 403.html,
+// in the directory.
+func errorPageFiles(dir string) (map[string]string, error) {
+	names, err := filepath.Glob(filepath.Join(dir, "[45][0-9][0-9].*"))
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[string]string)
+	for _, name := range names {
+		files[filepath.Base(name)[:3]] = name
+	}
+	return files, nil
+}
+
+// fail answers the request with the error page of the status or,
+// without one, with the message.
+func (p *reverseProxy) fail(w http.ResponseWriter, status int, msg string) {
+	page := p.current().errorPages[status]
+	if page == nil {
+		http.Error(w, msg, status)
+		return
+	}
+	w.Header().Set("Content-Type", page.contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Length", strconv.Itoa(len(page.body)))
+	w.WriteHeader(status)
+	w.Write(page.body)
+}
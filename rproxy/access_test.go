@@ -0,0 +1,171 @@
+// Copyright (c) 2014 David R. Jenni. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// echoBody answers with the request body.
+func echoBody(w http.ResponseWriter, r *http.Request) {
+	io.Copy(w, r.Body)
+}
+
+func TestAccess(t *testing.T) {
+	p := newTestProxy(t, http.HandlerFunc(echoBody), &config{
+		Access: []*accessRuleConfig{
+			{Action: "deny", CIDRs: []string{"198.51.100.0/24"}},
+			{Action: "deny", Methods: []string{"TRACE"}, Status: http.StatusMethodNotAllowed},
+			{Action: "deny", Headers: map[string]string{"User-Agent": "BadBot"}},
+		},
+		Routes: []*routeConfig{
+			{Prefix: "/admin/", Upstream: "a", Access: []*accessRuleConfig{
+				{Action: "allow", CIDRs: []string{"192.0.2.0/24", "2001:db8::1"}},
+				{Action: "deny", Path: "^/admin/secret", Status: http.StatusNotFound},
+				{Action: "deny", Methods: []string{"POST"}},
+			}},
+			{Upstream: "a"},
+		},
+	})
+
+	tests := []struct {
+		client, method, path, agent string
+		status                      int
+	}{
+		{"203.0.113.1", "GET", "/", "", http.StatusOK},
+		{"198.51.100.7", "GET", "/", "", http.StatusForbidden},
+		{"203.0.113.1", "TRACE", "/", "", http.StatusMethodNotAllowed},
+		{"203.0.113.1", "GET", "/", "BadBot", http.StatusForbidden},
+		{"192.0.2.5", "POST", "/admin/secret", "", http.StatusOK},
+		{"[2001:db8::1]", "POST", "/admin/secret", "", http.StatusOK},
+		{"203.0.113.1", "GET", "/admin/secret", "", http.StatusNotFound},
+		{"203.0.113.1", "POST", "/admin/users", "", http.StatusForbidden},
+		{"203.0.113.1", "GET", "/admin/users", "", http.StatusOK},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(test.method, test.path, nil)
+		r.RemoteAddr = test.client + ":1234"
+		if test.agent != "" {
+			r.Header.Set("User-Agent", test.agent)
+		}
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, r)
+		if w.Code != test.status {
+			t.Errorf("%s %s %s: expected %d, got %d", test.client, test.method, test.path, test.status, w.Code)
+		}
+	}
+
+	for _, rule := range []*accessRuleConfig{{Action: "drop"}, {Action: "deny", CIDRs: []string{"x"}}, {Action: "deny", Status: 200}} {
+		if _, err := newReverseProxy(&config{Access: []*accessRuleConfig{rule}}); err == nil {
+			t.Errorf("Expected an error for %+v", rule)
+		}
+	}
+}
+
+func TestAccessTraversal(t *testing.T) {
+	p := newTestProxy(t, http.HandlerFunc(echoBody), &config{
+		Access: []*accessRuleConfig{{Action: "deny", Path: "^/admin/"}},
+		Routes: []*routeConfig{
+			{Prefix: "/secret/", Upstream: "a", Access: []*accessRuleConfig{{Action: "deny"}}},
+			{Upstream: "a"},
+		},
+	})
+
+	tests := []struct {
+		path, clean string
+	}{
+		{"/x/../admin/a", "/admin/a"},
+		{"//admin/a", "/admin/a"},
+		{"/./admin/a?q=1", "/admin/a?q=1"},
+		{"/x/../secret/a", "/secret/a"},
+		{"/secret/x/..", "/secret"},
+		{"/x/%2e%2e/secret/", "/secret/"},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, httptest.NewRequest("GET", test.path, nil))
+		if w.Code != http.StatusPermanentRedirect {
+			t.Errorf("%s: expected %d, got %d", test.path, http.StatusPermanentRedirect, w.Code)
+		}
+		if loc := w.Header().Get("Location"); loc != test.clean {
+			t.Errorf("%s: expected a redirect to %s, got %q", test.path, test.clean, loc)
+		}
+	}
+	for _, path := range []string{"/admin/a", "/secret/a"} {
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != http.StatusForbidden {
+			t.Errorf("%s: expected %d, got %d", path, http.StatusForbidden, w.Code)
+		}
+	}
+}
+
+func TestMaxBody(t *testing.T) {
+	p := newTestProxy(t, http.HandlerFunc(echoBody), &config{Routes: []*routeConfig{{Upstream: "a", MaxBody: 10}}})
+
+	tests := []struct {
+		body   string
+		length bool // sent with Content-Length
+		status int
+	}{
+		{"short", true, http.StatusOK},
+		{"short", false, http.StatusOK},
+		{strings.Repeat("x", 11), true, http.StatusRequestEntityTooLarge},
+		{strings.Repeat("x", 100<<10), false, http.StatusRequestEntityTooLarge},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("POST", "/", strings.NewReader(test.body))
+		if !test.length {
+			r.ContentLength = -1
+			r.Body = io.NopCloser(strings.NewReader(test.body))
+		}
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, r)
+		if w.Code != test.status {
+			t.Errorf("%d bytes: expected %d, got %d", len(test.body), test.status, w.Code)
+		}
+		if test.status == http.StatusOK && w.Body.String() != test.body {
+			t.Errorf("Expected %q, got %q", test.body, w.Body.String())
+		}
+	}
+}
+
+func TestErrorPages(t *testing.T) {
+	dir := t.TempDir()
+	page := "<h1>Go away</h1>\n"
+	if err := os.WriteFile(filepath.Join(dir, "403.html"), []byte(page), 0644); err != nil {
+		t.Fatal(err)
+	}
+	files, err := errorPageFiles(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := newTestProxy(t, http.HandlerFunc(echoBody), &config{
+		Access:     []*accessRuleConfig{{Action: "deny", Path: "^/private/"}},
+		Routes:     []*routeConfig{{Upstream: "a", MaxBody: 1}},
+		ErrorPages: files,
+	})
+
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", "/private/x", nil))
+	if w.Code != http.StatusForbidden || w.Body.String() != page {
+		t.Errorf("Expected the error page with 403, got %d %q", w.Code, w.Body.String())
+	}
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/html") {
+		t.Errorf("Expected text/html, got %q", ct)
+	}
+	// Statuses without a page get the plain message.
+	w = httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("POST", "/", strings.NewReader("xx")))
+	if w.Code != http.StatusRequestEntityTooLarge || w.Body.String() != "Request body too large.\n" {
+		t.Errorf("Expected the plain message with 413, got %d %q", w.Code, w.Body.String())
+	}
+}
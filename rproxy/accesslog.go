@@ -0,0 +1,135 @@
+// Copyright (c) 2014 David R. Jenni. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// accessLog writes a line for every request, as JSON or in
+// the Common Log Format followed by the proxy specific fields.
+type accessLog struct {
+	mu     sync.Mutex
+	w      io.Writer
+	format string // json or clf
+}
+
+// logEntry is a line of the access log.
+type logEntry struct {
+	Time      time.Time `json:"time"`
+	Client    string    `json:"client"`
+	User      string    `json:"user,omitempty"`
+	Method    string    `json:"method"`
+	URI       string    `json:"uri"`
+	Proto     string    `json:"proto"`
+	Host      string    `json:"host"`
+	Route     string    `json:"route,omitempty"`
+	Upstream  string    `json:"upstream,omitempty"`
+	Status    int       `json:"status"`
+	Bytes     int64     `json:"bytes"`              // bytes sent to the client
+	Received  int64     `json:"received,omitempty"` // bytes received from a websocket client
+	Websocket bool      `json:"websocket,omitempty"`
+	Duration  float64   `json:"duration"` // seconds
+	TTFB      float64   `json:"ttfb"`     // seconds until the upstream response header
+}
+
+// newAccessLog returns an access log writing to w in the given format.
+func newAccessLog(w io.Writer, format string) (*accessLog, error) {
+	if format != "json" && format != "clf" {
+		return nil, fmt.Errorf("unknown access log format %q", format)
+	}
+	return &accessLog{w: w, format: format}, nil
+}
+
+// log writes the entry of a request.
+func (l *accessLog) log(r *http.Request, st *proxyState, lw *logWriter) {
+	e := logEntry{
+		Time:      st.start,
+		Client:    clientIP(r),
+		Method:    r.Method,
+		URI:       r.RequestURI,
+		Proto:     r.Proto,
+		Host:      r.Host,
+		Status:    lw.status,
+		Bytes:     lw.bytes + st.sent,
+		Received:  st.received,
+		Websocket: st.websocket,
+		Duration:  time.Since(st.start).Seconds(),
+		TTFB:      st.ttfb.Seconds(),
+	}
+	e.User = st.user
+	if e.User == "" {
+		e.User, _, _ = r.BasicAuth()
+	}
+	if st.route != nil {
+		e.Route = st.route.name
+	}
+	if st.backend != nil {
+		e.Upstream = st.backend.url.Host
+	}
+	if e.Status == 0 {
+		e.Status = http.StatusOK
+		if st.websocket {
+			e.Status = http.StatusSwitchingProtocols
+		}
+	}
+
+	var line []byte
+	if l.format == "json" {
+		var err error
+		if line, err = json.Marshal(e); err != nil {
+			log.Printf("Error writing access log: %v", err)
+			return
+		}
+	} else {
+		user := e.User
+		if user == "" {
+			user = "-"
+		}
+		line = fmt.Appendf(nil, "%s - %s [%s] %q %d %d %d %q %q %.6f %.6f",
+			e.Client, user, e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+			e.Method+" "+e.URI+" "+e.Proto, e.Status, e.Bytes,
+			e.Received, e.Route, e.Upstream, e.Duration, e.TTFB)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.w.Write(append(line, '\n')); err != nil {
+		log.Printf("Error writing access log: %v", err)
+	}
+}
+
+// logWriter records the status and the size of a response.
+type logWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *logWriter) WriteHeader(code int) {
+	if w.status == 0 && code >= 200 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *logWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap returns the underlying ResponseWriter for http.ResponseController.
+func (w *logWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
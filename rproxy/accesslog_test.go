@@ -0,0 +1,49 @@
+// Copyright (c) 2014 David R. Jenni. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestAccessLog(t *testing.T) {
+	r := httptest.NewRequest("GET", "/ws", nil)
+	r.RemoteAddr = "198.51.100.1:1234"
+	st := &proxyState{start: time.Now(), websocket: true, sent: 10, received: 20}
+
+	var buf bytes.Buffer
+	l, err := newAccessLog(&buf, "clf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.log(r, st, &logWriter{ResponseWriter: httptest.NewRecorder()})
+	want := regexp.MustCompile(`^198\.51\.100\.1 - - \[.+\] "GET /ws HTTP/1\.1" 101 10 20 "" "" [0-9.]+ [0-9.]+\n$`)
+	if !want.MatchString(buf.String()) {
+		t.Errorf("Expected a CLF line with 10 bytes sent and 20 received, got %q", buf.String())
+	}
+
+	buf.Reset()
+	if l, err = newAccessLog(&buf, "json"); err != nil {
+		t.Fatal(err)
+	}
+	l.log(r, st, &logWriter{ResponseWriter: httptest.NewRecorder()})
+	var e logEntry
+	if err := json.Unmarshal(buf.Bytes(), &e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Status != http.StatusSwitchingProtocols || e.Bytes != 10 || e.Received != 20 {
+		t.Errorf("Expected 101 with 10 bytes sent and 20 received, got %+v", e)
+	}
+
+	if _, err := newAccessLog(&buf, "xml"); err == nil {
+		t.Errorf("Expected an error for an unknown format")
+	}
+}
@@ -0,0 +1,249 @@
+// Copyright (c) 2014 David R. Jenni. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// newAdminHandler returns the handler of the admin API. If token
+// is given, all requests but those to /metrics must carry it as a
+// bearer token.
+func newAdminHandler(p *reverseProxy, token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /metrics", p.serveMetrics)
+	mux.HandleFunc("POST /cache/purge", p.purgeCache)
+	mux.HandleFunc("GET /limits", p.limits)
+	mux.HandleFunc("GET /upstreams", p.listUpstreams)
+	mux.HandleFunc("POST /upstreams/{name}/backends", p.addBackend)
+	mux.HandleFunc("DELETE /upstreams/{name}/backends", p.removeBackend)
+	mux.HandleFunc("POST /upstreams/{name}/drain", p.drainBackend)
+	mux.HandleFunc("POST /upstreams/{name}/undrain", p.drainBackend)
+	mux.HandleFunc("POST /upstreams/{name}/weight", p.setWeight)
+	if token == "" {
+		return mux
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if r.URL.Path != "/metrics" && subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// loopback reports whether the listen address only accepts
+// connections from the local host.
+func loopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip, err := netip.ParseAddr(host)
+	return err == nil && ip.IsLoopback()
+}
+
+// purgeCache purges the cached responses of the URL given by
+// the url parameter or of all URLs with the prefix parameter.
+func (p *reverseProxy) purgeCache(w http.ResponseWriter, r *http.Request) {
+	if p.cache == nil {
+		http.Error(w, "No cache.", http.StatusNotFound)
+		return
+	}
+	raw, prefix := r.FormValue("url"), false
+	if raw == "" {
+		raw, prefix = r.FormValue("prefix"), true
+	}
+	u, err := url.Parse(raw)
+	if raw == "" || err != nil {
+		http.Error(w, "Missing or invalid url or prefix parameter.", http.StatusBadRequest)
+		return
+	}
+	key := u.Host + u.Path
+	if u.RawQuery != "" || !prefix {
+		key = u.Host + u.RequestURI()
+	}
+	writeJSON(w, map[string]int{"purged": p.cache.purge(key, prefix)})
+}
+
+// limits shows the state of the limiters by route.
+func (p *reverseProxy) limits(w http.ResponseWriter, r *http.Request) {
+	s := make(map[string]limiterState)
+	for i, rt := range p.current().routes {
+		if rt.limiter == nil {
+			continue
+		}
+		name := rt.name
+		if _, ok := s[name]; ok {
+			name = fmt.Sprintf("%s#%d", name, i)
+		}
+		s[name] = rt.limiter.state()
+	}
+	writeJSON(w, s)
+}
+
+// backendState is the state of a backend shown by the admin API.
+type backendState struct {
+	URL          string     `json:"url"`
+	Weight       int64      `json:"weight"`
+	Available    bool       `json:"available"`
+	Down         bool       `json:"down"`
+	Draining     bool       `json:"draining"`
+	EjectedUntil *time.Time `json:"ejectedUntil,omitempty"`
+	Conns        int64      `json:"conns"`
+}
+
+// upstreamState is the state of an upstream shown by the admin API.
+type upstreamState struct {
+	Breaker  string         `json:"breaker"`
+	Backends []backendState `json:"backends"`
+}
+
+// listUpstreams shows the state of the upstreams and their backends.
+func (p *reverseProxy) listUpstreams(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	s := make(map[string]upstreamState)
+	for name, u := range p.current().upstreams {
+		us := upstreamState{Breaker: u.breaker.current().String(), Backends: []backendState{}}
+		for _, b := range u.list() {
+			bs := backendState{
+				URL:       b.url.String(),
+				Weight:    b.weight.Load(),
+				Available: b.available(),
+				Conns:     b.conns.Load(),
+			}
+			b.mu.Lock()
+			bs.Down, bs.Draining = b.down, b.draining
+			if b.ejectedUntil.After(now) {
+				t := b.ejectedUntil
+				bs.EjectedUntil = &t
+			}
+			b.mu.Unlock()
+			us.Backends = append(us.Backends, bs)
+		}
+		s[name] = us
+	}
+	writeJSON(w, s)
+}
+
+// upstream returns the upstream named in the path, or
+// answers with 404 and returns nil.
+func (p *reverseProxy) upstream(w http.ResponseWriter, r *http.Request) *upstream {
+	u, ok := p.current().upstreams[r.PathValue("name")]
+	if !ok {
+		http.Error(w, "Unknown upstream.", http.StatusNotFound)
+		return nil
+	}
+	return u
+}
+
+// backend returns the backend given by the url parameter of
+// the upstream named in the path, or answers with 404 and
+// returns nil.
+func (p *reverseProxy) backend(w http.ResponseWriter, r *http.Request) *backend {
+	u := p.upstream(w, r)
+	if u == nil {
+		return nil
+	}
+	b := u.find(r.FormValue("url"))
+	if b == nil {
+		http.Error(w, "Unknown backend.", http.StatusNotFound)
+	}
+	return b
+}
+
+// addBackend adds the backend given by the url and weight parameters.
+func (p *reverseProxy) addBackend(w http.ResponseWriter, r *http.Request) {
+	u := p.upstream(w, r)
+	if u == nil {
+		return
+	}
+	weight := 1
+	if s := r.FormValue("weight"); s != "" {
+		var err error
+		if weight, err = strconv.Atoi(s); err != nil {
+			http.Error(w, "Invalid weight.", http.StatusBadRequest)
+			return
+		}
+	}
+	if err := u.add(r.FormValue("url"), weight); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	log.Printf("Added %s to %s", r.FormValue("url"), u.name)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// removeBackend removes the backend given by the url parameter.
+func (p *reverseProxy) removeBackend(w http.ResponseWriter, r *http.Request) {
+	u := p.upstream(w, r)
+	if u == nil {
+		return
+	}
+	if err := u.remove(r.FormValue("url")); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	log.Printf("Removed %s from %s", r.FormValue("url"), u.name)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// drainBackend stops or resumes sending new requests to the
+// backend given by the url parameter.
+func (p *reverseProxy) drainBackend(w http.ResponseWriter, r *http.Request) {
+	b := p.backend(w, r)
+	if b == nil {
+		return
+	}
+	drain := strings.HasSuffix(r.URL.Path, "/drain")
+	b.mu.Lock()
+	b.draining = drain
+	b.mu.Unlock()
+	if drain {
+		log.Printf("Draining %s", b.url)
+	} else {
+		log.Printf("Undraining %s", b.url)
+	}
+	writeJSON(w, map[string]int64{"conns": b.conns.Load()})
+}
+
+// setWeight changes the weight of the backend given by the url
+// parameter to the weight parameter.
+func (p *reverseProxy) setWeight(w http.ResponseWriter, r *http.Request) {
+	b := p.backend(w, r)
+	if b == nil {
+		return
+	}
+	weight, err := strconv.Atoi(r.FormValue("weight"))
+	if err != nil || weight <= 0 {
+		http.Error(w, "Invalid weight.", http.StatusBadRequest)
+		return
+	}
+	b.weight.Store(int64(weight))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writeJSON writes v as a JSON response.
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	enc.Encode(v)
+}
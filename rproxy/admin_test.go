@@ -0,0 +1,129 @@
+// Copyright (c) 2014 David R. Jenni. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// admin sends a request to the admin API with the token.
+func admin(h http.Handler, method, url, token string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, url, nil)
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestAdminUpstreams(t *testing.T) {
+	p := testProxy(t, &routeConfig{Upstream: "a"})
+	h := newAdminHandler(p, "secret")
+
+	if w := admin(h, "GET", "/upstreams", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without token, got %d", w.Code)
+	}
+	if w := admin(h, "GET", "/upstreams", "wrong"); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 with a wrong token, got %d", w.Code)
+	}
+
+	tests := []struct {
+		method, url string
+		status      int
+	}{
+		{"POST", "/upstreams/a/backends?url=http://c&weight=2", http.StatusNoContent},
+		{"POST", "/upstreams/a/backends?url=http://c", http.StatusBadRequest},
+		{"POST", "/upstreams/a/backends?url=file:///etc/passwd", http.StatusBadRequest},
+		{"POST", "/upstreams/a/backends?url=tcp://e:22", http.StatusBadRequest},
+		{"POST", "/upstreams/a/backends?url=e:80", http.StatusBadRequest},
+		{"POST", "/upstreams/a/backends?url=http://e&weight=-1", http.StatusBadRequest},
+		{"POST", "/upstreams/x/backends?url=http://d", http.StatusNotFound},
+		{"POST", "/upstreams/a/weight?url=http://c&weight=5", http.StatusNoContent},
+		{"POST", "/upstreams/a/weight?url=http://c&weight=0", http.StatusBadRequest},
+		{"POST", "/upstreams/a/drain?url=http://a", http.StatusOK},
+		{"POST", "/upstreams/a/drain?url=http://d", http.StatusNotFound},
+	}
+	for _, test := range tests {
+		if w := admin(h, test.method, test.url, "secret"); w.Code != test.status {
+			t.Errorf("%s %s: expected %d, got %d %q", test.method, test.url, test.status, w.Code, w.Body.String())
+		}
+	}
+
+	u := p.current().upstreams["a"]
+	for i := 0; i < 3; i++ {
+		if b := u.pick(httptest.NewRequest("GET", "/", nil)); b.url.String() != "http://c" {
+			t.Errorf("Expected the drained target to be skipped, got %s", b.url)
+		}
+	}
+	if b := u.find("http://c"); b == nil || b.weight.Load() != 5 {
+		t.Errorf("Expected the added target with weight 5")
+	}
+
+	admin(h, "POST", "/upstreams/a/undrain?url=http://a", "secret")
+	if w := admin(h, "DELETE", "/upstreams/a/backends?url=http://c", "secret"); w.Code != http.StatusNoContent {
+		t.Errorf("Expected 204 removing a target, got %d", w.Code)
+	}
+	if w := admin(h, "DELETE", "/upstreams/a/backends?url=http://a", "secret"); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected the last target not to be removed, got %d", w.Code)
+	}
+	w := admin(h, "GET", "/upstreams", "secret")
+	if !strings.Contains(w.Body.String(), `"url": "http://a"`) || strings.Contains(w.Body.String(), "http://c") {
+		t.Errorf("Expected only http://a, got %s", w.Body.String())
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	p := testProxy(t, &routeConfig{Prefix: "/a/", Upstream: "a"})
+	p.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/x", nil))
+	p.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/x", nil))
+
+	w := admin(newAdminHandler(p, "secret"), "GET", "/metrics", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200 for the metrics without token, got %d", w.Code)
+	}
+	for _, want := range []string{
+		`rproxy_requests_total{route="",upstream="",code="404"} 2`,
+		`rproxy_request_duration_seconds_bucket{route="",le="+Inf"} 2`,
+		`rproxy_request_duration_seconds_count{route=""} 2`,
+		`rproxy_backend_up{upstream="a",backend="http://a"} 1`,
+		`rproxy_breaker_open{upstream="b"} 0`,
+	} {
+		if !strings.Contains(w.Body.String(), want+"\n") {
+			t.Errorf("Expected %s in\n%s", want, w.Body.String())
+		}
+	}
+}
+
+func TestLabels(t *testing.T) {
+	got := labels("route", "a\"b\\c\nd\té", "code", "200")
+	if want := `{route="a\"b\\c\nd` + "\té" + `",code="200"}`; got != want {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+}
+
+func TestLoopback(t *testing.T) {
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"localhost:9090", true},
+		{"127.0.0.1:9090", true},
+		{"[::1]:9090", true},
+		{":9090", false},
+		{"0.0.0.0:9090", false},
+		{"192.0.2.1:9090", false},
+		{"admin.example.com:9090", false},
+		{"localhost", false},
+	}
+	for _, test := range tests {
+		if got := loopback(test.addr); got != test.want {
+			t.Errorf("%s: expected %v, got %v", test.addr, test.want, got)
+		}
+	}
+}
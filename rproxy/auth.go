@@ -0,0 +1,254 @@
+// Copyright (c) 2014 David R. Jenni. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Defaults of the authentication.
+const (
+	defaultForwardAuthTimeout = 5 * time.Second
+	maxVerified               = 1024 // cached bcrypt verifications
+)
+
+// userHeader passes the authenticated user to the upstream.
+const userHeader = "X-Forwarded-User"
+
+// authenticator authenticates the requests of a route.
+type authenticator interface {
+	// authenticate returns the authenticated user, or answers
+	// the request and reports false. It may modify the header
+	// of the request, which is forwarded afterwards.
+	authenticate(w http.ResponseWriter, r *http.Request) (string, bool)
+}
+
+// withHeader returns a shallow copy of the request
+// with a copy of the header which may be modified.
+func withHeader(r *http.Request) *http.Request {
+	r2 := new(http.Request)
+	*r2 = *r
+	r2.Header = r.Header.Clone()
+	return r2
+}
+
+// basicAuth checks credentials against an htpasswd file.
+type basicAuth struct {
+	realm string
+	users map[string]string // hash by user
+
+	mu       sync.Mutex
+	verified map[[sha256.Size]byte]bool // successful bcrypt checks
+}
+
+// newBasicAuth reads an htpasswd file with bcrypt or {SHA} hashes.
+func newBasicAuth(file, realm string) (*basicAuth, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	a := &basicAuth{realm: realm, users: make(map[string]string), verified: make(map[[sha256.Size]byte]bool)}
+	if a.realm == "" {
+		a.realm = "rproxy"
+	}
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: missing password hash", file, n)
+		}
+		if !strings.HasPrefix(hash, "$2") && !strings.HasPrefix(hash, "{SHA}") {
+			return nil, fmt.Errorf("%s:%d: unsupported hash, use bcrypt or SHA", file, n)
+		}
+		a.users[user] = hash
+	}
+	return a, s.Err()
+}
+
+func (a *basicAuth) authenticate(w http.ResponseWriter, r *http.Request) (string, bool) {
+	user, pw, ok := r.BasicAuth()
+	if !ok || !a.check(user, pw) {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", a.realm))
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return "", false
+	}
+	return user, true
+}
+
+// check reports whether the password of the user is correct.
+func (a *basicAuth) check(user, pw string) bool {
+	hash, ok := a.users[user]
+	if !ok {
+		return false
+	}
+	if sha, ok := strings.CutPrefix(hash, "{SHA}"); ok {
+		sum := sha1.Sum([]byte(pw))
+		return subtle.ConstantTimeCompare([]byte(base64.StdEncoding.EncodeToString(sum[:])), []byte(sha)) == 1
+	}
+
+	// bcrypt is slow by design; remember the successful checks.
+	key := sha256.Sum256([]byte(user + "\x00" + hash + "\x00" + pw))
+	a.mu.Lock()
+	ok = a.verified[key]
+	a.mu.Unlock()
+	if ok {
+		return true
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(pw)) != nil {
+		return false
+	}
+	a.mu.Lock()
+	if len(a.verified) >= maxVerified {
+		clear(a.verified)
+	}
+	a.verified[key] = true
+	a.mu.Unlock()
+	return true
+}
+
+// forwardAuth asks an auth service whether a request may pass.
+// The service sees the headers of the request and its method,
+// host and URI in X-Forwarded-* headers. A 2xx response lets
+// the request pass with the given headers of the response; any
+// other response is returned to the client.
+type forwardAuth struct {
+	url     string
+	headers []string // response headers copied to the request
+	client  *http.Client
+}
+
+// newForwardAuth returns a forwardAuth asking the service at url.
+func newForwardAuth(url string, headers []string, timeout time.Duration) *forwardAuth {
+	return &forwardAuth{
+		url:     url,
+		headers: headers,
+		client: &http.Client{
+			Timeout: timeout,
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+}
+
+func (a *forwardAuth) authenticate(w http.ResponseWriter, r *http.Request) (string, bool) {
+	req, err := http.NewRequestWithContext(r.Context(), "GET", a.url, nil)
+	if err != nil {
+		log.Printf("Error creating auth request: %v", err)
+		http.Error(w, "Auth service unavailable.", http.StatusBadGateway)
+		return "", false
+	}
+	copyHeader(req.Header, r.Header)
+	req.Header.Del("Connection")
+	req.Header.Del("Upgrade")
+	proto := "http"
+	if r.TLS != nil {
+		proto = "https"
+	}
+	req.Header.Set("X-Forwarded-Method", r.Method)
+	req.Header.Set("X-Forwarded-Proto", proto)
+	req.Header.Set("X-Forwarded-Host", r.Host)
+	req.Header.Set("X-Forwarded-Uri", r.RequestURI)
+	req.Header.Set("X-Forwarded-For", clientIP(r))
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		log.Printf("Error asking auth service: %v", err)
+		http.Error(w, "Auth service unavailable.", http.StatusBadGateway)
+		return "", false
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		copyHeader(w.Header(), resp.Header)
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+		return "", false
+	}
+	for _, k := range a.headers {
+		r.Header.Del(k)
+		for _, v := range resp.Header.Values(k) {
+			r.Header.Add(k, v)
+		}
+	}
+	return resp.Header.Get(userHeader), true
+}
+
+// newAuthenticator returns the authenticator described by c.
+func newAuthenticator(c *authConfig) (authenticator, error) {
+	var as []authenticator
+	if c.Basic != nil {
+		a, err := newBasicAuth(c.Basic.Htpasswd, c.Basic.Realm)
+		if err != nil {
+			return nil, err
+		}
+		as = append(as, a)
+	}
+	if c.JWT != nil {
+		b, err := os.ReadFile(c.JWT.Keys)
+		if err != nil {
+			return nil, err
+		}
+		keys, err := parseKeys(b)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", c.JWT.Keys, err)
+		}
+		as = append(as, &jwtAuth{
+			keys:     keys,
+			issuer:   c.JWT.Issuer,
+			audience: c.JWT.Audience,
+			claims:   c.JWT.Claims,
+			query:    c.JWT.Query,
+			cookie:   c.JWT.Cookie,
+		})
+	}
+	if c.Forward != nil {
+		as = append(as, newForwardAuth(c.Forward.URL, c.Forward.Headers, c.Forward.Timeout.orDefault(defaultForwardAuthTimeout)))
+	}
+	if len(as) != 1 {
+		return nil, fmt.Errorf("auth needs exactly one of basic, jwt or forward")
+	}
+	return as[0], nil
+}
+
+// authenticate applies the authenticator of the route to the
+// request. The user is passed to the upstream in userHeader.
+func (rt *route) authenticate(w http.ResponseWriter, r *http.Request, st *proxyState) (*http.Request, bool) {
+	r = withHeader(r)
+	r.Header.Del(userHeader) // never pass a user claimed by the client
+	user, ok := rt.auth.authenticate(w, r)
+	if !ok {
+		return nil, false
+	}
+	if user != "" {
+		r.Header.Set(userHeader, user)
+	}
+	st.user = user
+	return r, true
+}
+
+// unauthorizedBearer answers with 401 and a Bearer challenge.
+func unauthorizedBearer(w http.ResponseWriter, msg string) {
+	w.Header().Set("WWW-Authenticate", fmt.Sprintf("Bearer error=\"invalid_token\", error_description=%q", msg))
+	http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+}
@@ -0,0 +1,187 @@
+// Copyright (c) 2014 David R. Jenni. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// authProxy returns a proxy to an upstream echoing X-Forwarded-User
+// whose only route is authenticated as configured by c.
+func authProxy(t *testing.T, c *authConfig) *reverseProxy {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.Header.Get("X-Forwarded-User"), r.Header.Get("X-Roles"))
+	})
+	return newTestProxy(t, h, &config{Routes: []*routeConfig{{Upstream: "a", Auth: c}}})
+}
+
+func TestBasicAuth(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(t.TempDir(), "htpasswd")
+	if err := os.WriteFile(file, []byte("# users\nalice:"+string(hash)+"\nbob:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	p := authProxy(t, &authConfig{Basic: &basicAuthConfig{Htpasswd: file}})
+
+	tests := []struct {
+		user, pw string
+		status   int
+		body     string
+	}{
+		{"alice", "secret", http.StatusOK, "alice"},
+		{"alice", "secret", http.StatusOK, "alice"},
+		{"bob", "secret", http.StatusOK, "bob"},
+		{"alice", "wrong", http.StatusUnauthorized, ""},
+		{"eve", "secret", http.StatusUnauthorized, ""},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.SetBasicAuth(test.user, test.pw)
+		r.Header.Set("X-Forwarded-User", "root")
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, r)
+		if w.Code != test.status || (test.body != "" && w.Body.String() != test.body) {
+			t.Errorf("%s:%s: expected %d %q, got %d %q", test.user, test.pw, test.status, test.body, w.Code, w.Body.String())
+		}
+	}
+}
+
+// signJWT returns a token with the claims signed with ES256.
+func signJWT(t *testing.T, key *ecdsa.PrivateKey, kid string, claims map[string]any) string {
+	enc := func(v any) string {
+		b, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	signed := enc(map[string]string{"alg": "ES256", "kid": kid}) + "." + enc(claims)
+	digest := sha256.Sum256([]byte(signed))
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestJWTAuth(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwks := fmt.Sprintf(`{"keys": [{"kty": "EC", "kid": "k1", "crv": "P-256", "x": %q, "y": %q}]}`,
+		base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, 32))),
+		base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, 32))))
+	file := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(file, []byte(jwks), 0600); err != nil {
+		t.Fatal(err)
+	}
+	p := authProxy(t, &authConfig{JWT: &jwtConfig{
+		Keys:     file,
+		Issuer:   "id",
+		Audience: "api",
+		Claims:   map[string]string{"scope": "read"},
+		Query:    "access_token",
+	}})
+
+	exp := time.Now().Add(time.Hour).Unix()
+	valid := map[string]any{"sub": "alice", "iss": "id", "aud": []string{"api"}, "scope": "read write", "exp": exp}
+	tests := []struct {
+		name   string
+		token  string
+		status int
+	}{
+		{"valid", signJWT(t, key, "k1", valid), http.StatusOK},
+		{"other key", signJWT(t, other, "k1", valid), http.StatusUnauthorized},
+		{"expired", signJWT(t, key, "k1", map[string]any{"sub": "alice", "iss": "id", "aud": "api", "scope": "read", "exp": 1}), http.StatusUnauthorized},
+		{"scope", signJWT(t, key, "k1", map[string]any{"sub": "alice", "iss": "id", "aud": "api", "scope": "write", "exp": exp}), http.StatusUnauthorized},
+		{"none", "", http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		if test.token != "" {
+			r.Header.Set("Authorization", "Bearer "+test.token)
+		}
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, r)
+		if w.Code != test.status {
+			t.Errorf("%s: expected %d, got %d %q", test.name, test.status, w.Code, w.Body.String())
+		}
+	}
+
+	// A websocket handshake passes the token in the query.
+	r := httptest.NewRequest("GET", "/?access_token="+signJWT(t, key, "k1", valid), nil)
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || w.Body.String() != "alice" {
+		t.Errorf("Expected 200 alice for a token in the query, got %d %q", w.Code, w.Body.String())
+	}
+	r = httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Connection", "Upgrade")
+	r.Header.Set("Upgrade", "websocket")
+	w = httptest.NewRecorder()
+	p.ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected an unauthenticated upgrade to be rejected, got %d", w.Code)
+	}
+
+	if err := verifySignature("HS256", crypto.PublicKey(&key.PublicKey), nil, nil); err == nil {
+		t.Errorf("Expected HS256 to be rejected")
+	}
+}
+
+func TestForwardAuth(t *testing.T) {
+	auth := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Cookie") != "session=ok" || r.Header.Get("X-Forwarded-Uri") != "/x?y" {
+			http.Redirect(w, r, "https://login/", http.StatusFound)
+			return
+		}
+		w.Header().Set("X-Forwarded-User", "alice")
+		w.Header().Set("X-Roles", ",admin")
+	}))
+	defer auth.Close()
+	p := authProxy(t, &authConfig{Forward: &forwardAuthConfig{URL: auth.URL, Headers: []string{"X-Roles"}}})
+
+	r := httptest.NewRequest("GET", "/x?y", nil)
+	r.Header.Set("Cookie", "session=ok")
+	r.Header.Set("X-Roles", "root")
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || w.Body.String() != "alice,admin" {
+		t.Errorf("Expected 200 alice,admin, got %d %q", w.Code, w.Body.String())
+	}
+
+	r = httptest.NewRequest("GET", "/x?y", nil)
+	w = httptest.NewRecorder()
+	p.ServeHTTP(w, r)
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "https://login/" {
+		t.Errorf("Expected the redirect of the auth service, got %d %q", w.Code, w.Header().Get("Location"))
+	}
+}
@@ -0,0 +1,108 @@
+// Copyright (c) 2014 David R. Jenni. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// defaultBreakerOpen is the default time a breaker stays open.
+const defaultBreakerOpen = 30 * time.Second
+
+// breakerState is the state of a circuit breaker.
+type breakerState int
+
+const (
+	breakerClosed   breakerState = iota // requests pass
+	breakerOpen                         // requests fail fast
+	breakerHalfOpen                     // a trial request passes
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+// breaker is the circuit breaker of an upstream. It opens after
+// consecutive failures and lets a trial request pass once it has
+// been open for a while; the trial closes or reopens it.
+type breaker struct {
+	name     string        // name of the upstream in logs
+	failures int           // consecutive failures which open the breaker, 0 disables it
+	openTime time.Duration // time before a trial request
+
+	mu    sync.Mutex
+	state breakerState
+	count int       // consecutive failures
+	until time.Time // end of the open state or of the trial
+}
+
+// allow reports whether a request may pass the breaker.
+func (b *breaker) allow() bool {
+	if b.failures <= 0 {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	switch b.state {
+	case breakerOpen:
+		if now.Before(b.until) {
+			return false
+		}
+		b.setState(breakerHalfOpen)
+		b.until = now.Add(b.openTime)
+		return true
+	case breakerHalfOpen:
+		// Only one trial at a time; a lost trial expires.
+		if now.Before(b.until) {
+			return false
+		}
+		b.until = now.Add(b.openTime)
+		return true
+	}
+	return true
+}
+
+// record records the outcome of a request which passed the breaker.
+func (b *breaker) record(ok bool) {
+	if b.failures <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ok {
+		b.count = 0
+		b.setState(breakerClosed)
+		return
+	}
+	b.count++
+	if b.state == breakerHalfOpen || (b.state == breakerClosed && b.count >= b.failures) {
+		b.setState(breakerOpen)
+		b.until = time.Now().Add(b.openTime)
+	}
+}
+
+// current returns the state of the breaker.
+func (b *breaker) current() breakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// setState changes the state and logs the transition.
+func (b *breaker) setState(s breakerState) {
+	if b.state != s {
+		log.Printf("Circuit breaker of %s is %v", b.name, s)
+		b.state = s
+	}
+}
@@ -0,0 +1,658 @@
+// Copyright (c) 2014 David R. Jenni. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cacheableStatus lists the status codes whose responses are stored.
+var cacheableStatus = []int{200, 203, 204, 300, 301, 308, 404, 410}
+
+// cacheEntry is a stored response.
+type cacheEntry struct {
+	Key     string
+	Route   string            // cacheID of the route which stored the response
+	Vary    map[string]string // request header values the response varies on
+	Status  int
+	Header  http.Header
+	Body    []byte
+	Date    time.Time     // time the response was received
+	Age     time.Duration // age of the response when it was received
+	Fresh   time.Duration // freshness lifetime
+	SWR     time.Duration // stale-while-revalidate
+	NoCache bool          // must be revalidated before every use
+}
+
+// age returns the current age of the entry.
+func (e *cacheEntry) age(now time.Time) time.Duration {
+	return e.Age + now.Sub(e.Date)
+}
+
+// size returns the approximate memory size of the entry.
+func (e *cacheEntry) size() int64 {
+	n := len(e.Key) + len(e.Body)
+	for k, vv := range e.Header {
+		for _, v := range vv {
+			n += len(k) + len(v)
+		}
+	}
+	return int64(n)
+}
+
+// matches reports whether the entry is the variant for the request
+// of the route.
+func (e *cacheEntry) matches(route string, r *http.Request) bool {
+	if e.Route != route {
+		return false
+	}
+	for k, v := range e.Vary {
+		if strings.Join(r.Header.Values(k), ",") != v {
+			return false
+		}
+	}
+	return true
+}
+
+// sameVariant reports whether both entries are of the same route
+// and vary equally.
+func (e *cacheEntry) sameVariant(o *cacheEntry) bool {
+	if e.Route != o.Route || len(e.Vary) != len(o.Vary) {
+		return false
+	}
+	for k, v := range e.Vary {
+		if ov, ok := o.Vary[k]; !ok || ov != v {
+			return false
+		}
+	}
+	return true
+}
+
+// cache is an HTTP cache with an LRU memory tier and an optional
+// disk tier. It follows the basics of RFC 9111 for a shared cache.
+type cache struct {
+	maxSize  int64 // size of the memory tier in bytes
+	maxEntry int64 // largest stored response body
+	disk     *diskCache
+
+	mu           sync.Mutex
+	size         int64
+	lru          *list.List // of *cacheEntry, most recently used first
+	entries      map[string][]*list.Element
+	revalidating map[string]bool
+}
+
+// newCache returns a cache with the given memory size in bytes
+// and, if dir is not empty, a disk tier of the given size.
+func newCache(size int64, dir string, diskSize int64) (*cache, error) {
+	c := &cache{
+		maxSize:      size,
+		maxEntry:     size / 16,
+		lru:          list.New(),
+		entries:      make(map[string][]*list.Element),
+		revalidating: make(map[string]bool),
+	}
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+		c.disk = &diskCache{dir: dir, max: diskSize}
+		c.disk.prune()
+	}
+	return c, nil
+}
+
+// cacheKey returns the key of the request.
+func cacheKey(r *http.Request) string {
+	return r.Host + r.URL.RequestURI()
+}
+
+// get returns the variant stored by the route for the request, or nil.
+func (c *cache) get(key, route string, r *http.Request) *cacheEntry {
+	c.mu.Lock()
+	for _, el := range c.entries[key] {
+		if e := el.Value.(*cacheEntry); e.matches(route, r) {
+			c.lru.MoveToFront(el)
+			c.mu.Unlock()
+			return e
+		}
+	}
+	c.mu.Unlock()
+	if c.disk == nil {
+		return nil
+	}
+	for _, e := range c.disk.load(key) {
+		if e.matches(route, r) {
+			c.add(e)
+			return e
+		}
+	}
+	return nil
+}
+
+// put stores the entry in all tiers.
+func (c *cache) put(e *cacheEntry) {
+	c.add(e)
+	if c.disk != nil {
+		c.disk.store(e)
+	}
+}
+
+// add stores the entry in the memory tier, replacing the same
+// variant and evicting the least recently used entries.
+func (c *cache) add(e *cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, el := range c.entries[e.Key] {
+		if el.Value.(*cacheEntry).sameVariant(e) {
+			c.remove(el)
+			break
+		}
+	}
+	c.entries[e.Key] = append(c.entries[e.Key], c.lru.PushFront(e))
+	c.size += e.size()
+	for c.size > c.maxSize {
+		c.remove(c.lru.Back())
+	}
+}
+
+// remove removes an element from the memory tier.
+func (c *cache) remove(el *list.Element) {
+	e := c.lru.Remove(el).(*cacheEntry)
+	c.size -= e.size()
+	els := slices.DeleteFunc(c.entries[e.Key], func(x *list.Element) bool { return x == el })
+	if len(els) == 0 {
+		delete(c.entries, e.Key)
+	} else {
+		c.entries[e.Key] = els
+	}
+}
+
+// purge removes the entries of the key or, if prefix is true,
+// of all keys with the given prefix. It returns the number of
+// purged keys.
+func (c *cache) purge(key string, prefix bool) int {
+	c.mu.Lock()
+	keys := make(map[string]bool)
+	for k, els := range c.entries {
+		if k == key || (prefix && strings.HasPrefix(k, key)) {
+			keys[k] = true
+			for _, el := range slices.Clone(els) {
+				c.remove(el)
+			}
+		}
+	}
+	c.mu.Unlock()
+	if c.disk != nil {
+		for _, k := range c.disk.remove(key, prefix) {
+			keys[k] = true
+		}
+	}
+	return len(keys)
+}
+
+// forwardFunc sends a request to the upstream of the route in st.
+type forwardFunc func(w http.ResponseWriter, r *http.Request, st *proxyState)
+
+// serve answers the request from the cache if possible and
+// forwards it otherwise, storing cacheable responses.
+func (c *cache) serve(w http.ResponseWriter, r *http.Request, st *proxyState, forward forwardFunc) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		// Unsafe methods invalidate the stored responses.
+		if r.Method != "OPTIONS" && r.Method != "TRACE" {
+			c.purge(cacheKey(r), false)
+		}
+		forward(w, r, st)
+		return
+	}
+	reqCC := parseCacheControl(r.Header)
+	if _, ok := reqCC["no-store"]; ok || isWebsocket(r) {
+		forward(w, r, st)
+		return
+	}
+	key := cacheKey(r)
+	e := c.get(key, st.route.cacheID, r)
+	if e == nil {
+		c.fetch(w, r, st, nil, forward)
+		return
+	}
+	now := time.Now()
+	age := e.age(now)
+	_, revalidate := reqCC["no-cache"]
+	revalidate = revalidate || e.NoCache
+	if v, ok := reqCC["max-age"]; ok {
+		if secs, err := strconv.Atoi(v); err == nil && age > time.Duration(secs)*time.Second {
+			revalidate = true
+		}
+	}
+	switch {
+	case !revalidate && age < e.Fresh:
+		c.write(w, r, e, "HIT")
+	case !revalidate && age < e.Fresh+e.SWR:
+		c.write(w, r, e, "STALE")
+		go c.revalidate(r, st, e, forward)
+	default:
+		c.fetch(w, r, st, e, forward)
+	}
+}
+
+// fetch forwards the request, conditionally if a stale entry
+// exists, and stores the response if it is cacheable.
+func (c *cache) fetch(w http.ResponseWriter, r *http.Request, st *proxyState, stale *cacheEntry, forward forwardFunc) {
+	out := r
+	if stale != nil {
+		out = r.Clone(r.Context())
+		out.Header.Del("If-None-Match")
+		out.Header.Del("If-Modified-Since")
+		if etag := stale.Header.Get("Etag"); etag != "" {
+			out.Header.Set("If-None-Match", etag)
+		}
+		if lm := stale.Header.Get("Last-Modified"); lm != "" {
+			out.Header.Set("If-Modified-Since", lm)
+		}
+	}
+	cw := &cacheWriter{w: w, header: make(http.Header), hold304: stale != nil, max: c.maxEntry}
+	forward(cw, out, st)
+	now := time.Now()
+
+	if cw.held {
+		// The stale entry is still valid; refresh it.
+		e := *stale
+		e.Header = stale.Header.Clone()
+		for k, vv := range cw.header {
+			if k != "Content-Length" {
+				e.Header[k] = vv
+			}
+		}
+		c.setFreshness(&e, now)
+		c.put(&e)
+		c.write(w, r, &e, "REVALIDATED")
+		return
+	}
+	if r.Method != "GET" || cw.overflow || !storable(r, cw.status, cw.header) {
+		if stale != nil && cw.status < 500 {
+			c.purge(stale.Key, false)
+		}
+		return
+	}
+	e := &cacheEntry{
+		Key:    cacheKey(r),
+		Route:  st.route.cacheID,
+		Status: cw.status,
+		Header: cw.header.Clone(),
+		Body:   cw.body.Bytes(),
+	}
+	e.Vary = make(map[string]string)
+	for _, k := range varyHeaders(cw.header) {
+		e.Vary[k] = strings.Join(r.Header.Values(k), ",")
+	}
+	c.setFreshness(e, now)
+	c.put(e)
+}
+
+// revalidate refreshes a stale entry in the background.
+func (c *cache) revalidate(r *http.Request, st *proxyState, e *cacheEntry, forward forwardFunc) {
+	c.mu.Lock()
+	if c.revalidating[e.Key] {
+		c.mu.Unlock()
+		return
+	}
+	c.revalidating[e.Key] = true
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.revalidating, e.Key)
+		c.mu.Unlock()
+	}()
+
+	r = r.Clone(context.WithoutCancel(r.Context()))
+	st = &proxyState{route: st.route, upstream: st.upstream, start: time.Now()}
+	c.fetch(&discardWriter{header: make(http.Header)}, r, st, e, forward)
+}
+
+// setFreshness sets the date, age and lifetimes of the entry from its header.
+func (c *cache) setFreshness(e *cacheEntry, now time.Time) {
+	cc := parseCacheControl(e.Header)
+	e.Date = now
+	e.Age = 0
+	if secs, err := strconv.Atoi(e.Header.Get("Age")); err == nil && secs > 0 {
+		e.Age = time.Duration(secs) * time.Second
+	}
+	e.Fresh, _ = freshness(e.Header, cc)
+	e.SWR = 0
+	if secs, err := strconv.Atoi(cc["stale-while-revalidate"]); err == nil && secs > 0 {
+		e.SWR = time.Duration(secs) * time.Second
+	}
+	_, noCache := cc["no-cache"]
+	e.NoCache = noCache
+	if _, ok := cc["must-revalidate"]; ok {
+		e.SWR = 0
+	}
+}
+
+// write answers the request with the entry.
+func (c *cache) write(w http.ResponseWriter, r *http.Request, e *cacheEntry, status string) {
+	h := w.Header()
+	for k, vv := range e.Header {
+		h[k] = slices.Clone(vv)
+	}
+	h.Set("Age", strconv.Itoa(int(e.age(time.Now()).Seconds())))
+	h.Set("X-Cache", status)
+	if e.Status == http.StatusOK {
+		var modtime time.Time
+		if lm, err := http.ParseTime(e.Header.Get("Last-Modified")); err == nil {
+			modtime = lm
+		}
+		if h.Get("Content-Encoding") != "" {
+			// Ranges of the encoded body mean nothing to the client;
+			// it is always sent whole, with the stored length.
+			r = r.Clone(r.Context())
+			r.Header.Del("Range")
+		} else {
+			// ServeContent sets the length of the range.
+			h.Del("Content-Length")
+		}
+		http.ServeContent(w, r, "", modtime, bytes.NewReader(e.Body))
+		return
+	}
+	w.WriteHeader(e.Status)
+	if r.Method != "HEAD" {
+		w.Write(e.Body)
+	}
+}
+
+// storable reports whether a response to the request may be stored.
+func storable(r *http.Request, status int, h http.Header) bool {
+	if !slices.Contains(cacheableStatus, status) || h.Get("Set-Cookie") != "" {
+		return false
+	}
+	cc := parseCacheControl(h)
+	if _, ok := cc["no-store"]; ok {
+		return false
+	}
+	if _, ok := cc["private"]; ok {
+		return false
+	}
+	if slices.Contains(varyHeaders(h), "*") {
+		return false
+	}
+	if r.Header.Get("Authorization") != "" {
+		_, public := cc["public"]
+		_, smaxage := cc["s-maxage"]
+		_, mustRevalidate := cc["must-revalidate"]
+		if !public && !smaxage && !mustRevalidate {
+			return false
+		}
+	}
+	_, explicit := freshness(h, cc)
+	return explicit || h.Get("Etag") != "" || h.Get("Last-Modified") != ""
+}
+
+// freshness returns the freshness lifetime given by the header and
+// reports whether the header gives one explicitly.
+func freshness(h http.Header, cc map[string]string) (time.Duration, bool) {
+	for _, d := range []string{"s-maxage", "max-age"} {
+		if v, ok := cc[d]; ok {
+			secs, err := strconv.Atoi(v)
+			if err != nil || secs < 0 {
+				return 0, true
+			}
+			return time.Duration(secs) * time.Second, true
+		}
+	}
+	if v := h.Get("Expires"); v != "" {
+		exp, err := http.ParseTime(v)
+		if err != nil {
+			return 0, true
+		}
+		date, err := http.ParseTime(h.Get("Date"))
+		if err != nil {
+			date = time.Now()
+		}
+		return max(exp.Sub(date), 0), true
+	}
+	return 0, false
+}
+
+// parseCacheControl returns the directives of the Cache-Control header.
+func parseCacheControl(h http.Header) map[string]string {
+	cc := make(map[string]string)
+	for _, v := range h.Values("Cache-Control") {
+		for _, d := range strings.Split(v, ",") {
+			d = strings.TrimSpace(d)
+			if d == "" {
+				continue
+			}
+			name, val, _ := strings.Cut(d, "=")
+			cc[strings.ToLower(name)] = strings.Trim(val, `"`)
+		}
+	}
+	return cc
+}
+
+// varyHeaders returns the canonical header names of the Vary header.
+func varyHeaders(h http.Header) []string {
+	var names []string
+	for _, v := range h.Values("Vary") {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	return names
+}
+
+// cacheWriter passes a response to the client while recording it.
+// With hold304, a 304 response is held back instead.
+type cacheWriter struct {
+	w        http.ResponseWriter
+	header   http.Header
+	hold304  bool
+	held     bool
+	status   int
+	body     bytes.Buffer
+	max      int64
+	overflow bool
+}
+
+func (cw *cacheWriter) Header() http.Header {
+	return cw.header
+}
+
+func (cw *cacheWriter) WriteHeader(code int) {
+	if cw.status != 0 {
+		return
+	}
+	if code < 200 {
+		copyHeader(cw.w.Header(), cw.header)
+		cw.w.WriteHeader(code)
+		return
+	}
+	cw.status = code
+	if cw.hold304 && code == http.StatusNotModified {
+		cw.held = true
+		return
+	}
+	h := cw.w.Header()
+	for k, vv := range cw.header {
+		h[k] = vv
+	}
+	h.Set("X-Cache", "MISS")
+	cw.w.WriteHeader(code)
+}
+
+func (cw *cacheWriter) Write(b []byte) (int, error) {
+	if cw.status == 0 {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if cw.held {
+		return len(b), nil
+	}
+	if !cw.overflow {
+		if int64(cw.body.Len()+len(b)) > cw.max {
+			cw.overflow = true
+			cw.body = bytes.Buffer{}
+		} else {
+			cw.body.Write(b)
+		}
+	}
+	return cw.w.Write(b)
+}
+
+// FlushError flushes the response unless it is held back.
+func (cw *cacheWriter) FlushError() error {
+	if cw.held || cw.status == 0 {
+		return nil
+	}
+	return http.NewResponseController(cw.w).Flush()
+}
+
+// discardWriter is a ResponseWriter which discards the response.
+type discardWriter struct {
+	header http.Header
+}
+
+func (d *discardWriter) Header() http.Header         { return d.header }
+func (d *discardWriter) WriteHeader(int)             {}
+func (d *discardWriter) Write(b []byte) (int, error) { return len(b), nil }
+
+// diskCache is the disk tier of a cache. It keeps the
+// variants of a key in a file named after the key's hash.
+type diskCache struct {
+	dir string
+	max int64 // size in bytes, 0 for no limit
+
+	mu   sync.Mutex
+	used int64
+}
+
+// file returns the filename of the key.
+func (d *diskCache) file(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(d.dir, hex.EncodeToString(sum[:]))
+}
+
+// load returns the stored variants of the key.
+func (d *diskCache) load(key string) []*cacheEntry {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.read(d.file(key))
+}
+
+// read decodes a file of variants.
+func (d *diskCache) read(name string) []*cacheEntry {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	var variants []*cacheEntry
+	if err := gob.NewDecoder(f).Decode(&variants); err != nil {
+		log.Printf("Error reading cache file %s: %v", name, err)
+		return nil
+	}
+	return variants
+}
+
+// store adds or replaces the variant of the entry.
+func (d *diskCache) store(e *cacheEntry) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	name := d.file(e.Key)
+	variants := slices.DeleteFunc(d.read(name), e.sameVariant)
+	variants = append(variants, e)
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(variants); err != nil {
+		log.Printf("Error writing cache file: %v", err)
+		return
+	}
+	if fi, err := os.Stat(name); err == nil {
+		d.used -= fi.Size()
+	}
+	tmp := name + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0644); err != nil {
+		log.Printf("Error writing cache file: %v", err)
+		return
+	}
+	if err := os.Rename(tmp, name); err != nil {
+		log.Printf("Error writing cache file: %v", err)
+		return
+	}
+	d.used += int64(buf.Len())
+	if d.max > 0 && d.used > d.max {
+		go d.prune()
+	}
+}
+
+// remove removes the file of the key or, if prefix is true, the
+// files of all keys with the given prefix. It returns the removed keys.
+func (d *diskCache) remove(key string, prefix bool) []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !prefix {
+		if os.Remove(d.file(key)) == nil {
+			return []string{key}
+		}
+		return nil
+	}
+	var keys []string
+	names, _ := filepath.Glob(filepath.Join(d.dir, "*"))
+	for _, name := range names {
+		variants := d.read(name)
+		if len(variants) > 0 && strings.HasPrefix(variants[0].Key, key) {
+			os.Remove(name)
+			keys = append(keys, variants[0].Key)
+		}
+	}
+	return keys
+}
+
+// prune removes the least recently written files until the disk tier
+// uses less than 90% of its size, and recomputes the used size.
+func (d *diskCache) prune() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	entries, err := os.ReadDir(d.dir)
+	if err != nil {
+		log.Printf("Error pruning cache: %v", err)
+		return
+	}
+	var files []os.FileInfo
+	d.used = 0
+	for _, de := range entries {
+		if fi, err := de.Info(); err == nil && fi.Mode().IsRegular() {
+			files = append(files, fi)
+			d.used += fi.Size()
+		}
+	}
+	if d.max <= 0 {
+		return
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].ModTime().Before(files[j].ModTime()) })
+	for _, fi := range files {
+		if d.used <= d.max*9/10 {
+			break
+		}
+		if os.Remove(filepath.Join(d.dir, fi.Name())) == nil {
+			d.used -= fi.Size()
+		}
+	}
+}
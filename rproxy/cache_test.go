@@ -0,0 +1,195 @@
+// Copyright (c) 2014 David R. Jenni. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+// cachedProxy returns a caching proxy in front of h
+// and a counter of the requests h received.
+func cachedProxy(t *testing.T, h http.HandlerFunc) (*reverseProxy, *atomic.Int32) {
+	var n atomic.Int32
+	counted := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n.Add(1)
+		h(w, r)
+	})
+	p := newTestProxy(t, counted, &config{Routes: []*routeConfig{{Upstream: "a", Cache: true}}})
+	var err error
+	if p.cache, err = newCache(1<<20, t.TempDir(), 0); err != nil {
+		t.Fatal(err)
+	}
+	return p, &n
+}
+
+func get(p http.Handler, path string, header ...string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("GET", path, nil)
+	for i := 0; i+1 < len(header); i += 2 {
+		r.Header.Set(header[i], header[i+1])
+	}
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, r)
+	return w
+}
+
+func TestCacheHit(t *testing.T) {
+	p, n := cachedProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		fmt.Fprint(w, "hello")
+	})
+
+	if w := get(p, "/a"); w.Header().Get("X-Cache") != "MISS" {
+		t.Errorf("Expected MISS, got %q", w.Header().Get("X-Cache"))
+	}
+	w := get(p, "/a")
+	if w.Header().Get("X-Cache") != "HIT" || w.Body.String() != "hello" {
+		t.Errorf("Expected HIT hello, got %q %q", w.Header().Get("X-Cache"), w.Body.String())
+	}
+	if n.Load() != 1 {
+		t.Errorf("Expected 1 upstream request, got %d", n.Load())
+	}
+
+	get(p, "/a", "Cache-Control", "no-cache")
+	if n.Load() != 2 {
+		t.Errorf("Expected no-cache to reach the upstream")
+	}
+}
+
+func TestCacheNoStore(t *testing.T) {
+	p, n := cachedProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-store, max-age=60")
+		fmt.Fprint(w, "secret")
+	})
+
+	get(p, "/a")
+	get(p, "/a")
+	if n.Load() != 2 {
+		t.Errorf("Expected 2 upstream requests, got %d", n.Load())
+	}
+}
+
+func TestCacheVary(t *testing.T) {
+	p, n := cachedProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Vary", "Accept-Language")
+		fmt.Fprint(w, r.Header.Get("Accept-Language"))
+	})
+
+	get(p, "/a", "Accept-Language", "de")
+	get(p, "/a", "Accept-Language", "fr")
+	if w := get(p, "/a", "Accept-Language", "de"); w.Body.String() != "de" {
+		t.Errorf("Expected de, got %q", w.Body.String())
+	}
+	if n.Load() != 2 {
+		t.Errorf("Expected 2 upstream requests, got %d", n.Load())
+	}
+}
+
+func TestCacheRevalidate(t *testing.T) {
+	p, n := cachedProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Etag", `"v1"`)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		fmt.Fprint(w, "body")
+	})
+
+	get(p, "/a")
+	w := get(p, "/a")
+	if w.Header().Get("X-Cache") != "REVALIDATED" || w.Body.String() != "body" {
+		t.Errorf("Expected REVALIDATED body, got %q %q", w.Header().Get("X-Cache"), w.Body.String())
+	}
+	if n.Load() != 2 {
+		t.Errorf("Expected 2 upstream requests, got %d", n.Load())
+	}
+}
+
+func TestCachePurge(t *testing.T) {
+	p, n := cachedProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		fmt.Fprint(w, "hello")
+	})
+
+	get(p, "/a")
+	r := httptest.NewRequest("POST", "/cache/purge?url=http://example.com/a", nil)
+	w := httptest.NewRecorder()
+	newAdminHandler(p, "").ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", w.Code)
+	}
+	get(p, "/a")
+	if n.Load() != 2 {
+		t.Errorf("Expected 2 upstream requests after the purge, got %d", n.Load())
+	}
+}
+
+func TestCacheRange(t *testing.T) {
+	p, _ := cachedProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		if r.URL.Path == "/encoded" {
+			w.Header().Set("Content-Encoding", "br")
+		}
+		w.Header().Set("Content-Length", "10")
+		fmt.Fprint(w, "0123456789")
+	})
+
+	get(p, "/plain")
+	w := get(p, "/plain", "Range", "bytes=2-4")
+	if w.Code != http.StatusPartialContent || w.Body.String() != "234" {
+		t.Errorf("Expected 206 234, got %d %q", w.Code, w.Body.String())
+	}
+	if got := w.Header().Get("Content-Length"); got != "3" {
+		t.Errorf("Expected Content-Length 3, got %q", got)
+	}
+
+	get(p, "/encoded")
+	w = get(p, "/encoded", "Range", "bytes=2-4")
+	if w.Code != http.StatusOK || w.Body.String() != "0123456789" {
+		t.Errorf("Expected the whole encoded body, got %d %q", w.Code, w.Body.String())
+	}
+	if got := w.Header().Get("Content-Length"); got != "10" {
+		t.Errorf("Expected Content-Length 10, got %q", got)
+	}
+}
+
+func TestCacheRoutes(t *testing.T) {
+	target := func(body string) string {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Cache-Control", "max-age=60")
+			fmt.Fprint(w, body)
+		}))
+		t.Cleanup(ts.Close)
+		return ts.URL
+	}
+	p := newTestProxy(t, nil, &config{
+		Upstreams: map[string]*upstreamConfig{
+			"a": {Targets: []targetConfig{{URL: target("a")}}},
+			"b": {Targets: []targetConfig{{URL: target("b")}}},
+		},
+		Routes: []*routeConfig{
+			{Upstream: "b", Headers: map[string]string{"X-Version": "2"}, Cache: true},
+			{Upstream: "a", Cache: true},
+		},
+	})
+	var err error
+	if p.cache, err = newCache(1<<20, t.TempDir(), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if w := get(p, "/x"); w.Body.String() != "a" {
+			t.Errorf("Expected a, got %q", w.Body.String())
+		}
+		if w := get(p, "/x", "X-Version", "2"); w.Body.String() != "b" {
+			t.Errorf("Expected b, got %q %s", w.Body.String(), w.Header().Get("X-Cache"))
+		}
+	}
+}
@@ -0,0 +1,505 @@
+// Copyright (c) 2014 David R. Jenni. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"time"
+)
+
+// Defaults of the health checks and the outlier ejection.
+const (
+	defaultHealthInterval = 10 * time.Second
+	defaultHealthTimeout  = 2 * time.Second
+	defaultEjectAfter     = 5
+	defaultEjectTime      = 10 * time.Second
+)
+
+// Defaults of the connections to the targets.
+const (
+	defaultDialTimeout     = 10 * time.Second
+	defaultTLSTimeout      = 10 * time.Second
+	defaultIdleConnTimeout = 90 * time.Second
+	defaultKeepAlive       = 30 * time.Second
+	defaultWebsocketIdle   = time.Hour
+)
+
+// config is the configuration of rproxy.
+type config struct {
+	Upstreams map[string]*upstreamConfig `json:"upstreams"`
+	Routes    []*routeConfig             `json:"routes"`
+	Streams   []*streamConfig            `json:"streams"`
+
+	Access     []*accessRuleConfig `json:"access"`     // rules checked before the routes
+	ErrorPages map[string]string   `json:"errorPages"` // files answered instead of errors, by status
+}
+
+// upstreamConfig configures a named upstream.
+type upstreamConfig struct {
+	Targets   []targetConfig   `json:"targets"`
+	Strategy  string           `json:"strategy"`  // balancing strategy
+	Hash      string           `json:"hash"`      // header hashed by the hash strategy
+	Health    *healthConfig    `json:"health"`    // active health checks, if any
+	Eject     *ejectConfig     `json:"eject"`     // passive outlier ejection
+	Retry     *retryConfig     `json:"retry"`     // retries of idempotent requests
+	Breaker   *breakerConfig   `json:"breaker"`   // circuit breaker
+	Transport *transportConfig `json:"transport"` // timeouts and pool of the connections
+
+	CA            string `json:"ca"`            // PEM file with the CA certificates of https targets
+	RewriteHost   bool   `json:"rewriteHost"`   // sets the Host header to the target instead of the client's
+	H2C           bool   `json:"h2c"`           // speaks HTTP/2 to the targets, cleartext to http targets
+	ProxyProtocol int    `json:"proxyProtocol"` // version of the PROXY protocol header sent to the targets
+}
+
+// targetConfig configures a backend of an upstream.
+type targetConfig struct {
+	URL    string `json:"url"`
+	Weight int    `json:"weight"`
+}
+
+// transportConfig configures the connections to the targets of an
+// upstream. Negative KeepAlive and WebsocketIdleTimeout disable them.
+type transportConfig struct {
+	DialTimeout           duration `json:"dialTimeout"`           // timeout connecting, defaults to 10s
+	TLSHandshakeTimeout   duration `json:"tlsHandshakeTimeout"`   // defaults to 10s
+	ResponseHeaderTimeout duration `json:"responseHeaderTimeout"` // time until the response header, 0 for none
+	IdleConnTimeout       duration `json:"idleConnTimeout"`       // time an unused connection is kept, defaults to 90s
+	MaxIdleConns          int      `json:"maxIdleConns"`          // unused connections kept per target, defaults to 2
+	MaxConns              int      `json:"maxConns"`              // connections per target, 0 for no limit
+	KeepAlive             duration `json:"keepAlive"`             // interval of TCP keepalive probes, defaults to 30s
+	DisableKeepAlives     bool     `json:"disableKeepAlives"`     // uses a connection for a single request
+	WebsocketIdleTimeout  duration `json:"websocketIdleTimeout"`  // closes websockets idle for this time, defaults to 1h
+}
+
+// healthConfig configures the active health checks of an upstream.
+type healthConfig struct {
+	Path     string   `json:"path"`
+	Interval duration `json:"interval"`
+	Timeout  duration `json:"timeout"`
+	Status   int      `json:"status"`
+}
+
+// ejectConfig configures the passive outlier ejection of an upstream.
+type ejectConfig struct {
+	After int      `json:"after"`
+	Time  duration `json:"time"`
+}
+
+// retryConfig configures the retries of idempotent requests after
+// connection errors or responses with one of the given statuses.
+type retryConfig struct {
+	Retries    int      `json:"retries"`
+	Statuses   []int    `json:"statuses"`
+	Backoff    duration `json:"backoff"`
+	MaxBackoff duration `json:"maxBackoff"`
+	MaxBody    int64    `json:"maxBody"` // largest replayable request body in bytes
+}
+
+// breakerConfig configures the circuit breaker of an upstream.
+type breakerConfig struct {
+	Failures int      `json:"failures"` // consecutive failures which open the breaker
+	Open     duration `json:"open"`     // time before a trial request
+}
+
+// streamConfig configures a TCP or UDP listener whose connections
+// are passed to an upstream.
+type streamConfig struct {
+	Listen        string            `json:"listen"`
+	Protocol      string            `json:"protocol"` // tcp (default) or udp
+	Upstream      string            `json:"upstream"` // upstream if no server name matches
+	SNI           map[string]string `json:"sni"`      // upstreams by TLS server name
+	IdleTimeout   duration          `json:"idleTimeout"`
+	ProxyProtocol bool              `json:"proxyProtocol"` // clients start with a PROXY protocol header
+}
+
+// routeConfig configures a route. All given conditions must match.
+type routeConfig struct {
+	Name        string              `json:"name"`        // name in logs, defaults to the upstream
+	Host        string              `json:"host"`        // host, "*.example.com" matches subdomains
+	Prefix      string              `json:"prefix"`      // path prefix
+	Regex       string              `json:"regex"`       // path regular expression
+	Methods     []string            `json:"methods"`     // request methods
+	Headers     map[string]string   `json:"headers"`     // header values
+	Upstream    string              `json:"upstream"`    // name of the upstream
+	Split       []*splitConfig      `json:"split"`       // upstreams sharing the requests instead of Upstream
+	Affinity    string              `json:"affinity"`    // keeps clients on their backend: ip or cookie:Name
+	StripPrefix bool                `json:"stripPrefix"` // removes the prefix from the path
+	Rewrite     string              `json:"rewrite"`     // replacement of the regex match in the path
+	ClientCert  bool                `json:"clientCert"`  // requires a verified client certificate
+	Cache       bool                `json:"cache"`       // caches the responses
+	Limit       *limitConfig        `json:"limit"`       // rate and connection limits
+	Auth        *authConfig         `json:"auth"`        // authentication of the clients
+	Mirror      *mirrorConfig       `json:"mirror"`      // shadow upstream
+	Faults      []*faultConfig      `json:"faults"`      // injected faults
+	Websocket   *websocketConfig    `json:"websocket"`   // inspection of the websocket frames
+	Access      []*accessRuleConfig `json:"access"`      // rules checked after the route matched
+	MaxBody     int64               `json:"maxBody"`     // largest request body in bytes
+
+	RequestHeaders  []headerRuleConfig `json:"requestHeaders"`  // rules for the headers sent to the upstream
+	ResponseHeaders []headerRuleConfig `json:"responseHeaders"` // rules for the headers sent to the client
+}
+
+// limitConfig configures the limits of a route. Key selects the
+// token bucket of a request: ip, route or header:Name.
+type limitConfig struct {
+	Rate          float64 `json:"rate"`          // requests per second
+	Burst         int     `json:"burst"`         // requests above the rate
+	Key           string  `json:"key"`           // bucket key, defaults to ip
+	MaxConns      int     `json:"maxConns"`      // concurrent connections per client IP
+	MaxWebsockets int     `json:"maxWebsockets"` // concurrent websockets per client IP
+}
+
+// authConfig configures the authentication of a route
+// with exactly one of Basic, JWT or Forward.
+type authConfig struct {
+	Basic   *basicAuthConfig   `json:"basic"`
+	JWT     *jwtConfig         `json:"jwt"`
+	Forward *forwardAuthConfig `json:"forward"`
+}
+
+// basicAuthConfig configures basic authentication.
+type basicAuthConfig struct {
+	Htpasswd string `json:"htpasswd"` // file with bcrypt or SHA hashes
+	Realm    string `json:"realm"`
+}
+
+// jwtConfig configures the verification of JSON Web Tokens.
+type jwtConfig struct {
+	Keys     string            `json:"keys"`     // JWKS or PEM file with the public keys
+	Issuer   string            `json:"issuer"`   // required iss claim
+	Audience string            `json:"audience"` // required aud claim
+	Claims   map[string]string `json:"claims"`   // required claim values
+	Query    string            `json:"query"`    // query parameter with the token
+	Cookie   string            `json:"cookie"`   // cookie with the token
+}
+
+// forwardAuthConfig configures the subrequests to an auth service.
+type forwardAuthConfig struct {
+	URL     string   `json:"url"`
+	Headers []string `json:"headers"` // response headers copied to the request
+	Timeout duration `json:"timeout"`
+}
+
+// mirrorConfig configures the mirroring of requests to a shadow
+// upstream. The responses of the shadow are discarded.
+type mirrorConfig struct {
+	Upstream      string   `json:"upstream"`      // name of the shadow upstream
+	Percent       *float64 `json:"percent"`       // share of the mirrored requests, defaults to 100
+	Diff          bool     `json:"diff"`          // logs differences of the responses
+	IgnoreHeaders []string `json:"ignoreHeaders"` // headers not compared besides Date
+	MaxBody       int64    `json:"maxBody"`       // largest mirrored request body in bytes
+}
+
+// accessRuleConfig configures a rule which allows or denies the
+// requests matching all its given conditions.
+type accessRuleConfig struct {
+	Action  string            `json:"action"`  // allow or deny
+	CIDRs   []string          `json:"cidrs"`   // client networks or IP addresses
+	Methods []string          `json:"methods"` // request methods
+	Path    string            `json:"path"`    // path regular expression
+	Headers map[string]string `json:"headers"` // header values
+	Status  int               `json:"status"`  // answered to denied requests, defaults to 403
+}
+
+// splitConfig configures an upstream which receives Weight of
+// the requests of a route, and those with one of the given Headers
+// or Cookies.
+type splitConfig struct {
+	Upstream string            `json:"upstream"`
+	Weight   int               `json:"weight"`  // relative share of the requests
+	Headers  map[string]string `json:"headers"` // header values which ask for the upstream
+	Cookies  map[string]string `json:"cookies"` // cookie values which ask for the upstream
+}
+
+// faultConfig configures a fault injected into the requests of a
+// route. A fault applies to Percent of the requests with the given
+// Headers; all its effects are injected.
+type faultConfig struct {
+	Percent   *float64          `json:"percent"`   // share of the requests, defaults to 100
+	Headers   map[string]string `json:"headers"`   // header values the requests must have
+	Delay     duration          `json:"delay"`     // added latency
+	Abort     int               `json:"abort"`     // status answered instead of forwarding
+	Bandwidth int64             `json:"bandwidth"` // bytes per second of the response body
+	DropAfter int               `json:"dropAfter"` // websocket messages before the connection is dropped
+	Corrupt   bool              `json:"corrupt"`   // corrupts the response body
+}
+
+// websocketConfig configures the inspection of the websocket frames of a route.
+type websocketConfig struct {
+	Log        bool     `json:"log"`        // logs text messages
+	Tee        bool     `json:"tee"`        // writes text messages to the file given by -ws-tee
+	MaxMessage int64    `json:"maxMessage"` // largest message in bytes
+	Ping       duration `json:"ping"`       // idle time before pings are sent
+}
+
+// headerRuleConfig configures a header rule. Op is add, set, remove
+// or replace; replace substitutes Value for the matches of Regex.
+type headerRuleConfig struct {
+	Op    string `json:"op"`
+	Name  string `json:"name"`
+	Value string `json:"value"`
+	Regex string `json:"regex"`
+}
+
+// duration is a time.Duration read from a string like "1m30s".
+type duration time.Duration
+
+// UnmarshalJSON parses a duration string.
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+// orDefault returns the duration, or def if it is zero.
+func (d duration) orDefault(def time.Duration) time.Duration {
+	if d == 0 {
+		return def
+	}
+	return time.Duration(d)
+}
+
+// readConfig reads a JSON configuration file.
+func readConfig(name string) (*config, error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var c config
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	return &c, nil
+}
+
+// newUpstreamFromConfig returns the upstream described by c.
+func newUpstreamFromConfig(name string, c *upstreamConfig) (*upstream, error) {
+	var targets []string
+	var weights []int
+	for _, t := range c.Targets {
+		targets = append(targets, t.URL)
+		w := t.Weight
+		if w == 0 {
+			w = 1
+		}
+		weights = append(weights, w)
+	}
+	u, err := newUpstream(targets, weights, c.Strategy, c.Hash)
+	if err != nil {
+		return nil, err
+	}
+	u.name = name
+	u.config = c
+	u.rewriteHost = c.RewriteHost
+	u.proxyProtocol = c.ProxyProtocol
+	if u.proxyProtocol < 0 || u.proxyProtocol > 2 {
+		return nil, fmt.Errorf("unknown PROXY protocol version %d", u.proxyProtocol)
+	}
+	if c.CA != "" {
+		pem, err := os.ReadFile(c.CA)
+		if err != nil {
+			return nil, err
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no certificates", c.CA)
+		}
+		u.tls = &tls.Config{RootCAs: roots}
+	}
+	if err := u.configureTransport(c.Transport); err != nil {
+		return nil, err
+	}
+	if c.H2C {
+		u.transport.Protocols = new(http.Protocols)
+		u.transport.Protocols.SetHTTP2(true)
+		u.transport.Protocols.SetUnencryptedHTTP2(true)
+	}
+	u.eject = ejection{failures: defaultEjectAfter, duration: defaultEjectTime}
+	if c.Eject != nil {
+		u.eject = ejection{failures: c.Eject.After, duration: c.Eject.Time.orDefault(defaultEjectTime)}
+	}
+	if c.Retry != nil {
+		u.retry = retryPolicy{
+			retries:    c.Retry.Retries,
+			statuses:   c.Retry.Statuses,
+			backoff:    c.Retry.Backoff.orDefault(defaultRetryBackoff),
+			maxBackoff: c.Retry.MaxBackoff.orDefault(defaultRetryMaxBackoff),
+			maxBody:    c.Retry.MaxBody,
+		}
+		if u.retry.statuses == nil {
+			u.retry.statuses = []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout}
+		}
+		if u.retry.maxBody == 0 {
+			u.retry.maxBody = defaultRetryMaxBody
+		}
+	}
+	u.breaker = breaker{name: name}
+	if c.Breaker != nil {
+		u.breaker.failures = c.Breaker.Failures
+		u.breaker.openTime = c.Breaker.Open.orDefault(defaultBreakerOpen)
+	}
+	if c.Health != nil {
+		u.health = &healthCheck{
+			path:     c.Health.Path,
+			interval: c.Health.Interval.orDefault(defaultHealthInterval),
+			timeout:  c.Health.Timeout.orDefault(defaultHealthTimeout),
+			status:   c.Health.Status,
+		}
+		if u.health.status == 0 {
+			u.health.status = 200
+		}
+	}
+	return u, nil
+}
+
+// configureTransport sets up the connections of the upstream to its
+// targets as described by c, which may be nil for the defaults.
+func (u *upstream) configureTransport(c *transportConfig) error {
+	if c == nil {
+		c = &transportConfig{}
+	}
+	if c.DialTimeout < 0 || c.TLSHandshakeTimeout < 0 || c.ResponseHeaderTimeout < 0 || c.IdleConnTimeout < 0 {
+		return fmt.Errorf("negative timeout")
+	}
+	if c.MaxIdleConns < 0 || c.MaxConns < 0 {
+		return fmt.Errorf("negative number of connections")
+	}
+	u.dialer = &net.Dialer{
+		Timeout:   c.DialTimeout.orDefault(defaultDialTimeout),
+		KeepAlive: c.KeepAlive.orDefault(defaultKeepAlive),
+	}
+	u.wsIdle = max(c.WebsocketIdleTimeout.orDefault(defaultWebsocketIdle), 0)
+	u.transport = http.DefaultTransport.(*http.Transport).Clone()
+	u.transport.TLSClientConfig = u.tls
+	u.transport.DialContext = u.dialContext
+	u.transport.TLSHandshakeTimeout = c.TLSHandshakeTimeout.orDefault(defaultTLSTimeout)
+	u.transport.ResponseHeaderTimeout = time.Duration(c.ResponseHeaderTimeout)
+	u.transport.IdleConnTimeout = c.IdleConnTimeout.orDefault(defaultIdleConnTimeout)
+	u.transport.MaxConnsPerHost = c.MaxConns
+	if c.MaxIdleConns > 0 {
+		u.transport.MaxIdleConns = 0 // limited per target only
+		u.transport.MaxIdleConnsPerHost = c.MaxIdleConns
+	}
+	// A connection with a PROXY protocol header carries the address
+	// of a single client.
+	u.transport.DisableKeepAlives = c.DisableKeepAlives || u.proxyProtocol != 0
+	return nil
+}
+
+// newRoute returns the route described by c.
+func newRoute(c *routeConfig, upstreams map[string]*upstream) (*route, error) {
+	rt := &route{
+		name:        c.Name,
+		host:        c.Host,
+		prefix:      c.Prefix,
+		methods:     c.Methods,
+		headers:     c.Headers,
+		stripPrefix: c.StripPrefix,
+		rewrite:     c.Rewrite,
+		clientCert:  c.ClientCert,
+		cache:       c.Cache,
+	}
+	if rt.name == "" {
+		rt.name = c.Upstream
+		if len(c.Split) > 0 {
+			rt.name = c.Split[0].Upstream
+		}
+	}
+	if rt.cache {
+		// Routes configured alike share their cached responses,
+		// also across reloads.
+		b, err := json.Marshal(c)
+		if err != nil {
+			return nil, fmt.Errorf("route %s: %v", rt.name, err)
+		}
+		sum := sha256.Sum256(b)
+		rt.cacheID = hex.EncodeToString(sum[:8])
+	}
+	var err error
+	if len(c.Split) > 0 {
+		if c.Upstream != "" {
+			return nil, fmt.Errorf("route %s: upstream and split", rt.name)
+		}
+		if rt.split, err = newSplits(c.Split, upstreams); err != nil {
+			return nil, fmt.Errorf("route %s: %v", rt.name, err)
+		}
+	} else {
+		var ok bool
+		if rt.upstream, ok = upstreams[c.Upstream]; !ok {
+			return nil, fmt.Errorf("route %s: unknown upstream %q", rt.name, c.Upstream)
+		}
+	}
+	if err := checkAffinity(c.Affinity); err != nil {
+		return nil, fmt.Errorf("route %s: %v", rt.name, err)
+	}
+	rt.affinity = c.Affinity
+	if rt.access, err = newAccessRules(c.Access); err != nil {
+		return nil, fmt.Errorf("route %s: %v", rt.name, err)
+	}
+	if rt.maxBody = c.MaxBody; rt.maxBody < 0 {
+		return nil, fmt.Errorf("route %s: negative maxBody", rt.name)
+	}
+	if c.Regex != "" {
+		if rt.regex, err = regexp.Compile(c.Regex); err != nil {
+			return nil, fmt.Errorf("route %s: %v", rt.name, err)
+		}
+	}
+	if c.Rewrite != "" && rt.regex == nil {
+		return nil, fmt.Errorf("route %s: rewrite without regex", rt.name)
+	}
+	if l := c.Limit; l != nil {
+		if rt.limiter, err = newLimiter(l.Rate, l.Burst, l.Key, l.MaxConns, l.MaxWebsockets); err != nil {
+			return nil, fmt.Errorf("route %s: %v", rt.name, err)
+		}
+	}
+	if c.Mirror != nil {
+		u, ok := upstreams[c.Mirror.Upstream]
+		if !ok {
+			return nil, fmt.Errorf("route %s: unknown mirror upstream %q", rt.name, c.Mirror.Upstream)
+		}
+		rt.mirror = newMirror(u, c.Mirror.Percent, c.Mirror.Diff, c.Mirror.IgnoreHeaders, c.Mirror.MaxBody)
+	}
+	if c.Auth != nil {
+		if rt.auth, err = newAuthenticator(c.Auth); err != nil {
+			return nil, fmt.Errorf("route %s: %v", rt.name, err)
+		}
+	}
+	if ws := c.Websocket; ws != nil {
+		if ws.MaxMessage < 0 || ws.Ping < 0 {
+			return nil, fmt.Errorf("route %s: negative websocket limit", rt.name)
+		}
+		rt.inspection = &wsInspection{log: ws.Log, tee: ws.Tee, maxMessage: ws.MaxMessage, ping: time.Duration(ws.Ping)}
+	}
+	for _, fc := range c.Faults {
+		f, err := newFault(fc)
+		if err != nil {
+			return nil, fmt.Errorf("route %s: %v", rt.name, err)
+		}
+		rt.faults = append(rt.faults, f)
+	}
+	if rt.requestHeaders, err = newHeaderRules(c.RequestHeaders); err != nil {
+		return nil, fmt.Errorf("route %s: %v", rt.name, err)
+	}
+	if rt.responseHeaders, err = newHeaderRules(c.ResponseHeaders); err != nil {
+		return nil, fmt.Errorf("route %s: %v", rt.name, err)
+	}
+	return rt, nil
+}
@@ -0,0 +1,153 @@
+// Copyright (c) 2014 David R. Jenni. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"time"
+)
+
+// fault is a rule which injects faults into a share of the
+// requests of a route, or into those with the given headers.
+type fault struct {
+	percent float64           // share of the requests
+	headers map[string]string // header values the requests must have
+
+	delay     time.Duration // added before the request is forwarded
+	abort     int           // status answered instead of forwarding, 0 for none
+	bandwidth int64         // bytes per second of the response body, 0 for no limit
+	dropAfter int           // websocket messages before the connection is dropped, 0 for never
+	corrupt   bool          // inverts a byte of every chunk of the response body
+}
+
+// newFault returns the fault described by c.
+func newFault(c *faultConfig) (*fault, error) {
+	f := &fault{
+		percent:   100,
+		headers:   c.Headers,
+		delay:     time.Duration(c.Delay),
+		abort:     c.Abort,
+		bandwidth: c.Bandwidth,
+		dropAfter: c.DropAfter,
+		corrupt:   c.Corrupt,
+	}
+	if c.Percent != nil {
+		f.percent = *c.Percent
+	}
+	if f.percent < 0 || f.percent > 100 {
+		return nil, fmt.Errorf("fault percent %v out of range", f.percent)
+	}
+	if f.abort != 0 && (f.abort < 200 || f.abort > 599) {
+		return nil, fmt.Errorf("invalid fault status %d", f.abort)
+	}
+	if f.delay < 0 || f.bandwidth < 0 || f.dropAfter < 0 {
+		return nil, fmt.Errorf("negative fault")
+	}
+	if f.delay == 0 && f.abort == 0 && f.bandwidth == 0 && f.dropAfter == 0 && !f.corrupt {
+		return nil, fmt.Errorf("fault without effect")
+	}
+	return f, nil
+}
+
+// applies reports whether the fault is injected into the request.
+func (f *fault) applies(r *http.Request) bool {
+	for k, v := range f.headers {
+		if r.Header.Get(k) != v {
+			return false
+		}
+	}
+	return rand.Float64()*100 < f.percent
+}
+
+// injectFaults injects the faults of the route which apply to the
+// request. It returns the writer for the response, and false if the
+// request was aborted or canceled while it was delayed.
+func injectFaults(w http.ResponseWriter, r *http.Request, st *proxyState) (http.ResponseWriter, bool) {
+	for _, f := range st.route.faults {
+		if !f.applies(r) {
+			continue
+		}
+		if f.delay > 0 {
+			t := time.NewTimer(f.delay)
+			select {
+			case <-t.C:
+			case <-r.Context().Done():
+				t.Stop()
+				return w, false
+			}
+		}
+		if f.abort != 0 {
+			http.Error(w, "Fault injected.", f.abort)
+			return w, false
+		}
+		if f.dropAfter > 0 {
+			st.dropAfter = f.dropAfter
+		}
+		if isWebsocket(r) {
+			continue // the body faults apply to HTTP responses
+		}
+		if f.bandwidth > 0 {
+			w = &throttleWriter{ResponseWriter: w, rate: f.bandwidth, start: time.Now()}
+		}
+		if f.corrupt {
+			w = &corruptWriter{w}
+		}
+	}
+	return w, true
+}
+
+// throttleWriter limits the bandwidth of a response body.
+type throttleWriter struct {
+	http.ResponseWriter
+	rate    int64 // bytes per second
+	start   time.Time
+	written int64
+}
+
+func (w *throttleWriter) Write(b []byte) (int, error) {
+	// Write a tenth of a second at a time.
+	chunk := max(int(w.rate/10), 1)
+	n := 0
+	for len(b) > 0 {
+		k := min(len(b), chunk)
+		m, err := w.ResponseWriter.Write(b[:k])
+		n += m
+		w.written += int64(m)
+		if err != nil {
+			return n, err
+		}
+		http.NewResponseController(w.ResponseWriter).Flush()
+		time.Sleep(time.Until(w.start.Add(time.Duration(w.written * int64(time.Second) / w.rate))))
+		b = b[k:]
+	}
+	return n, nil
+}
+
+// Unwrap returns the underlying ResponseWriter.
+func (w *throttleWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// corruptWriter inverts a random byte of every chunk of a response body.
+type corruptWriter struct {
+	http.ResponseWriter
+}
+
+func (w *corruptWriter) Write(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	c := make([]byte, len(b))
+	copy(c, b)
+	c[rand.IntN(len(c))] ^= 0xff
+	return w.ResponseWriter.Write(c)
+}
+
+// Unwrap returns the underlying ResponseWriter.
+func (w *corruptWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,136 @@
+// Copyright (c) 2014 David R. Jenni. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// faultProxy returns a proxy with the faults in front of a target
+// which answers with body.
+func faultProxy(t *testing.T, body string, faults ...*faultConfig) *reverseProxy {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, body)
+	})
+	return newTestProxy(t, h, &config{Routes: []*routeConfig{{Upstream: "a", Faults: faults}}})
+}
+
+// percent returns a pointer to the percentage p.
+func percent(p float64) *float64 {
+	return &p
+}
+
+func TestFaultAbortDelay(t *testing.T) {
+	p := faultProxy(t, "ok",
+		&faultConfig{Headers: map[string]string{"X-Fault": "abort"}, Abort: http.StatusServiceUnavailable},
+		&faultConfig{Headers: map[string]string{"X-Fault": "delay"}, Delay: duration(50 * time.Millisecond)},
+		&faultConfig{Headers: map[string]string{"X-Fault": "half"}, Percent: percent(50), Abort: http.StatusTeapot},
+		&faultConfig{Headers: map[string]string{"X-Fault": "none"}, Percent: percent(0), Abort: http.StatusTeapot},
+	)
+
+	tests := []struct {
+		fault  string
+		status int
+		delay  time.Duration
+	}{
+		{"", http.StatusOK, 0},
+		{"abort", http.StatusServiceUnavailable, 0},
+		{"delay", http.StatusOK, 50 * time.Millisecond},
+		{"none", http.StatusOK, 0},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("X-Fault", test.fault)
+		w := httptest.NewRecorder()
+		start := time.Now()
+		p.ServeHTTP(w, r)
+		if w.Code != test.status {
+			t.Errorf("%q: expected %d, got %d", test.fault, test.status, w.Code)
+		}
+		if d := time.Since(start); d < test.delay {
+			t.Errorf("%q: expected a delay of %v, got %v", test.fault, test.delay, d)
+		}
+	}
+
+	aborted := 0
+	for i := 0; i < 1000; i++ {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("X-Fault", "half")
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, r)
+		if w.Code == http.StatusTeapot {
+			aborted++
+		}
+	}
+	if aborted < 400 || aborted > 600 {
+		t.Errorf("Expected about 500 aborted requests, got %d", aborted)
+	}
+}
+
+func TestFaultBody(t *testing.T) {
+	body := strings.Repeat("x", 1000)
+	p := faultProxy(t, body, &faultConfig{Bandwidth: 5000, Corrupt: true})
+
+	w := httptest.NewRecorder()
+	start := time.Now()
+	p.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	// Two chunks of 500 bytes, the second one after 100ms.
+	if d := time.Since(start); d < 190*time.Millisecond {
+		t.Errorf("Expected the throttled response to take 200ms, took %v", d)
+	}
+	got := w.Body.Bytes()
+	if len(got) != len(body) {
+		t.Fatalf("Expected %d bytes, got %d", len(body), len(got))
+	}
+	diff := 0
+	for i := range got {
+		if got[i] != body[i] {
+			diff++
+		}
+	}
+	if diff == 0 || diff > 2 {
+		t.Errorf("Expected one corrupted byte per chunk, got %d", diff)
+	}
+}
+
+func TestFaultDropWebsocket(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(echoFrames))
+	defer ts.Close()
+	p, err := newReverseProxy(&config{
+		Upstreams: map[string]*upstreamConfig{"a": {Targets: []targetConfig{{URL: ts.URL}}}},
+		Routes:    []*routeConfig{{Upstream: "a", Faults: []*faultConfig{{DropAfter: 3}}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	front := httptest.NewServer(p)
+	defer front.Close()
+
+	conn, br := dialWebsocket(t, front.Listener.Addr().String())
+	defer conn.Close()
+	// The first message and its echo pass, the second message drops the connection.
+	conn.Write([]byte{0x81, 0x01, 'a'})
+	echo := make([]byte, 3)
+	if _, err := io.ReadFull(br, echo); err != nil || !bytes.Equal(echo, []byte{0x81, 0x01, 'a'}) {
+		t.Fatalf("Expected the echo of the first message, got %x %v", echo, err)
+	}
+	conn.Write([]byte{0x81, 0x01, 'b'})
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if b, err := io.ReadAll(br); len(b) != 0 || isTimeout(err) {
+		t.Errorf("Expected the connection to be dropped, got %x %v", b, err)
+	}
+}
+
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
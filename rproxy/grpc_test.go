@@ -0,0 +1,157 @@
+// Copyright (c) 2014 David R. Jenni. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// chatDesc describes a bidirectional streaming method which answers
+// every health check request with the number of requests so far.
+var chatDesc = grpc.StreamDesc{
+	StreamName:    "Chat",
+	ServerStreams: true,
+	ClientStreams: true,
+	Handler: func(_ any, stream grpc.ServerStream) error {
+		n := 0
+		for {
+			var req healthpb.HealthCheckRequest
+			if err := stream.RecvMsg(&req); err == io.EOF {
+				stream.SetTrailer(metadata.Pairs("x-count", strconv.Itoa(n)))
+				return nil
+			} else if err != nil {
+				return err
+			}
+			n++
+			if err := stream.SendMsg(&healthpb.HealthCheckResponse{Status: healthpb.HealthCheckResponse_ServingStatus(n)}); err != nil {
+				return err
+			}
+		}
+	},
+}
+
+// grpcProxy starts a gRPC server behind rproxy, which it reaches with h2c,
+// and returns a client connection to rproxy over TLS.
+func grpcProxy(t *testing.T) *grpc.ClientConn {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := grpc.NewServer()
+	hs := health.NewServer()
+	hs.SetServingStatus("ok", healthpb.HealthCheckResponse_SERVING)
+	healthpb.RegisterHealthServer(srv, hs)
+	srv.RegisterService(&grpc.ServiceDesc{
+		ServiceName: "rproxy.test.Echo",
+		HandlerType: (*any)(nil),
+		Streams:     []grpc.StreamDesc{chatDesc},
+	}, struct{}{})
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+
+	c := &config{
+		Upstreams: map[string]*upstreamConfig{"a": {Targets: []targetConfig{{URL: "http://" + lis.Addr().String()}}, H2C: true}},
+		Routes:    []*routeConfig{{Upstream: "a"}},
+	}
+	p, err := newReverseProxy(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	front := httptest.NewUnstartedServer(p)
+	front.EnableHTTP2 = true
+	front.StartTLS()
+	t.Cleanup(front.Close)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(front.Certificate())
+	conn, err := grpc.NewClient(front.Listener.Addr().String(),
+		grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{RootCAs: roots})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestGRPCUnary(t *testing.T) {
+	client := healthpb.NewHealthClient(grpcProxy(t))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	resp, err := client.Check(ctx, &healthpb.HealthCheckRequest{Service: "ok"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status != healthpb.HealthCheckResponse_SERVING {
+		t.Errorf("Expected SERVING, got %v", resp.Status)
+	}
+	// The status of a call without response is sent in the header alone.
+	_, err = client.Check(ctx, &healthpb.HealthCheckRequest{Service: "missing"})
+	if code := status.Code(err); code != codes.NotFound {
+		t.Errorf("Expected NotFound, got %v", err)
+	}
+}
+
+func TestGRPCStreaming(t *testing.T) {
+	conn := grpcProxy(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	stream, err := conn.NewStream(ctx, &chatDesc, "/rproxy.test.Echo/Chat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Every request is answered before the next one is sent.
+	for i := 1; i <= 3; i++ {
+		if err := stream.SendMsg(&healthpb.HealthCheckRequest{}); err != nil {
+			t.Fatal(err)
+		}
+		var resp healthpb.HealthCheckResponse
+		if err := stream.RecvMsg(&resp); err != nil {
+			t.Fatal(err)
+		}
+		if int(resp.Status) != i {
+			t.Errorf("Expected response %d, got %d", i, resp.Status)
+		}
+	}
+	if err := stream.CloseSend(); err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.RecvMsg(new(healthpb.HealthCheckResponse)); err != io.EOF {
+		t.Fatalf("Expected EOF, got %v", err)
+	}
+	if got := stream.Trailer().Get("x-count"); len(got) != 1 || got[0] != "3" {
+		t.Errorf("Expected trailer x-count 3, got %v", got)
+	}
+
+	// A server stream delivers its messages as they are sent.
+	watch, err := healthpb.NewHealthClient(conn).Watch(ctx, &healthpb.HealthCheckRequest{Service: "ok"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := watch.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status != healthpb.HealthCheckResponse_SERVING {
+		t.Errorf("Expected SERVING, got %v", resp.Status)
+	}
+}
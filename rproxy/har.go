@@ -0,0 +1,501 @@
+// Copyright (c) 2014 David R. Jenni. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Defaults of the recording.
+const (
+	defaultRecordBody   = 64 << 10
+	defaultRecordRedact = "Authorization,Proxy-Authorization,Cookie,Set-Cookie,access_token"
+	redacted            = "REDACTED"
+)
+
+// harClose ends the entries of a HAR file.
+const harClose = "\n\t\t]\n\t}\n}\n"
+
+// har is an HTTP Archive (HAR 1.2).
+type har struct {
+	Log harLog `json:"log"`
+}
+
+type harLog struct {
+	Version string     `json:"version"`
+	Creator harCreator `json:"creator"`
+	Entries []harEntry `json:"entries"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	StartedDateTime time.Time   `json:"startedDateTime"`
+	Time            float64     `json:"time"` // milliseconds
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+}
+
+type harRequest struct {
+	Method      string       `json:"method"`
+	URL         string       `json:"url"`
+	HTTPVersion string       `json:"httpVersion"`
+	Cookies     []harNV      `json:"cookies"`
+	Headers     []harNV      `json:"headers"`
+	QueryString []harNV      `json:"queryString"`
+	PostData    *harPostData `json:"postData,omitempty"`
+	HeadersSize int          `json:"headersSize"`
+	BodySize    int64        `json:"bodySize"`
+}
+
+type harResponse struct {
+	Status      int        `json:"status"`
+	StatusText  string     `json:"statusText"`
+	HTTPVersion string     `json:"httpVersion"`
+	Cookies     []harNV    `json:"cookies"`
+	Headers     []harNV    `json:"headers"`
+	Content     harContent `json:"content"`
+	RedirectURL string     `json:"redirectURL"`
+	HeadersSize int        `json:"headersSize"`
+	BodySize    int64      `json:"bodySize"`
+}
+
+type harNV struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+	Encoding string `json:"encoding,omitempty"` // rproxy extension, like content
+	Comment  string `json:"comment,omitempty"`
+}
+
+type harContent struct {
+	Size     int64  `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+	Encoding string `json:"encoding,omitempty"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+type harTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+// harText returns the body as HAR text, base64 encoded if it is not
+// UTF-8, and a comment if the body was truncated.
+func harText(b []byte, size int64) (text, encoding, comment string) {
+	if int64(len(b)) < size {
+		comment = fmt.Sprintf("truncated to %d of %d bytes", len(b), size)
+	}
+	if utf8.Valid(b) {
+		return string(b), "", comment
+	}
+	return base64.StdEncoding.EncodeToString(b), "base64", comment
+}
+
+// harBody decodes the text of a HAR body.
+func harBody(text, encoding string) ([]byte, error) {
+	if encoding == "base64" {
+		return base64.StdEncoding.DecodeString(text)
+	}
+	return []byte(text), nil
+}
+
+// recorder records the requests and the responses passing through
+// a handler to a HAR file. The entries are appended periodically
+// and the file is a complete HAR file after every write.
+type recorder struct {
+	file    string
+	maxBody int64    // largest recorded body, longer ones are truncated
+	redact  []string // headers and query parameters whose values are redacted
+
+	mu      sync.Mutex
+	pending []harEntry // not yet written
+	f       *os.File   // nil until the first write
+	end     int64      // offset of harClose in f
+	written int        // number of entries in f
+}
+
+// newRecorder returns a recorder writing to file.
+func newRecorder(file string, maxBody int64, redact []string) *recorder {
+	rec := &recorder{file: file, maxBody: maxBody}
+	for _, h := range redact {
+		if h = strings.TrimSpace(h); h != "" {
+			rec.redact = append(rec.redact, http.CanonicalHeaderKey(h))
+		}
+	}
+	return rec
+}
+
+// redacts reports whether the values of the header or query
+// parameter are redacted.
+func (rec *recorder) redacts(name string) bool {
+	return slices.ContainsFunc(rec.redact, func(r string) bool { return strings.EqualFold(r, name) })
+}
+
+// redactQuery returns the raw query with the values of the
+// redacted parameters replaced.
+func (rec *recorder) redactQuery(raw string) string {
+	if raw == "" {
+		return raw
+	}
+	params := strings.Split(raw, "&")
+	for i, p := range params {
+		k, _, _ := strings.Cut(p, "=")
+		if name, err := url.QueryUnescape(k); err == nil && rec.redacts(name) {
+			params[i] = k + "=" + redacted
+		}
+	}
+	return strings.Join(params, "&")
+}
+
+// headers returns the header as HAR name/value pairs
+// with the values of the redacted headers replaced.
+func (rec *recorder) headers(h http.Header) []harNV {
+	nvs := []harNV{}
+	for k, vv := range h {
+		for _, v := range vv {
+			if rec.redacts(k) {
+				v = redacted
+			}
+			nvs = append(nvs, harNV{Name: k, Value: v})
+		}
+	}
+	slices.SortStableFunc(nvs, func(a, b harNV) int { return strings.Compare(a.Name, b.Name) })
+	return nvs
+}
+
+// handler returns a handler recording the traffic of h.
+func (rec *recorder) handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		var reqBody *capture
+		if r.Body != nil && r.Body != http.NoBody {
+			reqBody = &capture{max: rec.maxBody}
+			r.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.TeeReader(r.Body, reqBody), r.Body}
+		}
+		header := r.Header.Clone()
+		rw := &recordWriter{ResponseWriter: w, body: capture{max: rec.maxBody}}
+		h.ServeHTTP(rw, r)
+		rec.add(start, r, header, reqBody, rw)
+	})
+}
+
+// add adds an entry for a request and its response.
+func (rec *recorder) add(start time.Time, r *http.Request, header http.Header, reqBody *capture, rw *recordWriter) {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	total := float64(time.Since(start).Microseconds()) / 1000
+	wait := total
+	if !rw.wrote.IsZero() {
+		wait = float64(rw.wrote.Sub(start).Microseconds()) / 1000
+	}
+	u := *r.URL
+	u.RawQuery = rec.redactQuery(u.RawQuery)
+	e := harEntry{
+		StartedDateTime: start,
+		Time:            total,
+		Request: harRequest{
+			Method:      r.Method,
+			URL:         scheme + "://" + r.Host + u.RequestURI(),
+			HTTPVersion: r.Proto,
+			Cookies:     []harNV{},
+			Headers:     rec.headers(header),
+			QueryString: []harNV{},
+			HeadersSize: -1,
+		},
+		Response: harResponse{
+			Status:      rw.status,
+			StatusText:  http.StatusText(rw.status),
+			HTTPVersion: r.Proto,
+			Cookies:     []harNV{},
+			Headers:     rec.headers(rw.header),
+			RedirectURL: rw.header.Get("Location"),
+			HeadersSize: -1,
+			BodySize:    rw.body.size,
+		},
+		Timings: harTimings{Wait: wait, Receive: total - wait},
+	}
+	if e.Response.Status == 0 {
+		// Websocket upgrades are written to the hijacked connection.
+		e.Response.Status = http.StatusOK
+		if isWebsocket(r) {
+			e.Response.Status = http.StatusSwitchingProtocols
+		}
+		e.Response.StatusText = http.StatusText(e.Response.Status)
+	}
+	for k, vv := range r.URL.Query() {
+		for _, v := range vv {
+			if rec.redacts(k) {
+				v = redacted
+			}
+			e.Request.QueryString = append(e.Request.QueryString, harNV{Name: k, Value: v})
+		}
+	}
+	slices.SortStableFunc(e.Request.QueryString, func(a, b harNV) int { return strings.Compare(a.Name, b.Name) })
+	if reqBody != nil {
+		reqBody.mu.Lock()
+		e.Request.BodySize = reqBody.size
+		pd := &harPostData{MimeType: header.Get("Content-Type")}
+		pd.Text, pd.Encoding, pd.Comment = harText(reqBody.buf.Bytes(), reqBody.size)
+		e.Request.PostData = pd
+		reqBody.mu.Unlock()
+	}
+	c := &e.Response.Content
+	c.Size, c.MimeType = rw.body.size, rw.header.Get("Content-Type")
+	c.Text, c.Encoding, c.Comment = harText(rw.body.buf.Bytes(), rw.body.size)
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.pending = append(rec.pending, e)
+}
+
+// flush writes the recorded entries to the HAR file every interval.
+func (rec *recorder) flush(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := rec.write(); err != nil {
+			log.Printf("Error writing %s: %v", rec.file, err)
+		}
+	}
+}
+
+// write appends the recorded entries to the HAR file, which it
+// creates on the first call. The entries are written over the end
+// of the file, which is written anew after them.
+func (rec *recorder) write() error {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if rec.f == nil {
+		f, err := os.Create(rec.file)
+		if err != nil {
+			return err
+		}
+		creator, err := json.Marshal(harCreator{Name: "rproxy", Version: "1.0"})
+		if err != nil {
+			f.Close()
+			return err
+		}
+		start := fmt.Sprintf("{\n\t\"log\": {\n\t\t\"version\": \"1.2\",\n\t\t\"creator\": %s,\n\t\t\"entries\": [", creator)
+		if _, err := f.WriteString(start + harClose); err != nil {
+			f.Close()
+			return err
+		}
+		rec.f, rec.end = f, int64(len(start))
+	}
+	if len(rec.pending) == 0 {
+		return nil
+	}
+	var buf bytes.Buffer
+	for i, e := range rec.pending {
+		b, err := json.MarshalIndent(e, "\t\t\t", "\t")
+		if err != nil {
+			return err
+		}
+		if rec.written+i > 0 {
+			buf.WriteByte(',')
+		}
+		buf.WriteString("\n\t\t\t")
+		buf.Write(b)
+	}
+	n := int64(buf.Len())
+	buf.WriteString(harClose)
+	if _, err := rec.f.WriteAt(buf.Bytes(), rec.end); err != nil {
+		return err
+	}
+	rec.end += n
+	rec.written += len(rec.pending)
+	rec.pending = nil
+	return nil
+}
+
+// capture keeps the first max bytes written to it
+// and counts all of them.
+type capture struct {
+	mu   sync.Mutex // the transport may still read a request body
+	buf  bytes.Buffer
+	max  int64
+	size int64
+}
+
+func (c *capture) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if n := c.max - int64(c.buf.Len()); n > 0 {
+		c.buf.Write(b[:min(int64(len(b)), n)])
+	}
+	c.size += int64(len(b))
+	return len(b), nil
+}
+
+// recordWriter records a response.
+type recordWriter struct {
+	http.ResponseWriter
+	status int
+	header http.Header
+	wrote  time.Time // time of the response header
+	body   capture
+}
+
+func (w *recordWriter) WriteHeader(status int) {
+	if w.status == 0 && (status >= 200 || status == http.StatusSwitchingProtocols) {
+		w.status = status
+		w.header = w.Header().Clone()
+		w.wrote = time.Now()
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *recordWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap returns the underlying ResponseWriter.
+func (w *recordWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// replayer serves the responses of a HAR file. A request is
+// answered with the recorded responses of the same method and
+// URI in turn, preferring those whose request body matches.
+type replayer struct {
+	mu      sync.Mutex
+	entries map[string][]*replayEntry // by method and URI
+}
+
+// replayEntry is a recorded request and its response.
+type replayEntry struct {
+	body     []byte // request body
+	status   int
+	header   http.Header
+	content  []byte
+	replayed int
+}
+
+// readReplay reads a HAR file for replay.
+func readReplay(file string) (*replayer, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var h har
+	if err := json.Unmarshal(b, &h); err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	rp := &replayer{entries: make(map[string][]*replayEntry)}
+	for i, e := range h.Log.Entries {
+		if e.Response.Status == http.StatusSwitchingProtocols {
+			continue // websockets cannot be replayed
+		}
+		key, err := replayKey(e.Request.Method, e.Request.URL)
+		if err != nil {
+			return nil, fmt.Errorf("%s: entry %d: %v", file, i, err)
+		}
+		re := &replayEntry{status: e.Response.Status, header: make(http.Header)}
+		for _, nv := range e.Response.Headers {
+			re.header.Add(nv.Name, nv.Value)
+		}
+		if re.content, err = harBody(e.Response.Content.Text, e.Response.Content.Encoding); err != nil {
+			return nil, fmt.Errorf("%s: entry %d: %v", file, i, err)
+		}
+		if pd := e.Request.PostData; pd != nil {
+			if re.body, err = harBody(pd.Text, pd.Encoding); err != nil {
+				return nil, fmt.Errorf("%s: entry %d: %v", file, i, err)
+			}
+		}
+		rp.entries[key] = append(rp.entries[key], re)
+	}
+	return rp, nil
+}
+
+// replayKey returns the key of a recorded request.
+func replayKey(method, rawURL string) (string, error) {
+	i := strings.Index(rawURL, "://")
+	if i < 0 {
+		return "", fmt.Errorf("invalid URL %q", rawURL)
+	}
+	uri := rawURL[i+3:]
+	if j := strings.Index(uri, "/"); j >= 0 {
+		uri = uri[j:]
+	} else {
+		uri = "/"
+	}
+	return method + " " + uri, nil
+}
+
+func (rp *replayer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Error reading body.", http.StatusBadRequest)
+		return
+	}
+	e := rp.next(r.Method+" "+r.URL.RequestURI(), body)
+	if e == nil {
+		http.Error(w, "No recorded response.", http.StatusNotFound)
+		return
+	}
+	for k, vv := range e.header {
+		if k != "Content-Length" && k != "Transfer-Encoding" && k != "Connection" {
+			w.Header()[k] = vv
+		}
+	}
+	w.WriteHeader(e.status)
+	w.Write(e.content)
+}
+
+// next returns the entry to replay for the key and the request
+// body: the least replayed of the entries with the same body or,
+// without such entries, of all entries with the key.
+func (rp *replayer) next(key string, body []byte) *replayEntry {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	var match, first *replayEntry
+	for _, e := range rp.entries[key] {
+		if first == nil || e.replayed < first.replayed {
+			first = e
+		}
+		if bytes.Equal(e.body, body) && (match == nil || e.replayed < match.replayed) {
+			match = e
+		}
+	}
+	if match == nil {
+		match = first
+	}
+	if match != nil {
+		match.replayed++
+	}
+	return match
+}
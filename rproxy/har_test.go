@@ -0,0 +1,124 @@
+// Copyright (c) 2014 David R. Jenni. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRecordReplay(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "session.har")
+	rec := newRecorder(file, 8, strings.Split(defaultRecordRedact, ","))
+	h := rec.handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		w.Header().Set("Set-Cookie", "session=secret")
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("got " + string(b)))
+	}))
+	for _, body := range []string{"a", "b", "long request body"} {
+		r := httptest.NewRequest("POST", "http://example.com/x?q=1", strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer secret")
+		h.ServeHTTP(httptest.NewRecorder(), r)
+	}
+	if err := rec.write(); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), "secret") {
+		t.Errorf("Expected the credentials to be redacted")
+	}
+	var a har
+	if err := json.Unmarshal(b, &a); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(a.Log.Entries); n != 3 {
+		t.Fatalf("Expected 3 entries, got %d", n)
+	}
+	e := a.Log.Entries[2]
+	if e.Request.PostData.Text != "long req" || e.Request.BodySize != 17 || e.Response.Content.Text != "got long" {
+		t.Errorf("Expected truncated bodies, got %q %d %q", e.Request.PostData.Text, e.Request.BodySize, e.Response.Content.Text)
+	}
+
+	rp, err := readReplay(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		method, url, body string
+		status            int
+		want              string
+	}{
+		{"POST", "/x?q=1", "b", http.StatusCreated, "got b"},
+		{"POST", "/x?q=1", "c", http.StatusCreated, "got a"},
+		{"POST", "/x?q=1", "c", http.StatusCreated, "got long"},
+		{"GET", "/x?q=1", "", http.StatusNotFound, "No recorded response.\n"},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		rp.ServeHTTP(w, httptest.NewRequest(test.method, test.url, strings.NewReader(test.body)))
+		if w.Code != test.status || w.Body.String() != test.want {
+			t.Errorf("%s %s %q: expected %d %q, got %d %q", test.method, test.url, test.body, test.status, test.want, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestRecordAppend(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "session.har")
+	rec := newRecorder(file, 8, []string{"authorization", "Token"})
+	h := rec.handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	read := func() har {
+		t.Helper()
+		if err := rec.write(); err != nil {
+			t.Fatal(err)
+		}
+		b, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(string(b), "secret") {
+			t.Errorf("Expected the credentials to be redacted, got %s", b)
+		}
+		var a har
+		if err := json.Unmarshal(b, &a); err != nil {
+			t.Fatalf("Expected a valid HAR file, got %v: %s", err, b)
+		}
+		return a
+	}
+
+	if a := read(); len(a.Log.Entries) != 0 || a.Log.Version != "1.2" {
+		t.Errorf("Expected an empty HAR 1.2 file, got %+v", a.Log)
+	}
+	for n, paths := range [][]string{{"/a?token=secret&q=1"}, {"/b", "/c?x=1&TOKEN=secret"}} {
+		for _, path := range paths {
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://example.com"+path, nil))
+		}
+		a := read()
+		if want := 1 + 2*n; len(a.Log.Entries) != want {
+			t.Fatalf("Expected %d entries, got %d", want, len(a.Log.Entries))
+		}
+		if len(rec.pending) != 0 {
+			t.Errorf("Expected the written entries to be dropped, got %d", len(rec.pending))
+		}
+	}
+	a := read()
+	if got := a.Log.Entries[0].Request.URL; got != "http://example.com/a?token=REDACTED&q=1" {
+		t.Errorf("Expected the token to be redacted, got %s", got)
+	}
+	if got := a.Log.Entries[2].Request.QueryString; len(got) != 2 || got[0] != (harNV{"TOKEN", redacted}) {
+		t.Errorf("Expected the token to be redacted, got %v", got)
+	}
+}
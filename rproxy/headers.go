@@ -0,0 +1,64 @@
+// Copyright (c) 2014 David R. Jenni. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+)
+
+// headerRule modifies a header of a request or response.
+type headerRule struct {
+	op    string // add, set, remove or replace
+	name  string
+	value string         // added or set value, or replacement
+	regex *regexp.Regexp // replaced pattern
+}
+
+// headerRules is a list of rules applied in order.
+type headerRules []headerRule
+
+// newHeaderRules returns the rules described by cs.
+func newHeaderRules(cs []headerRuleConfig) (headerRules, error) {
+	var rules headerRules
+	for _, c := range cs {
+		hr := headerRule{op: c.Op, name: http.CanonicalHeaderKey(c.Name), value: c.Value}
+		if hr.name == "" {
+			return nil, fmt.Errorf("header rule without name")
+		}
+		switch c.Op {
+		case "add", "set", "remove":
+		case "replace":
+			var err error
+			if hr.regex, err = regexp.Compile(c.Regex); err != nil {
+				return nil, fmt.Errorf("header rule for %s: %v", hr.name, err)
+			}
+		default:
+			return nil, fmt.Errorf("header rule for %s: unknown op %q", hr.name, c.Op)
+		}
+		rules = append(rules, hr)
+	}
+	return rules, nil
+}
+
+// apply modifies the header with the rules.
+func (rules headerRules) apply(h http.Header) {
+	for _, hr := range rules {
+		switch hr.op {
+		case "add":
+			h.Add(hr.name, hr.value)
+		case "set":
+			h.Set(hr.name, hr.value)
+		case "remove":
+			h.Del(hr.name)
+		case "replace":
+			vv := h[hr.name]
+			for i, v := range vv {
+				vv[i] = hr.regex.ReplaceAllString(v, hr.value)
+			}
+		}
+	}
+}
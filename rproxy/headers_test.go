@@ -0,0 +1,56 @@
+// Copyright (c) 2014 David R. Jenni. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestHeaderRules(t *testing.T) {
+	rules, err := newHeaderRules([]headerRuleConfig{
+		{Op: "set", Name: "authorization", Value: "Bearer x"},
+		{Op: "add", Name: "X-Via", Value: "rproxy"},
+		{Op: "remove", Name: "X-Internal"},
+		{Op: "replace", Name: "Set-Cookie", Regex: "(?i)domain=internal", Value: "Domain=example.com"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := http.Header{}
+	h.Set("Authorization", "Basic y")
+	h.Set("X-Via", "lb")
+	h.Set("X-Internal", "1")
+	h.Add("Set-Cookie", "a=1; Domain=internal")
+	h.Add("Set-Cookie", "b=2")
+
+	rules.apply(h)
+
+	if got := h.Get("Authorization"); got != "Bearer x" {
+		t.Errorf("Expected Bearer x, got %q", got)
+	}
+	if got := h.Values("X-Via"); len(got) != 2 {
+		t.Errorf("Expected 2 values, got %q", got)
+	}
+	if got := h.Get("X-Internal"); got != "" {
+		t.Errorf("Expected no X-Internal, got %q", got)
+	}
+	cookies := h.Values("Set-Cookie")
+	if cookies[0] != "a=1; Domain=example.com" || cookies[1] != "b=2" {
+		t.Errorf("Unexpected cookies %q", cookies)
+	}
+}
+
+func TestInvalidHeaderRules(t *testing.T) {
+	for _, c := range []headerRuleConfig{
+		{Op: "rename", Name: "X"},
+		{Op: "set"},
+		{Op: "replace", Name: "X", Regex: "("},
+	} {
+		if _, err := newHeaderRules([]headerRuleConfig{c}); err == nil {
+			t.Errorf("%+v: expected an error", c)
+		}
+	}
+}
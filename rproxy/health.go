@@ -0,0 +1,157 @@
+// Copyright (c) 2014 David R. Jenni. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// healthCheck configures the active health checks of an upstream.
+type healthCheck struct {
+	path     string        // probed path
+	interval time.Duration // time between probes
+	timeout  time.Duration // timeout of a probe
+	status   int           // expected status code
+}
+
+// ejection configures the passive outlier ejection of an upstream.
+type ejection struct {
+	failures int           // consecutive failures before an ejection, 0 disables it
+	duration time.Duration // first ejection time, doubled for every consecutive ejection
+}
+
+// maxEjections limits the exponential growth of the ejection time.
+const maxEjections = 6
+
+// available reports whether the backend may receive requests.
+func (b *backend) available() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return !b.draining && !b.down && !time.Now().Before(b.ejectedUntil)
+}
+
+// targetFailed reports whether a response status is a failure of the
+// target rather than an error of the application.
+func targetFailed(status int) bool {
+	return status == http.StatusBadGateway || status == http.StatusServiceUnavailable || status == http.StatusGatewayTimeout
+}
+
+// report records the outcome of a request to the backend b and ejects
+// b after too many consecutive failures, unless no other backend of
+// the upstream is available.
+func (u *upstream) report(b *backend, ok bool) {
+	if !b.fail(ok, u.eject.failures) {
+		return
+	}
+	u.ejecting.Lock()
+	defer u.ejecting.Unlock()
+	for _, o := range u.available() {
+		if o != b {
+			b.eject(u.eject.duration)
+			return
+		}
+	}
+	log.Printf("Not ejecting %s: no other target available", b.url)
+}
+
+// fail records the outcome of a request to the backend and reports
+// whether the backend failed for the given number of times in a row.
+func (b *backend) fail(ok bool, failures int) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ok {
+		b.failures = 0
+		b.ejections = 0
+		return false
+	}
+	b.failures++
+	if failures <= 0 || b.failures < failures {
+		return false
+	}
+	b.failures = 0
+	return true
+}
+
+// eject takes the backend out of the rotation for the duration,
+// doubled for every consecutive ejection.
+func (b *backend) eject(duration time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.ejections < maxEjections {
+		b.ejections++
+	}
+	d := duration << (b.ejections - 1)
+	b.ejectedUntil = time.Now().Add(d)
+	log.Printf("Ejecting %s for %v", b.url, d)
+}
+
+// checkHealth probes the backends of the upstream periodically. A
+// round of probes ends before the interval until the next one starts,
+// so that slow targets do not pile up probes.
+func (u *upstream) checkHealth() {
+	hc := *u.health
+	client := &http.Client{
+		Transport: u.transport,
+		Timeout:   hc.timeout,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	for {
+		var wg sync.WaitGroup
+		for _, b := range u.list() {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				b.probe(client, hc)
+			}()
+		}
+		wg.Wait()
+		select {
+		case <-time.After(hc.interval):
+		case <-u.stop:
+			return
+		}
+	}
+}
+
+// probe checks the health of the backend.
+func (b *backend) probe(client *http.Client, hc healthCheck) {
+	target := *b.url
+	target.Path = hc.path
+	target.RawQuery = ""
+	down := true
+	switch b.url.Scheme {
+	case "tcp":
+		// Stream targets are healthy if they accept connections.
+		if c, err := net.DialTimeout("tcp", b.url.Host, hc.timeout); err == nil {
+			c.Close()
+			down = false
+		}
+	case "udp":
+		return
+	default:
+		resp, err := client.Get(target.String())
+		if err == nil {
+			resp.Body.Close()
+			down = resp.StatusCode != hc.status
+		}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if down != b.down {
+		if down {
+			log.Printf("Health check of %s failed", b.url)
+		} else {
+			log.Printf("Health check of %s succeeded", b.url)
+		}
+	}
+	b.down = down
+}
@@ -0,0 +1,300 @@
+// Copyright (c) 2014 David R. Jenni. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// jwtLeeway is the tolerated clock skew of exp and nbf.
+const jwtLeeway = time.Minute
+
+// jwtAuth verifies JSON Web Tokens signed with RSA, ECDSA or Ed25519
+// keys. The token is taken from a Bearer Authorization header or,
+// since browsers cannot set headers on websockets, from the query
+// parameter or cookie given by query or cookie.
+type jwtAuth struct {
+	keys     []jwk
+	issuer   string            // required iss, if any
+	audience string            // required aud, if any
+	claims   map[string]string // required claim values
+	query    string
+	cookie   string
+}
+
+// jwk is a verification key with an optional key ID.
+type jwk struct {
+	kid string
+	key crypto.PublicKey
+}
+
+func (a *jwtAuth) authenticate(w http.ResponseWriter, r *http.Request) (string, bool) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok && a.query != "" {
+		token = r.URL.Query().Get(a.query)
+	}
+	if token == "" && a.cookie != "" {
+		if c, err := r.Cookie(a.cookie); err == nil {
+			token = c.Value
+		}
+	}
+	if token == "" {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return "", false
+	}
+	claims, err := a.verify(token, time.Now())
+	if err != nil {
+		unauthorizedBearer(w, err.Error())
+		return "", false
+	}
+	sub, _ := claims["sub"].(string)
+	return sub, true
+}
+
+// verify verifies the signature and the claims of the token
+// and returns its claims.
+func (a *jwtAuth) verify(token string, now time.Time) (map[string]any, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, errors.New("malformed header")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed signature")
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+	verified := false
+	for _, k := range a.keys {
+		if k.kid != "" && header.Kid != "" && k.kid != header.Kid {
+			continue
+		}
+		if verifySignature(header.Alg, k.key, signed, sig) == nil {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, errors.New("invalid signature")
+	}
+
+	var claims map[string]any
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, errors.New("malformed claims")
+	}
+	if exp, ok := claims["exp"].(float64); ok && now.After(time.Unix(int64(exp), 0).Add(jwtLeeway)) {
+		return nil, errors.New("token expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Before(time.Unix(int64(nbf), 0).Add(-jwtLeeway)) {
+		return nil, errors.New("token not yet valid")
+	}
+	if a.issuer != "" && claims["iss"] != a.issuer {
+		return nil, errors.New("wrong issuer")
+	}
+	if a.audience != "" && !hasClaim(claims["aud"], a.audience) {
+		return nil, errors.New("wrong audience")
+	}
+	for k, v := range a.claims {
+		if !hasClaim(claims[k], v) {
+			return nil, fmt.Errorf("missing claim %s", k)
+		}
+	}
+	return claims, nil
+}
+
+// hasClaim reports whether the claim is the value, an array
+// containing it or a space separated list (like scope) with it.
+func hasClaim(claim any, v string) bool {
+	switch c := claim.(type) {
+	case string:
+		return c == v || slices.Contains(strings.Fields(c), v)
+	case []any:
+		return slices.Contains(c, any(v))
+	case float64, bool:
+		return fmt.Sprint(c) == v
+	}
+	return false
+}
+
+// decodeSegment decodes a base64url encoded JSON segment of a token.
+func decodeSegment(seg string, v any) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// verifySignature verifies the signature of the signed bytes with
+// the algorithm alg. The key type must match the algorithm.
+func verifySignature(alg string, key crypto.PublicKey, signed, sig []byte) error {
+	if alg == "EdDSA" {
+		k, ok := key.(ed25519.PublicKey)
+		if !ok || !ed25519.Verify(k, signed, sig) {
+			return errors.New("invalid signature")
+		}
+		return nil
+	}
+	var h crypto.Hash
+	switch strings.TrimLeft(alg, "RPES") {
+	case "256":
+		h = crypto.SHA256
+	case "384":
+		h = crypto.SHA384
+	case "512":
+		h = crypto.SHA512
+	}
+	if h == 0 || len(alg) != 5 {
+		return fmt.Errorf("unsupported algorithm %q", alg)
+	}
+	hh := h.New()
+	hh.Write(signed)
+	digest := hh.Sum(nil)
+	switch {
+	case strings.HasPrefix(alg, "RS"):
+		if k, ok := key.(*rsa.PublicKey); ok {
+			return rsa.VerifyPKCS1v15(k, h, digest, sig)
+		}
+	case strings.HasPrefix(alg, "PS"):
+		if k, ok := key.(*rsa.PublicKey); ok {
+			return rsa.VerifyPSS(k, h, digest, sig, nil)
+		}
+	case strings.HasPrefix(alg, "ES"):
+		if k, ok := key.(*ecdsa.PublicKey); ok {
+			size := (k.Curve.Params().BitSize + 7) / 8
+			if len(sig) != 2*size {
+				return errors.New("invalid signature")
+			}
+			r := new(big.Int).SetBytes(sig[:size])
+			s := new(big.Int).SetBytes(sig[size:])
+			if !ecdsa.Verify(k, digest, r, s) {
+				return errors.New("invalid signature")
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("unsupported algorithm %q", alg)
+}
+
+// parseKeys parses a JWKS document or PEM encoded public keys
+// and certificates.
+func parseKeys(b []byte) ([]jwk, error) {
+	if bytes.HasPrefix(bytes.TrimSpace(b), []byte("{")) {
+		return parseJWKS(b)
+	}
+	var keys []jwk
+	for {
+		var block *pem.Block
+		if block, b = pem.Decode(b); block == nil {
+			break
+		}
+		var key crypto.PublicKey
+		var err error
+		switch block.Type {
+		case "PUBLIC KEY":
+			key, err = x509.ParsePKIXPublicKey(block.Bytes)
+		case "RSA PUBLIC KEY":
+			key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+		case "CERTIFICATE":
+			var cert *x509.Certificate
+			if cert, err = x509.ParseCertificate(block.Bytes); err == nil {
+				key = cert.PublicKey
+			}
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, jwk{key: key})
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no public keys")
+	}
+	return keys, nil
+}
+
+// parseJWKS parses the RSA, EC and OKP keys of a JWKS document.
+func parseJWKS(b []byte) ([]jwk, error) {
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			Crv string `json:"crv"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(b, &set); err != nil {
+		return nil, err
+	}
+	var keys []jwk
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		var key crypto.PublicKey
+		switch k.Kty {
+		case "RSA":
+			n, err1 := base64.RawURLEncoding.DecodeString(k.N)
+			e, err2 := base64.RawURLEncoding.DecodeString(k.E)
+			if err := errors.Join(err1, err2); err != nil {
+				return nil, fmt.Errorf("key %s: %v", k.Kid, err)
+			}
+			key = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		case "EC":
+			curves := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}
+			curve, ok := curves[k.Crv]
+			if !ok {
+				return nil, fmt.Errorf("key %s: unsupported curve %q", k.Kid, k.Crv)
+			}
+			x, err1 := base64.RawURLEncoding.DecodeString(k.X)
+			y, err2 := base64.RawURLEncoding.DecodeString(k.Y)
+			if err := errors.Join(err1, err2); err != nil {
+				return nil, fmt.Errorf("key %s: %v", k.Kid, err)
+			}
+			key = &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		case "OKP":
+			x, err := base64.RawURLEncoding.DecodeString(k.X)
+			if k.Crv != "Ed25519" || err != nil || len(x) != ed25519.PublicKeySize {
+				return nil, fmt.Errorf("key %s: invalid Ed25519 key", k.Kid)
+			}
+			key = ed25519.PublicKey(x)
+		default:
+			continue
+		}
+		keys = append(keys, jwk{kid: k.Kid, key: key})
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no signing keys")
+	}
+	return keys, nil
+}
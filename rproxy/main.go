@@ -9,7 +9,11 @@ Installation:
 	% go get github.com/davidrjenni/cmd/rproxy
 
 Usage:
-	% rproxy -target http[s]://... [-addr ...]
+	% rproxy -target http[s]://...[,http[s]://...] [-addr ...]
+	% rproxy -config file.json [-addr ...]
+	% rproxy -replay file.har [-addr ...]
+
+See Readme.md for the features and the configuration file.
 
 Example
 	% rproxy -target "https://example.com:8000" -addr ":8080"
@@ -17,6 +21,8 @@ Example
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -24,91 +30,670 @@ import (
 	"net"
 	"net/http"
 	"net/http/httputil"
-	"net/url"
+	"net/netip"
+	"net/textproto"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
 var (
-	addr   = flag.String("addr", ":8080", "HTTP listen address")
-	target = flag.String("target", "", "pass all requests to this address")
+	addr       = flag.String("addr", ":8080", "HTTP listen address")
+	configFile = flag.String("config", "", "JSON configuration file with routes and upstreams")
+
+	certFile   = flag.String("cert", "", "PEM file with the default TLS certificate (enables TLS)")
+	keyFile    = flag.String("key", "", "PEM file with the key of the default TLS certificate")
+	certDir    = flag.String("certdir", "", "directory of name.crt and name.key pairs selected by SNI (enables TLS)")
+	tlsMin     = flag.String("tls-min", "1.2", "minimum TLS version: 1.0, 1.1, 1.2 or 1.3")
+	tlsCiphers = flag.String("tls-ciphers", "", "comma separated TLS 1.0-1.2 cipher suites (default: Go defaults)")
+	clientCA   = flag.String("client-ca", "", "PEM file with the CAs of client certificates")
+
+	proxyProtocol  = flag.Bool("proxy-protocol", false, "expect a PROXY protocol v1 or v2 header on every connection")
+	trustedProxies = flag.String("trusted-proxies", "", "comma separated CIDRs of proxies whose X-Forwarded-For is kept (default: none)")
+
+	accessLogFile   = flag.String("access-log", "", "file of the access log, - for stdout (default: none)")
+	accessLogFormat = flag.String("access-log-format", "json", "format of the access log: json or clf")
+
+	adminAddr     = flag.String("admin", "", "listen address of the admin API (default: none)")
+	adminToken    = flag.String("admin-token", "", "bearer token required by the admin API (default: none, admin API on loopback only)")
+	cacheSize     = flag.Int64("cache", 0, "size of the response cache in MB (0: no cache)")
+	cacheDir      = flag.String("cache-dir", "", "directory of the on-disk cache tier (default: memory only)")
+	cacheDiskSize = flag.Int64("cache-disk", 1024, "size of the on-disk cache tier in MB (0: unlimited)")
+
+	target    = flag.String("target", "", "pass all requests to these comma separated addresses")
+	weights   = flag.String("weights", "", "comma separated weights of the targets")
+	strategy  = flag.String("lb", "round-robin", "balancing strategy: round-robin, weighted, least-conn or hash")
+	hashKey   = flag.String("hash", "", "header hashed by the hash strategy (default: client IP)")
+	caFile    = flag.String("ca", "", "PEM file with the CA certificates of https targets (default: system roots)")
+	setHost   = flag.Bool("rewrite-host", false, "set the Host header to the target instead of passing the client's")
+	h2c       = flag.Bool("h2c", false, "speak HTTP/2 to the targets, in cleartext (h2c) to http targets")
+	sendProxy = flag.Int("send-proxy", 0, "version of the PROXY protocol header sent to the targets (0: none)")
+
+	dialTimeout     = flag.Duration("dial-timeout", defaultDialTimeout, "timeout connecting to a target")
+	tlsTimeout      = flag.Duration("tls-handshake-timeout", defaultTLSTimeout, "timeout of the TLS handshake with a target")
+	headerTimeout   = flag.Duration("response-header-timeout", 0, "time a target has to send the response header (0: no limit)")
+	idleConnTimeout = flag.Duration("idle-conn-timeout", defaultIdleConnTimeout, "time an unused connection to a target is kept")
+	maxIdleConns    = flag.Int("max-idle-conns", 0, "unused connections kept per target (default: 2)")
+	maxTargetConns  = flag.Int("max-target-conns", 0, "connections per target (0: no limit)")
+	keepAlive       = flag.Duration("keepalive", defaultKeepAlive, "interval of TCP keepalive probes of target connections (negative: none)")
+
+	healthPath     = flag.String("health", "", "path probed by the health checks (default: no health checks)")
+	healthInterval = flag.Duration("health-interval", defaultHealthInterval, "time between health checks")
+	healthTimeout  = flag.Duration("health-timeout", defaultHealthTimeout, "timeout of a health check")
+	healthStatus   = flag.Int("health-status", http.StatusOK, "expected status of a health check")
+	ejectAfter     = flag.Int("eject-after", defaultEjectAfter, "consecutive failures before a target is ejected (0: never)")
+	ejectTime      = flag.Duration("eject-time", defaultEjectTime, "time of the first ejection of a target")
+
+	retries       = flag.Int("retries", 0, "retries of idempotent requests on other targets")
+	retryStatuses = flag.String("retry-statuses", "502,503,504", "comma separated statuses which are retried")
+	retryBackoff  = flag.Duration("retry-backoff", defaultRetryBackoff, "backoff before the first retry, doubled for every retry")
+	breakerAfter  = flag.Int("breaker", 0, "consecutive failures which open the circuit breaker (0: never)")
+	breakerTime   = flag.Duration("breaker-open", defaultBreakerOpen, "time the circuit breaker stays open")
+
+	rateLimit     = flag.Float64("rate", 0, "requests per second per client (0: no limit)")
+	rateBurst     = flag.Int("burst", 0, "requests above the rate per client (default: the rate)")
+	rateKey       = flag.String("rate-key", "ip", "key of the rate limit: ip, route or header:Name")
+	maxConns      = flag.Int("max-conns", 0, "concurrent connections per client IP (0: no limit)")
+	maxWebsockets = flag.Int("max-websockets", 0, "concurrent websockets per client IP (0: no limit)")
+
+	allowCIDRs     = flag.String("allow", "", "comma separated CIDRs of the only clients allowed (default: all)")
+	denyCIDRs      = flag.String("deny", "", "comma separated CIDRs of denied clients (default: none)")
+	maxRequestBody = flag.Int64("max-body", 0, "largest request body in bytes (0: no limit)")
+	errorPages     = flag.String("error-pages", "", "directory of error pages named after their status, like 403.html (default: none)")
+
+	htpasswd   = flag.String("htpasswd", "", "htpasswd file with bcrypt or SHA hashes for basic authentication")
+	jwtKeys    = flag.String("jwt-keys", "", "JWKS or PEM file with the keys verifying bearer tokens")
+	forwardURL = flag.String("forward-auth", "", "URL of an auth service asked before every request")
+
+	mirrorTarget  = flag.String("mirror", "", "shadow address the requests are mirrored to (default: none)")
+	mirrorPercent = flag.Float64("mirror-percent", 100, "percentage of the mirrored requests")
+	mirrorDiff    = flag.Bool("mirror-diff", false, "log differences between the responses of the targets and the shadow")
+
+	recordFile   = flag.String("record", "", "HAR file the traffic is recorded to (default: none)")
+	recordBody   = flag.Int64("record-body", defaultRecordBody, "largest recorded body in bytes, longer ones are truncated")
+	recordRedact = flag.String("record-redact", defaultRecordRedact, "comma separated headers and query parameters whose values are not recorded")
+	replayFile   = flag.String("replay", "", "HAR file whose responses are served without targets")
+
+	wsLog        = flag.Bool("ws-log", false, "log the text messages of websockets")
+	wsTeeFile    = flag.String("ws-tee", "", "file the text messages of websockets are written to as JSON lines, - for stdout")
+	wsMaxMessage = flag.Int64("ws-max-message", 0, "largest websocket message in bytes (0: no limit)")
+	wsPing       = flag.Duration("ws-ping", 0, "idle time before websockets are pinged (0: never)")
+	wsIdle       = flag.Duration("ws-idle", defaultWebsocketIdle, "idle time after which websockets are closed (0: never)")
+
+	canary        = flag.String("canary", "", "comma separated canary addresses which receive a share of the requests (default: none)")
+	canaryPercent = flag.Int("canary-percent", 5, "percentage of the requests sent to the canary addresses")
+	canaryHeader  = flag.String("canary-header", "X-Canary", "header whose value 1 sends a request to the canary addresses")
+	affinity      = flag.String("affinity", "", "keeps clients on their target: ip or cookie:Name (default: none)")
+
+	faultDelay   = flag.Duration("fault-delay", 0, "latency added to the faulty requests")
+	faultAbort   = flag.Int("fault-abort", 0, "status answered to the faulty requests instead of forwarding them")
+	faultPercent = flag.Float64("fault-percent", 100, "percentage of the faulty requests")
+
+	shutdownTimeout = flag.Duration("shutdown-timeout", 30*time.Second, "time for requests and websockets to finish on SIGINT or SIGTERM")
 )
 
 // reverseProxy represents a websocket-aware HTTP reverse proxy.
 type reverseProxy struct {
-	proxy  *httputil.ReverseProxy
-	target *url.URL
+	proxy     *httputil.ReverseProxy
+	table     atomic.Pointer[table] // replaced by a reload
+	accessLog *accessLog            // nil disables the access log
+	cache     *cache                // nil disables the cache
+	wsTee     *wsTee                // nil disables the websocket tee
+	trusted   []netip.Prefix        // proxies whose X-Forwarded-For is kept
+	metrics   *metrics
+
+	mu         sync.Mutex
+	websockets map[*wsSession]bool // active websocket sessions
+	listeners  []io.Closer         // listeners of the streams
+	conns      map[net.Conn]bool   // active connections of TCP streams
 }
 
-func newReverseProxy(target string) (*reverseProxy, error) {
-	p := &reverseProxy{}
-	var err error
-	p.target, err = url.Parse(target)
+// proxyState is the state of a proxied request.
+type proxyState struct {
+	route    *route
+	upstream *upstream
+	backend  *backend
+	affinity string // key which selects the backend, "" for the balancer
+
+	user      string        // authenticated user
+	start     time.Time     // arrival of the request
+	ttfb      time.Duration // time until the upstream response header
+	websocket bool
+	dropAfter int   // websocket messages before an injected drop, 0 for never
+	sent      int64 // bytes sent to a websocket client
+	received  int64 // bytes received from a websocket client
+}
+
+// stateKey is the context key of the proxyState.
+type stateKey struct{}
+
+// stateFrom returns the proxyState stored in the context.
+func stateFrom(ctx context.Context) *proxyState {
+	return ctx.Value(stateKey{}).(*proxyState)
+}
+
+func newReverseProxy(c *config) (*reverseProxy, error) {
+	t, err := newTable(c, nil)
 	if err != nil {
 		return nil, err
 	}
-	p.proxy = httputil.NewSingleHostReverseProxy(p.target)
+	p := &reverseProxy{
+		metrics:    newMetrics(),
+		websockets: make(map[*wsSession]bool),
+		conns:      make(map[net.Conn]bool),
+	}
+	p.table.Store(t)
+	p.proxy = &httputil.ReverseProxy{
+		Rewrite:   p.rewrite,
+		Transport: upstreamTransport{},
+		ModifyResponse: func(resp *http.Response) error {
+			stateFrom(resp.Request.Context()).route.responseHeaders.apply(resp.Header)
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			var tooLarge *http.MaxBytesError
+			switch {
+			case errors.As(err, &tooLarge):
+				p.fail(w, http.StatusRequestEntityTooLarge, "Request body too large.")
+				return
+			case !errors.Is(err, context.Canceled):
+				log.Printf("Proxy error: %v", err)
+			}
+			w.WriteHeader(http.StatusBadGateway)
+		},
+	}
 	return p, nil
 }
 
-func (p *reverseProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	upgrade := r.Header.Get("Upgrade")
-	if strings.ToLower(upgrade) == "websocket" {
-		p.handleWebsocket(w, r)
-	} else {
-		p.proxy.ServeHTTP(w, r)
+// rewrite directs the outgoing request to the backend chosen for it.
+func (p *reverseProxy) rewrite(pr *httputil.ProxyRequest) {
+	st := stateFrom(pr.In.Context())
+	p.forwardTo(pr, st.upstream, st.backend, st.route)
+}
+
+// forwardedHeaders are set by the proxy; the values sent by the
+// client are removed unless it is trusted.
+var forwardedHeaders = []string{"Forwarded", "X-Forwarded-For", "X-Forwarded-Host", "X-Forwarded-Proto"}
+
+// hopHeaders are the hop-by-hop headers, which are not forwarded.
+var hopHeaders = []string{
+	"Connection", "Proxy-Connection", "Keep-Alive", "Proxy-Authenticate",
+	"Proxy-Authorization", "Te", "Trailer", "Transfer-Encoding", "Upgrade",
+}
+
+// removeHopHeaders removes the hop-by-hop headers, including those
+// listed in Connection.
+func removeHopHeaders(h http.Header) {
+	for _, v := range h.Values("Connection") {
+		for _, f := range strings.Split(v, ",") {
+			if f = textproto.TrimString(f); f != "" {
+				h.Del(f)
+			}
+		}
+	}
+	for _, k := range hopHeaders {
+		h.Del(k)
 	}
 }
 
-func (p *reverseProxy) handleWebsocket(w http.ResponseWriter, r *http.Request) {
-	dst, err := net.Dial("tcp", p.target.Host)
-	if err != nil {
-		http.Error(w, "Error dialing target.", 500)
+// forwardTo directs the outgoing request to the backend b of u and
+// sets the forwarding and route headers.
+func (p *reverseProxy) forwardTo(pr *httputil.ProxyRequest, u *upstream, b *backend, rt *route) {
+	pr.SetURL(b.url)
+	if !u.rewriteHost {
+		pr.Out.Host = pr.In.Host
+	}
+	if peer, err := netip.ParseAddrPort(pr.In.RemoteAddr); err == nil && p.trusts(peer.Addr().Unmap()) {
+		pr.Out.Header["X-Forwarded-For"] = pr.In.Header["X-Forwarded-For"]
+	}
+	pr.SetXForwarded()
+	rt.requestHeaders.apply(pr.Out.Header)
+}
+
+// upstreamTransport sends requests with the transport of their upstream.
+type upstreamTransport struct{}
+
+func (upstreamTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	st := stateFrom(r.Context())
+	return st.upstream.roundTrip(r, st)
+}
+
+// checkHealth starts the health checks of the upstreams.
+func (p *reverseProxy) checkHealth() {
+	for _, u := range p.current().upstreams {
+		if u.health != nil {
+			go u.checkHealth()
+		}
+	}
+}
+
+// match returns the first route matching the request, or nil.
+func (p *reverseProxy) match(r *http.Request) *route {
+	for _, rt := range p.current().routes {
+		if rt.match(r) {
+			return rt
+		}
+	}
+	return nil
+}
+
+func (p *reverseProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	st := &proxyState{start: time.Now()}
+	r = p.withClient(r)
+	lw := &logWriter{ResponseWriter: w}
+	w = lw
+	defer p.done(r, st, lw)
+
+	// Access rules and routes see the same path as the targets.
+	if cp := cleanPath(r.URL.Path); cp != r.URL.Path {
+		u := *r.URL
+		u.Path, u.RawPath = cp, ""
+		http.Redirect(w, r, u.RequestURI(), http.StatusPermanentRedirect)
 		return
 	}
-	hj, ok := w.(http.Hijacker)
-	if !ok {
-		log.Printf("ResponseWriter is not a hijacker?")
+	if status := access(p.current().access, r); status != 0 {
+		p.fail(w, status, "Access denied.")
 		return
 	}
-	src, _, err := hj.Hijack()
-	if err != nil {
-		log.Printf("Hijack error: %v", err)
+	rt := p.match(r)
+	if rt == nil {
+		http.NotFound(w, r)
+		return
+	}
+	st.route = rt
+	if rt.clientCert && !hasClientCert(r) {
+		http.Error(w, "Client certificate required.", http.StatusForbidden)
 		return
 	}
-	defer src.Close()
-	defer dst.Close()
+	if status := access(rt.access, r); status != 0 {
+		p.fail(w, status, "Access denied.")
+		return
+	}
+	if rt.maxBody > 0 {
+		if r.ContentLength > rt.maxBody {
+			p.fail(w, http.StatusRequestEntityTooLarge, "Request body too large.")
+			return
+		}
+		// Bodies without length are cut off where they exceed the limit.
+		r.Body = http.MaxBytesReader(w, r.Body, rt.maxBody)
+	}
+	if rt.limiter != nil {
+		release, ok := rt.limiter.limit(w, r)
+		if !ok {
+			return
+		}
+		defer release()
+	}
+	if rt.auth != nil {
+		var ok bool
+		if r, ok = rt.authenticate(w, r, st); !ok {
+			return
+		}
+	}
+	// Denied requests get no affinity cookie.
+	st.upstream, st.affinity = rt.choose(w, r)
+	if len(rt.faults) != 0 {
+		var ok bool
+		if w, ok = injectFaults(w, r, st); !ok {
+			return
+		}
+	}
+	if rt.cache && p.cache != nil {
+		p.cache.serve(w, r, st, p.forward)
+	} else {
+		p.forward(w, r, st)
+	}
+}
 
-	err = r.Write(dst)
-	if err != nil {
-		log.Printf("Error copying request to target: %v", err)
+// done records the metrics of a completed request and logs it.
+func (p *reverseProxy) done(r *http.Request, st *proxyState, lw *logWriter) {
+	status := lw.status
+	switch {
+	case status == 0 && st.websocket:
+		status = http.StatusSwitchingProtocols
+	case status == 0:
+		status = http.StatusOK
+	}
+	p.metrics.observe(st, status)
+	if p.accessLog != nil {
+		p.accessLog.log(r, st, lw)
+	}
+}
+
+// forward sends the request to a backend of the upstream in st.
+func (p *reverseProxy) forward(w http.ResponseWriter, r *http.Request, st *proxyState) {
+	rt, u := st.route, st.upstream
+	if !u.breaker.allow() {
+		w.Header().Set("Retry-After", strconv.Itoa(int(u.breaker.openTime.Seconds())))
+		http.Error(w, "Upstream unavailable.", http.StatusServiceUnavailable)
+		return
+	}
+	var b *backend
+	if st.affinity != "" {
+		b = u.pickKey(st.affinity)
+	} else {
+		b = u.pick(r)
+	}
+	if b == nil {
+		http.Error(w, "No backend available.", http.StatusServiceUnavailable)
 		return
 	}
+	st.backend = b
+	b.conns.Add(1)
+	// Retries may move the request to another backend.
+	defer func() { st.backend.conns.Add(-1) }()
 
-	errc := make(chan error, 2)
-	cp := func(dst io.Writer, src io.Reader) {
-		_, err := io.Copy(dst, src)
-		errc <- err
+	r = rt.rewritePath(r)
+	r = r.WithContext(context.WithValue(r.Context(), stateKey{}, st))
+	switch {
+	case isWebsocket(r):
+		p.handleWebsocket(w, r, st)
+	case rt.mirror != nil && !isGRPC(r):
+		w, done := rt.mirror.start(w, r, p, rt)
+		p.proxy.ServeHTTP(w, r)
+		done()
+	default:
+		p.proxy.ServeHTTP(w, r)
 	}
-	go cp(dst, src)
-	go cp(src, dst)
-	<-errc
 }
 
 func main() {
 	flag.Parse()
-	if *target == "" {
+	if *replayFile != "" {
+		rp, err := readReplay(*replayFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := serve(rp, nil); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	var c *config
+	var err error
+	switch {
+	case *configFile != "":
+		c, err = readConfig(*configFile)
+	case *target != "":
+		c, err = flagConfig()
+	default:
 		usage()
 	}
-	proxy, err := newReverseProxy(*target)
 	if err != nil {
 		log.Fatal(err)
 	}
-	log.Fatal(http.ListenAndServe(*addr, proxy))
+	proxy, err := newReverseProxy(c)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *accessLogFile != "" {
+		w := io.Writer(os.Stdout)
+		if *accessLogFile != "-" {
+			f, err := os.OpenFile(*accessLogFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+			if err != nil {
+				log.Fatal(err)
+			}
+			w = f
+		}
+		if proxy.accessLog, err = newAccessLog(w, *accessLogFormat); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if proxy.trusted, err = parseCIDRs(*trustedProxies); err != nil {
+		log.Fatal(err)
+	}
+	if *wsTeeFile != "" {
+		w := io.Writer(os.Stdout)
+		if *wsTeeFile != "-" {
+			f, err := os.OpenFile(*wsTeeFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+			if err != nil {
+				log.Fatal(err)
+			}
+			w = f
+		}
+		proxy.wsTee = &wsTee{w: w}
+	}
+	if *cacheSize > 0 {
+		proxy.cache, err = newCache(*cacheSize<<20, *cacheDir, *cacheDiskSize<<20)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if err := proxy.checkRoutes(proxy.current()); err != nil {
+		log.Fatal(err)
+	}
+	proxy.checkHealth()
+	if err := proxy.listenStreams(); err != nil {
+		log.Fatal(err)
+	}
+	if *adminAddr != "" {
+		if *adminToken == "" && !loopback(*adminAddr) {
+			log.Fatalf("The admin API on %s needs -admin-token unless it listens on a loopback address", *adminAddr)
+		}
+		go func() {
+			log.Fatal(http.ListenAndServe(*adminAddr, newAdminHandler(proxy, *adminToken)))
+		}()
+	}
+	if *configFile != "" {
+		proxy.reloadOnHangup(*configFile)
+	}
+	var h http.Handler = proxy
+	var rec *recorder
+	if *recordFile != "" {
+		rec = newRecorder(*recordFile, *recordBody, strings.Split(*recordRedact, ","))
+		go rec.flush(time.Second)
+		h = rec.handler(proxy)
+	}
+	if err := serve(h, proxy); err != nil {
+		log.Fatal(err)
+	}
+	if rec != nil {
+		if err := rec.write(); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+// serve serves h on the listen address, with TLS if certificates
+// are given, until SIGINT or SIGTERM. Then it stops accepting
+// connections and waits for the requests in flight and, until
+// -shutdown-timeout, for the websockets of p, if any.
+func serve(h http.Handler, p *reverseProxy) error {
+	srv := &http.Server{Addr: *addr, Handler: h, Protocols: new(http.Protocols)}
+	srv.Protocols.SetHTTP1(true)
+	srv.Protocols.SetHTTP2(true)
+	srv.Protocols.SetUnencryptedHTTP2(true)
+	done := make(chan struct{})
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+		log.Printf("Shutting down")
+		ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+		defer cancel()
+		streams := make(chan struct{})
+		go func() {
+			if p != nil {
+				p.closeStreams(ctx)
+			}
+			close(streams)
+		}()
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Printf("Error shutting down: %v", err)
+		}
+		if p != nil {
+			p.closeWebsockets(ctx)
+		}
+		<-streams
+		close(done)
+	}()
+
+	l, err := net.Listen("tcp", srv.Addr)
+	if err != nil {
+		return err
+	}
+	if *proxyProtocol {
+		l = proxyListener{l}
+	}
+	if *certFile == "" && *certDir == "" {
+		err = srv.Serve(l)
+	} else {
+		var certs *certStore
+		if certs, err = newCertStore(*certFile, *keyFile, *certDir); err != nil {
+			return err
+		}
+		go certs.watch(10 * time.Second)
+		if srv.TLSConfig, err = newServerTLSConfig(certs, *tlsMin, *tlsCiphers, *clientCA); err != nil {
+			return err
+		}
+		err = srv.ServeTLS(l, "", "")
+	}
+	if err != http.ErrServerClosed {
+		return err
+	}
+	<-done
+	return nil
+}
+
+// flagConfig returns the configuration given by the flags,
+// which routes all requests to a single upstream.
+func flagConfig() (*config, error) {
+	uc := &upstreamConfig{
+		Strategy:      *strategy,
+		Hash:          *hashKey,
+		CA:            *caFile,
+		RewriteHost:   *setHost,
+		H2C:           *h2c,
+		ProxyProtocol: *sendProxy,
+		Eject:         &ejectConfig{After: *ejectAfter, Time: duration(*ejectTime)},
+		Transport: &transportConfig{
+			DialTimeout:           duration(*dialTimeout),
+			TLSHandshakeTimeout:   duration(*tlsTimeout),
+			ResponseHeaderTimeout: duration(*headerTimeout),
+			IdleConnTimeout:       duration(*idleConnTimeout),
+			MaxIdleConns:          *maxIdleConns,
+			MaxConns:              *maxTargetConns,
+			KeepAlive:             duration(*keepAlive),
+			WebsocketIdleTimeout:  duration(*wsIdle),
+		},
+	}
+	if *wsIdle == 0 {
+		uc.Transport.WebsocketIdleTimeout = -1 // never
+	}
+	targets := strings.Split(*target, ",")
+	var ws []string
+	if *weights != "" {
+		ws = strings.Split(*weights, ",")
+		if len(ws) != len(targets) {
+			return nil, fmt.Errorf("%d weights for %d targets", len(ws), len(targets))
+		}
+	}
+	for i, t := range targets {
+		tc := targetConfig{URL: t, Weight: 1}
+		if ws != nil {
+			w, err := strconv.Atoi(strings.TrimSpace(ws[i]))
+			if err != nil || w <= 0 {
+				return nil, fmt.Errorf("invalid weight %q", ws[i])
+			}
+			tc.Weight = w
+		}
+		uc.Targets = append(uc.Targets, tc)
+	}
+	if *retries > 0 {
+		uc.Retry = &retryConfig{Retries: *retries, Backoff: duration(*retryBackoff)}
+		for _, s := range strings.Split(*retryStatuses, ",") {
+			code, err := strconv.Atoi(strings.TrimSpace(s))
+			if err != nil {
+				return nil, fmt.Errorf("invalid status %q", s)
+			}
+			uc.Retry.Statuses = append(uc.Retry.Statuses, code)
+		}
+	}
+	if *breakerAfter > 0 {
+		uc.Breaker = &breakerConfig{Failures: *breakerAfter, Open: duration(*breakerTime)}
+	}
+	if *healthPath != "" {
+		uc.Health = &healthConfig{
+			Path:     *healthPath,
+			Interval: duration(*healthInterval),
+			Timeout:  duration(*healthTimeout),
+			Status:   *healthStatus,
+		}
+	}
+	rc := &routeConfig{Upstream: "default", Cache: *cacheSize > 0, Affinity: *affinity, MaxBody: *maxRequestBody}
+	if *rateLimit > 0 || *maxConns > 0 || *maxWebsockets > 0 {
+		rc.Limit = &limitConfig{
+			Rate:          *rateLimit,
+			Burst:         *rateBurst,
+			Key:           *rateKey,
+			MaxConns:      *maxConns,
+			MaxWebsockets: *maxWebsockets,
+		}
+	}
+	switch {
+	case *htpasswd != "":
+		rc.Auth = &authConfig{Basic: &basicAuthConfig{Htpasswd: *htpasswd}}
+	case *jwtKeys != "":
+		rc.Auth = &authConfig{JWT: &jwtConfig{Keys: *jwtKeys}}
+	case *forwardURL != "":
+		rc.Auth = &authConfig{Forward: &forwardAuthConfig{URL: *forwardURL, Headers: []string{userHeader}}}
+	}
+	if *wsLog || *wsTeeFile != "" || *wsMaxMessage > 0 || *wsPing > 0 {
+		rc.Websocket = &websocketConfig{Log: *wsLog, Tee: *wsTeeFile != "", MaxMessage: *wsMaxMessage, Ping: duration(*wsPing)}
+	}
+	if *faultDelay > 0 || *faultAbort != 0 {
+		rc.Faults = []*faultConfig{{Percent: faultPercent, Delay: duration(*faultDelay), Abort: *faultAbort}}
+	}
+	c := &config{
+		Upstreams: map[string]*upstreamConfig{"default": uc},
+		Routes:    []*routeConfig{rc},
+	}
+	if *denyCIDRs != "" {
+		c.Access = append(c.Access, &accessRuleConfig{Action: "deny", CIDRs: []string{*denyCIDRs}})
+	}
+	if *allowCIDRs != "" {
+		c.Access = append(c.Access,
+			&accessRuleConfig{Action: "allow", CIDRs: []string{*allowCIDRs}},
+			&accessRuleConfig{Action: "deny"})
+	}
+	if *errorPages != "" {
+		var err error
+		if c.ErrorPages, err = errorPageFiles(*errorPages); err != nil {
+			return nil, err
+		}
+	}
+	if *canary != "" {
+		if *canaryPercent < 0 || *canaryPercent > 100 {
+			return nil, fmt.Errorf("canary percent %d out of range", *canaryPercent)
+		}
+		cc := *uc
+		cc.Targets = nil
+		for _, t := range strings.Split(*canary, ",") {
+			cc.Targets = append(cc.Targets, targetConfig{URL: t, Weight: 1})
+		}
+		c.Upstreams["canary"] = &cc
+		rc.Upstream = ""
+		rc.Split = []*splitConfig{
+			{Upstream: "default", Weight: 100 - *canaryPercent},
+			{Upstream: "canary", Weight: *canaryPercent, Headers: map[string]string{*canaryHeader: "1"}},
+		}
+	}
+	if *mirrorTarget != "" {
+		c.Upstreams["shadow"] = &upstreamConfig{Targets: []targetConfig{{URL: *mirrorTarget}}, CA: *caFile}
+		rc.Mirror = &mirrorConfig{Upstream: "shadow", Percent: mirrorPercent, Diff: *mirrorDiff}
+	}
+	return c, nil
 }
 
 func usage() {
-	fmt.Println("Usage: rproxy -host http[s]://... [-addr ...]")
+	fmt.Println("Usage: rproxy -target http[s]://...[,http[s]://...] [-addr ...]")
+	fmt.Println("       rproxy -config file.json [-addr ...]")
+	fmt.Println("       rproxy -replay file.har [-addr ...]")
 	fmt.Println("Flags:")
 	flag.PrintDefaults()
 	os.Exit(2)
@@ -0,0 +1,58 @@
+// Copyright (c) 2014 David R. Jenni. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// newTestProxy returns a proxy with the configuration. If h is not
+// nil, a target served by h is added to the upstream "a", which
+// receives all requests if the configuration has no routes.
+func newTestProxy(t *testing.T, h http.Handler, c *config) *reverseProxy {
+	t.Helper()
+	if h != nil {
+		ts := httptest.NewServer(h)
+		t.Cleanup(ts.Close)
+		if c.Upstreams == nil {
+			c.Upstreams = make(map[string]*upstreamConfig)
+		}
+		uc := c.Upstreams["a"]
+		if uc == nil {
+			uc = &upstreamConfig{}
+			c.Upstreams["a"] = uc
+		}
+		uc.Targets = append(uc.Targets, targetConfig{URL: ts.URL})
+		if len(c.Routes) == 0 {
+			c.Routes = []*routeConfig{{Upstream: "a"}}
+		}
+	}
+	p, err := newReverseProxy(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestRewriteHost(t *testing.T) {
+	host := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Host))
+	})
+	for _, rewriteHost := range []bool{false, true} {
+		p := newTestProxy(t, host, &config{Upstreams: map[string]*upstreamConfig{"a": {RewriteHost: rewriteHost}}})
+		target := p.current().upstreams["a"].backends[0].url.Host
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, httptest.NewRequest("GET", "http://front.example/", nil))
+		want := "front.example"
+		if rewriteHost {
+			want = target
+		}
+		if got := w.Body.String(); got != want {
+			t.Errorf("rewriteHost %v: expected Host %q, got %q", rewriteHost, want, got)
+		}
+	}
+}
@@ -0,0 +1,208 @@
+// Copyright (c) 2014 David R. Jenni. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// latencyBuckets are the upper bounds of the latency histograms in seconds.
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// histogram is a Prometheus histogram.
+type histogram struct {
+	counts []int64 // per bucket, not cumulative; the last is +Inf
+	sum    float64
+	count  int64
+}
+
+func (h *histogram) observe(v float64) {
+	if h.counts == nil {
+		h.counts = make([]int64, len(latencyBuckets)+1)
+	}
+	i, _ := slices.BinarySearch(latencyBuckets, v)
+	h.counts[i]++
+	h.sum += v
+	h.count++
+}
+
+// requestKey labels the requests of a route to an upstream.
+type requestKey struct {
+	route, upstream string
+	code            int
+}
+
+// metrics collects the metrics of the proxy.
+type metrics struct {
+	mu         sync.Mutex
+	requests   map[requestKey]int64
+	latency    map[string]*histogram // total latency by route
+	upstream   map[string]*histogram // time to the response header by upstream
+	websockets map[string]int64      // active websockets by route
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		requests:   make(map[requestKey]int64),
+		latency:    make(map[string]*histogram),
+		upstream:   make(map[string]*histogram),
+		websockets: make(map[string]int64),
+	}
+}
+
+// observe records a completed request.
+func (m *metrics) observe(st *proxyState, status int) {
+	var k requestKey
+	if st.route != nil {
+		k.route = st.route.name
+	}
+	if st.upstream != nil {
+		k.upstream = st.upstream.name
+	}
+	k.code = status
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests[k]++
+	if st.websocket {
+		return // the latency of a websocket is its lifetime
+	}
+	h := m.latency[k.route]
+	if h == nil {
+		h = new(histogram)
+		m.latency[k.route] = h
+	}
+	h.observe(time.Since(st.start).Seconds())
+	if st.backend != nil {
+		h := m.upstream[k.upstream]
+		if h == nil {
+			h = new(histogram)
+			m.upstream[k.upstream] = h
+		}
+		h.observe(st.ttfb.Seconds())
+	}
+}
+
+// websocket adds d to the active websockets of the route.
+func (m *metrics) websocket(route string, d int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.websockets[route] += d
+}
+
+// labelEscaper escapes label values as the text exposition format does.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labels formats label pairs.
+func labels(kv ...string) string {
+	var b strings.Builder
+	b.WriteByte('{')
+	for i := 0; i < len(kv); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, `%s="%s"`, kv[i], labelEscaper.Replace(kv[i+1]))
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// writeHistogram writes a histogram in the text exposition format.
+func writeHistogram(w io.Writer, name, lbl string, h *histogram) {
+	var cum int64
+	for i, le := range latencyBuckets {
+		cum += h.counts[i]
+		fmt.Fprintf(w, "%s_bucket%s %d\n", name, bucketLabels(lbl, strconv.FormatFloat(le, 'g', -1, 64)), cum)
+	}
+	fmt.Fprintf(w, "%s_bucket%s %d\n", name, bucketLabels(lbl, "+Inf"), h.count)
+	fmt.Fprintf(w, "%s_sum%s %g\n", name, lbl, h.sum)
+	fmt.Fprintf(w, "%s_count%s %d\n", name, lbl, h.count)
+}
+
+// bucketLabels adds the le label to the formatted labels lbl.
+func bucketLabels(lbl, le string) string {
+	return strings.TrimSuffix(lbl, "}") + `,le="` + le + `"}`
+}
+
+// serveMetrics writes the metrics of the proxy in the
+// Prometheus text exposition format.
+func (p *reverseProxy) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
+	m := p.metrics
+	m.mu.Lock()
+
+	fmt.Fprintln(bw, "# HELP rproxy_requests_total Requests by route, upstream and status.")
+	fmt.Fprintln(bw, "# TYPE rproxy_requests_total counter")
+	keys := slices.SortedFunc(maps.Keys(m.requests), func(a, b requestKey) int {
+		return cmp.Or(strings.Compare(a.route, b.route), strings.Compare(a.upstream, b.upstream), cmp.Compare(a.code, b.code))
+	})
+	for _, k := range keys {
+		fmt.Fprintf(bw, "rproxy_requests_total%s %d\n",
+			labels("route", k.route, "upstream", k.upstream, "code", strconv.Itoa(k.code)), m.requests[k])
+	}
+
+	fmt.Fprintln(bw, "# HELP rproxy_request_duration_seconds Latency of the requests by route.")
+	fmt.Fprintln(bw, "# TYPE rproxy_request_duration_seconds histogram")
+	for _, route := range slices.Sorted(maps.Keys(m.latency)) {
+		writeHistogram(bw, "rproxy_request_duration_seconds", labels("route", route), m.latency[route])
+	}
+
+	fmt.Fprintln(bw, "# HELP rproxy_upstream_response_seconds Time until the response header by upstream.")
+	fmt.Fprintln(bw, "# TYPE rproxy_upstream_response_seconds histogram")
+	for _, name := range slices.Sorted(maps.Keys(m.upstream)) {
+		writeHistogram(bw, "rproxy_upstream_response_seconds", labels("upstream", name), m.upstream[name])
+	}
+
+	fmt.Fprintln(bw, "# HELP rproxy_websockets_active Active websockets by route.")
+	fmt.Fprintln(bw, "# TYPE rproxy_websockets_active gauge")
+	for _, route := range slices.Sorted(maps.Keys(m.websockets)) {
+		fmt.Fprintf(bw, "rproxy_websockets_active%s %d\n", labels("route", route), m.websockets[route])
+	}
+	m.mu.Unlock()
+
+	t := p.current()
+	gauges := []struct {
+		name, help string
+		value      func(b *backend) int64
+	}{
+		{"rproxy_backend_up", "Whether a backend receives requests.", func(b *backend) int64 {
+			if b.available() {
+				return 1
+			}
+			return 0
+		}},
+		{"rproxy_backend_connections", "Active connections of a backend.", func(b *backend) int64 { return b.conns.Load() }},
+		{"rproxy_backend_weight", "Weight of a backend.", func(b *backend) int64 { return b.weight.Load() }},
+	}
+	for _, g := range gauges {
+		fmt.Fprintf(bw, "# HELP %s %s\n", g.name, g.help)
+		fmt.Fprintf(bw, "# TYPE %s gauge\n", g.name)
+		for _, name := range slices.Sorted(maps.Keys(t.upstreams)) {
+			for _, b := range t.upstreams[name].list() {
+				fmt.Fprintf(bw, "%s%s %d\n", g.name, labels("upstream", name, "backend", b.url.String()), g.value(b))
+			}
+		}
+	}
+	fmt.Fprintln(bw, "# HELP rproxy_breaker_open Whether the circuit breaker of an upstream is open.")
+	fmt.Fprintln(bw, "# TYPE rproxy_breaker_open gauge")
+	for _, name := range slices.Sorted(maps.Keys(t.upstreams)) {
+		open := 0
+		if t.upstreams[name].breaker.current() != breakerClosed {
+			open = 1
+		}
+		fmt.Fprintf(bw, "rproxy_breaker_open%s %d\n", labels("upstream", name), open)
+	}
+}
@@ -0,0 +1,235 @@
+// Copyright (c) 2014 David R. Jenni. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	hashing "hash"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"net/http/httputil"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Defaults of the mirroring.
+const (
+	defaultMirrorMaxBody = 64 << 10
+	mirrorTimeout        = 30 * time.Second
+	maxMirrors           = 100 // concurrent mirrored requests
+)
+
+// mirror copies a share of the requests of a route to a shadow
+// upstream and discards its responses. With diff, differences
+// between the responses of the upstream and the shadow are logged.
+type mirror struct {
+	upstream *upstream
+	percent  float64
+	diff     bool
+	ignore   []string // headers not compared, canonicalized
+	maxBody  int64    // largest mirrored request body
+
+	sem chan struct{} // limits the concurrent mirrored requests
+}
+
+// newMirror returns a mirror to the upstream u of the given
+// percentage of the requests, all if percent is nil.
+func newMirror(u *upstream, percent *float64, diff bool, ignore []string, maxBody int64) *mirror {
+	m := &mirror{
+		upstream: u,
+		percent:  100,
+		diff:     diff,
+		ignore:   []string{"Date"},
+		maxBody:  maxBody,
+		sem:      make(chan struct{}, maxMirrors),
+	}
+	if percent != nil {
+		m.percent = *percent
+	}
+	if m.maxBody == 0 {
+		m.maxBody = defaultMirrorMaxBody
+	}
+	for _, h := range ignore {
+		m.ignore = append(m.ignore, http.CanonicalHeaderKey(h))
+	}
+	return m
+}
+
+// mirrorResult is the part of a response which is compared.
+type mirrorResult struct {
+	status int
+	header http.Header
+	sum    []byte
+	err    error
+}
+
+// isGRPC reports whether the request is a gRPC call. Its body may
+// stream until the response ends, so it is not mirrored.
+func isGRPC(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc")
+}
+
+// start mirrors the request if it is sampled. The shadow gets the
+// headers p would send to the primary. It returns the writer for
+// the response of the upstream and a function to call once that
+// response is written.
+func (m *mirror) start(w http.ResponseWriter, r *http.Request, p *reverseProxy, rt *route) (http.ResponseWriter, func()) {
+	if rand.Float64()*100 >= m.percent {
+		return w, func() {}
+	}
+	select {
+	case m.sem <- struct{}{}:
+	default:
+		return w, func() {} // the shadow is too slow, skip it
+	}
+	body, ok, err := bufferBody(r, m.maxBody)
+	if err != nil || !ok {
+		<-m.sem
+		return w, func() {}
+	}
+	if body != nil {
+		r.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	b := m.upstream.pick(r)
+	if b == nil {
+		<-m.sem
+		return w, func() {}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), mirrorTimeout)
+	pr := &httputil.ProxyRequest{In: r, Out: r.Clone(ctx)}
+	pr.Out.RequestURI = ""
+	pr.Out.Body = http.NoBody
+	if body != nil {
+		pr.Out.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	removeHopHeaders(pr.Out.Header)
+	for _, h := range forwardedHeaders {
+		pr.Out.Header.Del(h)
+	}
+	p.forwardTo(pr, m.upstream, b, rt)
+
+	shadow := make(chan mirrorResult, 1)
+	go func() {
+		defer func() { <-m.sem }()
+		defer cancel()
+		shadow <- m.send(pr.Out, b, rt)
+	}()
+	if !m.diff {
+		return w, func() {}
+	}
+	dw := &diffWriter{ResponseWriter: w, hash: sha256.New()}
+	method, uri := r.Method, r.RequestURI
+	return dw, func() {
+		primary := mirrorResult{status: dw.status, header: dw.header, sum: dw.hash.Sum(nil)}
+		if primary.status == 0 {
+			primary.status = http.StatusOK
+			primary.header = w.Header().Clone()
+		}
+		go func() {
+			res := <-shadow
+			if res.err != nil {
+				log.Printf("Error mirroring %s %s: %v", method, uri, res.err)
+				return
+			}
+			if d := m.compare(primary, res); len(d) != 0 {
+				log.Printf("Mirror diff %s %s: %s", method, uri, strings.Join(d, "; "))
+			}
+		}()
+	}
+}
+
+// send sends the request to the backend b of the shadow upstream.
+// The header of the response is changed like that of the upstream,
+// so that only differences of the targets are compared.
+func (m *mirror) send(r *http.Request, b *backend, rt *route) mirrorResult {
+	b.conns.Add(1)
+	defer b.conns.Add(-1)
+	resp, err := m.upstream.transport.RoundTrip(r)
+	m.upstream.report(b, err == nil && !targetFailed(resp.StatusCode))
+	if err != nil {
+		return mirrorResult{err: err}
+	}
+	defer resp.Body.Close()
+	if !m.diff {
+		io.Copy(io.Discard, resp.Body)
+		return mirrorResult{}
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, resp.Body); err != nil {
+		return mirrorResult{err: err}
+	}
+	removeHopHeaders(resp.Header)
+	rt.responseHeaders.apply(resp.Header)
+	return mirrorResult{status: resp.StatusCode, header: resp.Header, sum: h.Sum(nil)}
+}
+
+// compare returns the differences between the responses
+// of the upstream and the shadow.
+func (m *mirror) compare(primary, shadow mirrorResult) []string {
+	var diffs []string
+	if primary.status != shadow.status {
+		diffs = append(diffs, fmt.Sprintf("status %d != %d", primary.status, shadow.status))
+	}
+	var keys []string
+	for k := range primary.header {
+		keys = append(keys, k)
+	}
+	for k := range shadow.header {
+		if _, ok := primary.header[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	slices.Sort(keys)
+	for _, k := range keys {
+		if slices.Contains(m.ignore, k) {
+			continue
+		}
+		p, s := strings.Join(primary.header[k], ", "), strings.Join(shadow.header[k], ", ")
+		if p != s {
+			diffs = append(diffs, fmt.Sprintf("header %s %q != %q", k, p, s))
+		}
+	}
+	if !bytes.Equal(primary.sum, shadow.sum) {
+		diffs = append(diffs, fmt.Sprintf("body sha256 %x != %x", primary.sum[:8], shadow.sum[:8]))
+	}
+	return diffs
+}
+
+// diffWriter records the status, the header and
+// the hash of the body of a response.
+type diffWriter struct {
+	http.ResponseWriter
+	status int
+	header http.Header
+	hash   hashing.Hash
+}
+
+func (w *diffWriter) WriteHeader(status int) {
+	if w.status == 0 && status >= 200 {
+		w.status = status
+		w.header = w.Header().Clone()
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *diffWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	w.hash.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap returns the underlying ResponseWriter.
+func (w *diffWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,169 @@
+// Copyright (c) 2014 David R. Jenni. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/sha256"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMirror(t *testing.T) {
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(w, r.Body)
+	}))
+	defer primary.Close()
+	mirrored := make(chan string, 1)
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		mirrored <- r.Method + " " + r.URL.Path + " " + string(b)
+		http.Error(w, "shadow", http.StatusInternalServerError)
+	}))
+	defer shadow.Close()
+	p, err := newReverseProxy(&config{
+		Upstreams: map[string]*upstreamConfig{
+			"a":      {Targets: []targetConfig{{URL: primary.URL}}},
+			"shadow": {Targets: []targetConfig{{URL: shadow.URL}}},
+		},
+		Routes: []*routeConfig{{Upstream: "a", Mirror: &mirrorConfig{Upstream: "shadow", Diff: true}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest("POST", "/x", strings.NewReader("body"))
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || w.Body.String() != "body" {
+		t.Errorf("Expected 200 body from the primary, got %d %q", w.Code, w.Body.String())
+	}
+	select {
+	case m := <-mirrored:
+		if m != "POST /x body" {
+			t.Errorf("Expected the shadow to get POST /x body, got %q", m)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected the request to be mirrored")
+	}
+}
+
+func TestMirrorPercent(t *testing.T) {
+	if m := newMirror(nil, nil, false, nil, 0); m.percent != 100 {
+		t.Errorf("Expected to mirror 100%% by default, got %v", m.percent)
+	}
+	m := newMirror(nil, percent(0), false, nil, 0)
+	for i := 0; i < 100; i++ {
+		w := httptest.NewRecorder()
+		if got, _ := m.start(w, httptest.NewRequest("GET", "/", nil), nil, nil); got != w {
+			t.Fatalf("Expected no request to be mirrored at 0%%")
+		}
+	}
+}
+
+func TestMirrorHeaders(t *testing.T) {
+	headers := make(chan http.Header, 2)
+	record := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers <- r.Header
+	})
+	shadow := httptest.NewServer(record)
+	defer shadow.Close()
+	p := newTestProxy(t, record, &config{
+		Upstreams: map[string]*upstreamConfig{"shadow": {Targets: []targetConfig{{URL: shadow.URL}}}},
+		Routes:    []*routeConfig{{Upstream: "a", Mirror: &mirrorConfig{Upstream: "shadow"}}},
+	})
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "198.51.100.1:1234"
+	r.Header.Set("X-Forwarded-For", "10.0.0.1")
+	r.Header.Set("Connection", "X-Secret")
+	r.Header.Set("X-Secret", "1")
+	r.Header.Set("Proxy-Authorization", "Basic eDp4")
+	p.ServeHTTP(httptest.NewRecorder(), r)
+	for _, who := range []string{"first", "second"} {
+		var h http.Header
+		select {
+		case h = <-headers:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected the %s request", who)
+		}
+		if got := h.Get("X-Forwarded-For"); got != "198.51.100.1" {
+			t.Errorf("%s: expected X-Forwarded-For 198.51.100.1, got %q", who, got)
+		}
+		for _, k := range []string{"X-Secret", "Proxy-Authorization"} {
+			if got := h.Get(k); got != "" {
+				t.Errorf("%s: expected no %s, got %q", who, k, got)
+			}
+		}
+	}
+}
+
+func TestMirrorNormalize(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Connection", "X-Hop")
+		w.Header().Set("X-Hop", "1")
+		w.Header().Set("Keep-Alive", "timeout=5")
+		w.Header().Set("Server", "target")
+		io.WriteString(w, "body")
+	})
+	shadow := httptest.NewServer(h)
+	defer shadow.Close()
+	p := newTestProxy(t, h, &config{
+		Upstreams: map[string]*upstreamConfig{"shadow": {Targets: []targetConfig{{URL: shadow.URL}}}},
+		Routes: []*routeConfig{{
+			Upstream:        "a",
+			Mirror:          &mirrorConfig{Upstream: "shadow", Percent: percent(0), Diff: true},
+			ResponseHeaders: []headerRuleConfig{{Op: "set", Name: "Server", Value: "rproxy"}},
+		}},
+	})
+
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	sum := sha256.Sum256(w.Body.Bytes())
+	primary := mirrorResult{status: w.Code, header: w.Header(), sum: sum[:]}
+
+	rt := p.current().routes[0]
+	r, err := http.NewRequest("GET", shadow.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := rt.mirror.send(r, rt.mirror.upstream.backends[0], rt)
+	if res.err != nil {
+		t.Fatal(res.err)
+	}
+	if d := rt.mirror.compare(primary, res); len(d) != 0 {
+		t.Errorf("Expected no differences, got %q", d)
+	}
+}
+
+func TestMirrorCompare(t *testing.T) {
+	m := newMirror(nil, nil, true, []string{"server"}, 0)
+	a := mirrorResult{
+		status: 200,
+		header: http.Header{"Date": {"1"}, "Server": {"a"}, "Content-Type": {"text/plain"}},
+		sum:    make([]byte, 32),
+	}
+	if d := m.compare(a, a); len(d) != 0 {
+		t.Errorf("Expected no differences, got %q", d)
+	}
+	b := mirrorResult{
+		status: 500,
+		header: http.Header{"Date": {"2"}, "Server": {"b"}, "X-Debug": {"1"}},
+		sum:    make([]byte, 32),
+	}
+	b.sum[0] = 1
+	want := []string{
+		"status 200 != 500",
+		`header Content-Type "text/plain" != ""`,
+		`header X-Debug "" != "1"`,
+		"body sha256 0000000000000000 != 0100000000000000",
+	}
+	if d := m.compare(a, b); strings.Join(d, "\n") != strings.Join(want, "\n") {
+		t.Errorf("Expected %q, got %q", want, d)
+	}
+}
@@ -0,0 +1,296 @@
+// Copyright (c) 2014 David R. Jenni. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	proxyHeaderTimeout = 10 * time.Second // timeout reading a PROXY protocol header
+	maxProxyV1         = 107              // longest v1 header
+)
+
+// proxySig is the signature of a PROXY protocol v2 header.
+var proxySig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// errNoProxyHeader is returned for a connection which does
+// not start with a PROXY protocol header.
+var errNoProxyHeader = errors.New("no PROXY protocol header")
+
+// proxyListener accepts connections which start with a PROXY protocol
+// header, sent by a load balancer in front of rproxy.
+type proxyListener struct {
+	net.Listener
+}
+
+func (l proxyListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyConn{Conn: c}, nil
+}
+
+// proxyConn is a connection which starts with a PROXY protocol header.
+// The header is read by the first Read or RemoteAddr, which returns
+// the address of the client given by the header.
+type proxyConn struct {
+	net.Conn
+	once   sync.Once
+	r      *bufio.Reader
+	remote net.Addr // nil if the header has no address
+	err    error
+}
+
+func (c *proxyConn) init() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		c.r = bufio.NewReader(c.Conn)
+		c.remote, c.err = readProxyHeader(c.r)
+		c.Conn.SetReadDeadline(time.Time{})
+		if c.err != nil {
+			log.Printf("Error reading the PROXY protocol header of %s: %v", c.Conn.RemoteAddr(), c.err)
+		}
+	})
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.init()
+	if c.remote == nil {
+		return c.Conn.RemoteAddr()
+	}
+	return c.remote
+}
+
+// CloseWrite shuts down the writing side of a TCP connection.
+func (c *proxyConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+// readProxyHeader reads a PROXY protocol v1 or v2 header and returns
+// the source address it gives, or nil for a header without address
+// (v1 UNKNOWN, v2 LOCAL or an unsupported address family).
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	b, err := r.Peek(len(proxySig))
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case bytes.Equal(b, proxySig):
+		return readProxyV2(r)
+	case bytes.HasPrefix(b, []byte("PROXY ")):
+		return readProxyV1(r)
+	}
+	return nil, errNoProxyHeader
+}
+
+// readProxyV1 reads a header like "PROXY TCP4 src dst sport dport\r\n".
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if line = append(line, b); len(line) > maxProxyV1 {
+			return nil, fmt.Errorf("PROXY protocol header too long")
+		}
+	}
+	f := strings.Fields(string(line))
+	if len(f) >= 2 && f[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(f) != 6 || (f[1] != "TCP4" && f[1] != "TCP6") {
+		return nil, fmt.Errorf("invalid PROXY protocol header %q", line)
+	}
+	ip, err := netip.ParseAddr(f[2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid PROXY protocol source %q", f[2])
+	}
+	port, err := strconv.ParseUint(f[4], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid PROXY protocol port %q", f[4])
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, uint16(port))), nil
+}
+
+// readProxyV2 reads a binary header.
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	h := make([]byte, 16)
+	if _, err := io.ReadFull(r, h); err != nil {
+		return nil, err
+	}
+	if h[12]>>4 != 2 {
+		return nil, fmt.Errorf("invalid PROXY protocol version %d", h[12]>>4)
+	}
+	b := make([]byte, binary.BigEndian.Uint16(h[14:]))
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	if h[12]&0x0f == 0 {
+		return nil, nil // LOCAL, such as a health check of the balancer
+	}
+	var ip netip.Addr
+	var port []byte
+	switch h[13] >> 4 {
+	case 1: // IPv4
+		if len(b) < 12 {
+			return nil, fmt.Errorf("short PROXY protocol address")
+		}
+		ip, port = netip.AddrFrom4([4]byte(b[:4])), b[8:10]
+	case 2: // IPv6
+		if len(b) < 36 {
+			return nil, fmt.Errorf("short PROXY protocol address")
+		}
+		ip, port = netip.AddrFrom16([16]byte(b[:16])), b[32:34]
+	default:
+		return nil, nil
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip.Unmap(), binary.BigEndian.Uint16(port))), nil
+}
+
+// proxyHeader returns the PROXY protocol header of the given version
+// for a TCP connection from src to dst. Without both addresses, the
+// header carries none.
+func proxyHeader(version int, src, dst net.Addr) []byte {
+	s, sok := tcpAddrPort(src)
+	d, dok := tcpAddrPort(dst)
+	if sok && dok && s.Addr().Is4() != d.Addr().Is4() {
+		// Mixed families are sent as IPv6.
+		s = netip.AddrPortFrom(netip.AddrFrom16(s.Addr().As16()), s.Port())
+		d = netip.AddrPortFrom(netip.AddrFrom16(d.Addr().As16()), d.Port())
+	}
+	if version == 1 {
+		if !sok || !dok {
+			return []byte("PROXY UNKNOWN\r\n")
+		}
+		proto := "TCP4"
+		if !s.Addr().Is4() {
+			proto = "TCP6"
+		}
+		return fmt.Appendf(nil, "PROXY %s %s %s %d %d\r\n", proto, s.Addr(), d.Addr(), s.Port(), d.Port())
+	}
+	b := append([]byte(nil), proxySig...)
+	if !sok || !dok {
+		return append(b, 0x20, 0x00, 0x00, 0x00) // LOCAL
+	}
+	if s.Addr().Is4() {
+		b = append(b, 0x21, 0x11, 0x00, 12)
+	} else {
+		b = append(b, 0x21, 0x21, 0x00, 36)
+	}
+	b = append(b, s.Addr().AsSlice()...)
+	b = append(b, d.Addr().AsSlice()...)
+	b = binary.BigEndian.AppendUint16(b, s.Port())
+	return binary.BigEndian.AppendUint16(b, d.Port())
+}
+
+// tcpAddrPort returns the IP address and port of a TCP address.
+func tcpAddrPort(a net.Addr) (netip.AddrPort, bool) {
+	ta, ok := a.(*net.TCPAddr)
+	if !ok || ta == nil {
+		return netip.AddrPort{}, false
+	}
+	ap := ta.AddrPort()
+	return netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port()), ap.IsValid()
+}
+
+// sendProxyHeader writes the PROXY protocol header of the upstream,
+// if it has one, for the client of the request in ctx to c.
+func (u *upstream) sendProxyHeader(ctx context.Context, c net.Conn) error {
+	if u.proxyProtocol == 0 {
+		return nil
+	}
+	var src net.Addr
+	if ap, ok := ctx.Value(clientKey{}).(netip.AddrPort); ok {
+		src = net.TCPAddrFromAddrPort(ap)
+	}
+	dst, _ := ctx.Value(http.LocalAddrContextKey).(net.Addr)
+	_, err := c.Write(proxyHeader(u.proxyProtocol, src, dst))
+	return err
+}
+
+// clientKey is the context key of the address of the client.
+type clientKey struct{}
+
+// withClient stores the address of the client in the context of
+// the request: the peer or, if the peer is a trusted proxy, the
+// last untrusted address of the X-Forwarded-For header.
+func (p *reverseProxy) withClient(r *http.Request) *http.Request {
+	peer, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil {
+		return r
+	}
+	client := netip.AddrPortFrom(peer.Addr().Unmap(), peer.Port())
+	fwd := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(fwd) - 1; i >= 0 && p.trusts(client.Addr()); i-- {
+		ip, err := netip.ParseAddr(strings.TrimSpace(fwd[i]))
+		if err != nil {
+			break
+		}
+		client = netip.AddrPortFrom(ip.Unmap(), 0)
+	}
+	return r.WithContext(context.WithValue(r.Context(), clientKey{}, client))
+}
+
+// trusts reports whether ip is a trusted proxy.
+func (p *reverseProxy) trusts(ip netip.Addr) bool {
+	for _, pfx := range p.trusted {
+		if pfx.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseCIDRs parses comma separated CIDRs or IP addresses.
+func parseCIDRs(s string) ([]netip.Prefix, error) {
+	var pfxs []netip.Prefix
+	for _, f := range strings.Split(s, ",") {
+		if f = strings.TrimSpace(f); f == "" {
+			continue
+		}
+		if !strings.Contains(f, "/") {
+			ip, err := netip.ParseAddr(f)
+			if err != nil {
+				return nil, fmt.Errorf("invalid CIDR %q", f)
+			}
+			pfxs = append(pfxs, netip.PrefixFrom(ip, ip.BitLen()))
+			continue
+		}
+		pfx, err := netip.ParsePrefix(f)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q", f)
+		}
+		pfxs = append(pfxs, pfx.Masked())
+	}
+	return pfxs, nil
+}
@@ -0,0 +1,219 @@
+// Copyright (c) 2014 David R. Jenni. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestProxyHeader(t *testing.T) {
+	tests := []struct {
+		src, dst string
+		want     string // as read back
+	}{
+		{"203.0.113.7:5555", "10.0.0.1:80", "203.0.113.7:5555"},
+		{"[2001:db8::1]:5555", "[2001:db8::2]:443", "[2001:db8::1]:5555"},
+		{"203.0.113.7:5555", "[2001:db8::2]:443", "203.0.113.7:5555"},
+		{"", "", ""},
+	}
+	for _, version := range []int{1, 2} {
+		for _, test := range tests {
+			var src, dst net.Addr
+			if test.src != "" {
+				src, _ = net.ResolveTCPAddr("tcp", test.src)
+				dst, _ = net.ResolveTCPAddr("tcp", test.dst)
+			}
+			h := proxyHeader(version, src, dst)
+			r := bufio.NewReader(io.MultiReader(bytes.NewReader(h), strings.NewReader("GET / HTTP/1.1\r\n")))
+			addr, err := readProxyHeader(r)
+			if err != nil {
+				t.Errorf("v%d %s: %v", version, test.src, err)
+				continue
+			}
+			got := ""
+			if addr != nil {
+				got = addr.String()
+			}
+			if got != test.want {
+				t.Errorf("v%d: expected %q, got %q", version, test.want, got)
+			}
+			if rest, _ := r.ReadString('\n'); rest != "GET / HTTP/1.1\r\n" {
+				t.Errorf("v%d: expected the request after the header, got %q", version, rest)
+			}
+		}
+	}
+
+	r := bufio.NewReader(strings.NewReader("GET / HTTP/1.1\r\nHost: a\r\n\r\n"))
+	if _, err := readProxyHeader(r); err != errNoProxyHeader {
+		t.Errorf("Expected %v, got %v", errNoProxyHeader, err)
+	}
+}
+
+func TestTrustedProxies(t *testing.T) {
+	p := newTestProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Header.Get("X-Forwarded-For"))
+	}), &config{})
+	var err error
+	if p.trusted, err = parseCIDRs("192.0.2.0/24, 10.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		peer, fwd string
+		client    string
+		want      string // X-Forwarded-For sent to the target
+	}{
+		{"198.51.100.1:1234", "203.0.113.9", "198.51.100.1", "198.51.100.1"},
+		{"192.0.2.1:1234", "", "192.0.2.1", "192.0.2.1"},
+		{"192.0.2.1:1234", "203.0.113.9", "203.0.113.9", "203.0.113.9, 192.0.2.1"},
+		{"192.0.2.1:1234", "203.0.113.9, 198.51.100.1, 10.0.0.1", "198.51.100.1", "203.0.113.9, 198.51.100.1, 10.0.0.1, 192.0.2.1"},
+		{"192.0.2.1:1234", "bogus, 10.0.0.1", "10.0.0.1", "bogus, 10.0.0.1, 192.0.2.1"},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = test.peer
+		if test.fwd != "" {
+			r.Header.Set("X-Forwarded-For", test.fwd)
+		}
+		if ip := clientIP(p.withClient(r)); ip != test.client {
+			t.Errorf("%s %q: expected client %s, got %s", test.peer, test.fwd, test.client, ip)
+		}
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, r)
+		if got := w.Body.String(); got != test.want {
+			t.Errorf("%s %q: expected X-Forwarded-For %q, got %q", test.peer, test.fwd, test.want, got)
+		}
+	}
+
+	if _, err := parseCIDRs("10.0.0.0/33"); err == nil {
+		t.Errorf("Expected an error for an invalid CIDR")
+	}
+}
+
+// remoteAddrTarget returns a target which expects PROXY protocol
+// headers and answers with the remote address of the request,
+// also after a websocket handshake.
+func remoteAddrTarget(t *testing.T) *httptest.Server {
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isWebsocket(r) {
+			io.WriteString(w, r.RemoteAddr)
+			return
+		}
+		conn, brw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		brw.WriteString(switchProtocols(r) + r.RemoteAddr + "\n")
+		brw.Flush()
+	}))
+	ts.Listener = proxyListener{ts.Listener}
+	ts.Start()
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func TestProxyProtocol(t *testing.T) {
+	target := remoteAddrTarget(t)
+	p, err := newReverseProxy(&config{
+		Upstreams: map[string]*upstreamConfig{"a": {Targets: []targetConfig{{URL: target.URL}}, ProxyProtocol: 2}},
+		Routes:    []*routeConfig{{Upstream: "a"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	front := httptest.NewUnstartedServer(p)
+	front.Listener = proxyListener{front.Listener}
+	front.Start()
+	defer front.Close()
+
+	// The balancer in front sends v1, the target gets v2.
+	conn, err := net.Dial("tcp", front.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "PROXY TCP4 203.0.113.7 10.0.0.1 5555 80\r\nGET / HTTP/1.1\r\nHost: a\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(resp.Body)
+	if string(b) != "203.0.113.7:5555" {
+		t.Errorf("Expected the target to see 203.0.113.7:5555, got %q", b)
+	}
+
+	conn, err = net.Dial("tcp", front.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "PROXY TCP4 203.0.113.8 10.0.0.1 6666 80\r\n")
+	io.WriteString(conn, "GET /ws HTTP/1.1\r\nHost: a\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Key: "+testWSKey+"\r\n\r\n")
+	br := bufio.NewReader(conn)
+	if resp, err = http.ReadResponse(br, nil); err != nil || resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("Expected 101, got %v", err)
+	}
+	if line, _ := br.ReadString('\n'); line != "203.0.113.8:6666\n" {
+		t.Errorf("Expected the websocket target to see 203.0.113.8:6666, got %q", line)
+	}
+
+	// A connection without header is refused.
+	conn, err = net.Dial("tcp", front.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: a\r\n\r\n")
+	if resp, err = http.ReadResponse(bufio.NewReader(conn), nil); err != nil || resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected 400 without PROXY protocol header, got %v", err)
+	}
+}
+
+func TestStreamProxyProtocol(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		pl := proxyListener{l}
+		for {
+			c, err := pl.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.WriteString(c, c.RemoteAddr().String()+"\n")
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	_, addr := streamProxy(t, &config{
+		Upstreams: map[string]*upstreamConfig{"db": {Targets: []targetConfig{{URL: "tcp://" + l.Addr().String()}}, ProxyProtocol: 1}},
+		Streams:   []*streamConfig{{Listen: "127.0.0.1:0", Upstream: "db", ProxyProtocol: true}},
+	})
+
+	c, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Write(proxyHeader(2, &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 5555}, addr))
+	io.WriteString(c, "ping")
+	c.(*net.TCPConn).CloseWrite()
+	b, err := io.ReadAll(c)
+	if want := "203.0.113.7:5555\nping"; err != nil || string(b) != want {
+		t.Errorf("Expected %q, got %q %v", want, b, err)
+	}
+}
@@ -0,0 +1,209 @@
+// Copyright (c) 2014 David R. Jenni. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// limiter limits the request rate and the concurrent connections
+// of the clients of a route. The rate is limited by token buckets
+// keyed by client IP, a header value or the route as a whole; the
+// concurrent connections and websockets are limited per client IP.
+type limiter struct {
+	rate          float64 // tokens per second, 0 disables the rate limit
+	burst         float64 // size of a bucket
+	key           string  // ip, route or header:Name
+	maxConns      int     // concurrent requests and websockets, 0 for no limit
+	maxWebsockets int     // concurrent websockets, 0 for no limit
+
+	mu         sync.Mutex
+	buckets    map[string]*bucket
+	conns      map[string]int
+	websockets map[string]int
+	swept      time.Time
+}
+
+// bucket is a token bucket.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// newLimiter returns a limiter with the given rate in requests per
+// second, burst, bucket key and limits of concurrent connections.
+func newLimiter(rate float64, burst int, key string, maxConns, maxWebsockets int) (*limiter, error) {
+	if key == "" {
+		key = "ip"
+	}
+	if key != "ip" && key != "route" && !strings.HasPrefix(key, "header:") {
+		return nil, fmt.Errorf("unknown rate limit key %q", key)
+	}
+	if burst <= 0 {
+		burst = max(int(math.Ceil(rate)), 1)
+	}
+	return &limiter{
+		rate:          rate,
+		burst:         float64(burst),
+		key:           key,
+		maxConns:      maxConns,
+		maxWebsockets: maxWebsockets,
+		buckets:       make(map[string]*bucket),
+		conns:         make(map[string]int),
+		websockets:    make(map[string]int),
+	}, nil
+}
+
+// bucketKey returns the key of the bucket of the request.
+func (l *limiter) bucketKey(r *http.Request) string {
+	switch {
+	case l.key == "route":
+		return ""
+	case strings.HasPrefix(l.key, "header:"):
+		return r.Header.Get(strings.TrimPrefix(l.key, "header:"))
+	}
+	return clientIP(r)
+}
+
+// allow takes a token from the bucket of the request. If the bucket
+// is empty, it returns false and the time until the next token.
+func (l *limiter) allow(r *http.Request) (bool, time.Duration) {
+	if l.rate <= 0 {
+		return true, 0
+	}
+	key := l.bucketKey(r)
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sweep(now)
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// sweep removes the buckets which are full again, at most once a minute.
+func (l *limiter) sweep(now time.Time) {
+	if now.Sub(l.swept) < time.Minute {
+		return
+	}
+	l.swept = now
+	full := time.Duration(l.burst / l.rate * float64(time.Second))
+	for k, b := range l.buckets {
+		if now.Sub(b.last) > full {
+			delete(l.buckets, k)
+		}
+	}
+}
+
+// acquire counts a connection of the client of the request. It
+// reports false if the client has too many concurrent connections;
+// otherwise the connection must be released.
+func (l *limiter) acquire(r *http.Request, websocket bool) bool {
+	ip := clientIP(r)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.maxConns > 0 && l.conns[ip] >= l.maxConns {
+		return false
+	}
+	if websocket && l.maxWebsockets > 0 && l.websockets[ip] >= l.maxWebsockets {
+		return false
+	}
+	l.conns[ip]++
+	if websocket {
+		l.websockets[ip]++
+	}
+	return true
+}
+
+// release releases a connection acquired for the request.
+func (l *limiter) release(r *http.Request, websocket bool) {
+	ip := clientIP(r)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.conns[ip]--; l.conns[ip] <= 0 {
+		delete(l.conns, ip)
+	}
+	if websocket {
+		if l.websockets[ip]--; l.websockets[ip] <= 0 {
+			delete(l.websockets, ip)
+		}
+	}
+}
+
+// limit applies the limits to the request. It reports false after
+// answering with 429; otherwise the returned function releases the
+// connection of the request.
+func (l *limiter) limit(w http.ResponseWriter, r *http.Request) (func(), bool) {
+	if ok, wait := l.allow(r); !ok {
+		tooManyRequests(w, wait)
+		return nil, false
+	}
+	ws := isWebsocket(r)
+	if !l.acquire(r, ws) {
+		tooManyRequests(w, time.Second)
+		return nil, false
+	}
+	return func() { l.release(r, ws) }, true
+}
+
+// tooManyRequests answers with 429 and a Retry-After header.
+func tooManyRequests(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+}
+
+// limiterState is the state of a limiter shown by the admin API.
+type limiterState struct {
+	Rate          float64            `json:"rate"`
+	Burst         float64            `json:"burst"`
+	Key           string             `json:"key"`
+	MaxConns      int                `json:"maxConns"`
+	MaxWebsockets int                `json:"maxWebsockets"`
+	Tokens        map[string]float64 `json:"tokens"`
+	Conns         map[string]int     `json:"conns"`
+	Websockets    map[string]int     `json:"websockets"`
+}
+
+// state returns a snapshot of the limiter.
+func (l *limiter) state() limiterState {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	s := limiterState{
+		Rate:          l.rate,
+		Burst:         l.burst,
+		Key:           l.key,
+		MaxConns:      l.maxConns,
+		MaxWebsockets: l.maxWebsockets,
+		Tokens:        make(map[string]float64),
+		Conns:         make(map[string]int),
+		Websockets:    make(map[string]int),
+	}
+	for k, b := range l.buckets {
+		s.Tokens[k] = min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	}
+	for k, n := range l.conns {
+		s.Conns[k] = n
+	}
+	for k, n := range l.websockets {
+		s.Websockets[k] = n
+	}
+	return s
+}
@@ -0,0 +1,72 @@
+// Copyright (c) 2014 David R. Jenni. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRateLimit(t *testing.T) {
+	l, err := newLimiter(1, 2, "header:X-Api-Key", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("X-Api-Key", "a")
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.allow(r); !ok {
+			t.Errorf("%d: expected request within the burst to pass", i)
+		}
+	}
+	if ok, wait := l.allow(r); ok || wait <= 0 {
+		t.Errorf("Expected rejection with a wait, got %v %v", ok, wait)
+	}
+	r.Header.Set("X-Api-Key", "b")
+	if ok, _ := l.allow(r); !ok {
+		t.Errorf("Expected a separate bucket per key")
+	}
+
+	w := httptest.NewRecorder()
+	r.Header.Set("X-Api-Key", "a")
+	if _, ok := l.limit(w, r); ok {
+		t.Fatalf("Expected the request to be limited")
+	}
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "1" {
+		t.Errorf("Expected 429 with Retry-After 1, got %d %q", w.Code, w.Header().Get("Retry-After"))
+	}
+}
+
+func TestConnLimit(t *testing.T) {
+	l, err := newLimiter(0, 0, "", 2, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("GET", "/", nil)
+	if !l.acquire(r, true) {
+		t.Errorf("Expected the first websocket to pass")
+	}
+	if l.acquire(r, true) {
+		t.Errorf("Expected the second websocket to be limited")
+	}
+	if !l.acquire(r, false) {
+		t.Errorf("Expected a request next to the websocket to pass")
+	}
+	if l.acquire(r, false) {
+		t.Errorf("Expected the third connection to be limited")
+	}
+	l.release(r, true)
+	if !l.acquire(r, true) {
+		t.Errorf("Expected a websocket after the release to pass")
+	}
+	if s := l.state(); s.Conns["192.0.2.1"] != 2 || s.Websockets["192.0.2.1"] != 1 {
+		t.Errorf("Expected 2 conns and 1 websocket, got %v %v", s.Conns, s.Websockets)
+	}
+
+	if _, err := newLimiter(1, 0, "cookie", 0, 0); err == nil {
+		t.Errorf("Expected an error for an unknown key")
+	}
+}
@@ -0,0 +1,144 @@
+// Copyright (c) 2014 David R. Jenni. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"reflect"
+	"syscall"
+)
+
+// table holds the routes and upstreams of the proxy.
+// A reload replaces it as a whole.
+type table struct {
+	upstreams map[string]*upstream
+	routes    []*route
+	streams   map[string]*stream // by listener
+
+	access     []*accessRule      // checked before the routes
+	errorPages map[int]*errorPage // by status
+}
+
+// current returns the current table of the proxy.
+func (p *reverseProxy) current() *table {
+	return p.table.Load()
+}
+
+// newTable returns the table described by c. Upstreams of old whose
+// configuration is unchanged are kept with their state.
+func newTable(c *config, old map[string]*upstream) (*table, error) {
+	t := &table{upstreams: make(map[string]*upstream), streams: make(map[string]*stream)}
+	var err error
+	if t.access, err = newAccessRules(c.Access); err != nil {
+		return nil, err
+	}
+	if t.errorPages, err = loadErrorPages(c.ErrorPages); err != nil {
+		return nil, err
+	}
+	for name, uc := range c.Upstreams {
+		if u, ok := old[name]; ok && reflect.DeepEqual(u.config, uc) {
+			t.upstreams[name] = u
+			continue
+		}
+		u, err := newUpstreamFromConfig(name, uc)
+		if err != nil {
+			return nil, fmt.Errorf("upstream %s: %v", name, err)
+		}
+		t.upstreams[name] = u
+	}
+	for _, rc := range c.Routes {
+		rt, err := newRoute(rc, t.upstreams)
+		if err != nil {
+			return nil, err
+		}
+		t.routes = append(t.routes, rt)
+	}
+	for _, sc := range c.Streams {
+		s, err := newStream(sc, t.upstreams)
+		if err != nil {
+			return nil, err
+		}
+		if t.streams[s.key()] != nil {
+			return nil, fmt.Errorf("stream %s: duplicate listener", s.listen)
+		}
+		t.streams[s.key()] = s
+	}
+	return t, nil
+}
+
+// checkRoutes checks that the routes of the table
+// can be served by the proxy.
+func (p *reverseProxy) checkRoutes(t *table) error {
+	for _, rt := range t.routes {
+		if rt.cache && p.cache == nil {
+			return fmt.Errorf("route %s: caching needs -cache", rt.name)
+		}
+		if rt.inspection != nil && rt.inspection.tee && p.wsTee == nil {
+			return fmt.Errorf("route %s: the websocket tee needs -ws-tee", rt.name)
+		}
+	}
+	return nil
+}
+
+// reload replaces the routes, streams and upstreams by those described
+// by c. Requests in flight complete with the old ones; replaced upstreams
+// stop their health checks. The listeners of the streams stay open; new
+// connections to a removed stream are closed.
+func (p *reverseProxy) reload(c *config) error {
+	old := p.current()
+	t, err := newTable(c, old.upstreams)
+	if err != nil {
+		return err
+	}
+	if err := p.checkRoutes(t); err != nil {
+		return err
+	}
+	for name, u := range t.upstreams {
+		if old.upstreams[name] != u && u.health != nil {
+			go u.checkHealth()
+		}
+	}
+	p.table.Store(t)
+	for key := range t.streams {
+		if old.streams[key] == nil {
+			log.Printf("Stream %s is opened by a restart only", key)
+		}
+	}
+	for name, u := range old.upstreams {
+		if t.upstreams[name] != u {
+			u.close()
+		}
+	}
+	return nil
+}
+
+// reloadOnHangup reloads the configuration file on every SIGHUP
+// received after it returns.
+func (p *reverseProxy) reloadOnHangup(file string) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := p.reloadFile(file); err != nil {
+				log.Printf("Error reloading %s: %v", file, err)
+				continue
+			}
+			log.Printf("Reloaded %s", file)
+		}
+	}()
+}
+
+// reloadFile reloads the configuration file. If it is invalid,
+// the current configuration is kept.
+func (p *reverseProxy) reloadFile(file string) error {
+	c, err := readConfig(file)
+	if err != nil {
+		return err
+	}
+	return p.reload(c)
+}
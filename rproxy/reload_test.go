@@ -0,0 +1,159 @@
+// Copyright (c) 2014 David R. Jenni. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestReload(t *testing.T) {
+	p := testProxy(t, &routeConfig{Prefix: "/a/", Upstream: "a"})
+	old := p.current()
+
+	c := &config{
+		Upstreams: map[string]*upstreamConfig{
+			"a": {Targets: []targetConfig{{URL: "http://a"}}},
+			"b": {Targets: []targetConfig{{URL: "http://c"}}},
+		},
+		Routes: []*routeConfig{{Prefix: "/b/", Upstream: "b"}},
+	}
+	if err := p.reload(c); err != nil {
+		t.Fatal(err)
+	}
+	cur := p.current()
+	if cur.upstreams["a"] != old.upstreams["a"] {
+		t.Errorf("Expected the unchanged upstream to be kept")
+	}
+	if cur.upstreams["b"] == old.upstreams["b"] {
+		t.Errorf("Expected the changed upstream to be replaced")
+	}
+	select {
+	case <-old.upstreams["b"].stop:
+	default:
+		t.Errorf("Expected the replaced upstream to be closed")
+	}
+	if rt := p.match(httptest.NewRequest("GET", "/b/x", nil)); rt == nil || rt.upstream.name != "b" {
+		t.Errorf("Expected the new route to match")
+	}
+	if rt := p.match(httptest.NewRequest("GET", "/a/x", nil)); rt != nil {
+		t.Errorf("Expected the old route to be gone")
+	}
+
+	c.Routes = []*routeConfig{{Upstream: "x"}}
+	if err := p.reload(c); err == nil {
+		t.Errorf("Expected an error for an unknown upstream")
+	}
+	if p.current() != cur {
+		t.Errorf("Expected a failed reload to keep the table")
+	}
+}
+
+func TestReloadFile(t *testing.T) {
+	p := testProxy(t, &routeConfig{Prefix: "/a/", Upstream: "a"})
+	name := filepath.Join(t.TempDir(), "rproxy.json")
+	write := func(s string) {
+		t.Helper()
+		if err := os.WriteFile(name, []byte(s), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(`{
+		"upstreams": {"b": {"targets": [{"url": "http://b"}], "transport": {"dialTimeout": "2s"}}},
+		"routes": [{"prefix": "/b/", "upstream": "b"}]
+	}`)
+	old := p.current()
+	p.reloadOnHangup(name)
+	if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); p.current() == old; time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the configuration to be reloaded on SIGHUP")
+		}
+	}
+	cur := p.current()
+	if rt := p.match(httptest.NewRequest("GET", "/b/x", nil)); rt == nil || rt.upstream.name != "b" {
+		t.Errorf("Expected the route of the file to match")
+	}
+	if d := cur.upstreams["b"].config.Transport.DialTimeout; d != duration(2*time.Second) {
+		t.Errorf("Expected a dial timeout of 2s, got %v", time.Duration(d))
+	}
+
+	for _, s := range []string{
+		`{"routes": [{"upstream": "b"}`,
+		`{"upstreams": {"b": {"targets": [{"url": "http://b"}], "transport": {"dialTimeout": "2 parsecs"}}}}`,
+		`{"upstreams": {"b": {"targets": [{"url": "http://b"}]}}, "routes": [{"upstream": "x"}]}`,
+	} {
+		write(s)
+		if err := p.reloadFile(name); err == nil {
+			t.Errorf("%s: expected an error", s)
+		}
+		if p.current() != cur {
+			t.Errorf("%s: expected the table to be kept", s)
+		}
+	}
+	if err := p.reloadFile(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Errorf("Expected an error for a missing file")
+	}
+}
+
+func TestCloseWebsockets(t *testing.T) {
+	received := make(chan []byte, 1)
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, brw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		brw.WriteString(switchProtocols(r))
+		brw.Flush()
+		b, _ := io.ReadAll(brw)
+		received <- b
+	})
+	p := newTestProxy(t, h, &config{})
+	front := httptest.NewServer(p)
+	defer front.Close()
+
+	conn, br := dialWebsocket(t, front.Listener.Addr().String())
+	defer conn.Close()
+	for i := 0; ; i++ {
+		p.mu.Lock()
+		n := len(p.websockets)
+		p.mu.Unlock()
+		if n == 1 {
+			break
+		}
+		if i == 100 {
+			t.Fatal("Expected an active websocket")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	p.closeWebsockets(ctx)
+
+	b, _ := io.ReadAll(br)
+	if want := []byte{0x88, 0x02, 0x03, 0xe9}; !bytes.Equal(b, want) {
+		t.Errorf("Expected close frame %x to the client, got %x", want, b)
+	}
+	b = <-received
+	if len(b) != 8 || b[0] != 0x88 || b[1] != 0x82 {
+		t.Fatalf("Expected a masked close frame to the backend, got %x", b)
+	}
+	if code := uint16(b[6]^b[2])<<8 | uint16(b[7]^b[3]); code != closeGoingAway {
+		t.Errorf("Expected status %d, got %d", closeGoingAway, code)
+	}
+}
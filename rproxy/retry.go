@@ -0,0 +1,151 @@
+// Copyright (c) 2014 David R. Jenni. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Defaults of the retries.
+const (
+	defaultRetryBackoff    = 100 * time.Millisecond
+	defaultRetryMaxBackoff = 2 * time.Second
+	defaultRetryMaxBody    = 64 << 10
+)
+
+// retryPolicy configures the retries of an upstream.
+type retryPolicy struct {
+	retries    int           // retries after the first attempt, 0 disables them
+	statuses   []int         // retried status codes
+	backoff    time.Duration // backoff before the first retry, doubled for every retry
+	maxBackoff time.Duration
+	maxBody    int64 // largest request body buffered for replays
+}
+
+// idempotent reports whether the request may be sent more than once.
+func idempotent(r *http.Request) bool {
+	switch r.Method {
+	case "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+		return true
+	}
+	return r.Header.Get("Idempotency-Key") != "" || r.Header.Get("X-Idempotency-Key") != ""
+}
+
+// retryable reports whether a failed attempt may be retried.
+func (rp *retryPolicy) retryable(resp *http.Response, err error) bool {
+	if err != nil {
+		return !errors.Is(err, context.Canceled)
+	}
+	return slices.Contains(rp.statuses, resp.StatusCode)
+}
+
+// delay returns the jittered backoff before the given retry.
+func (rp *retryPolicy) delay(retry int) time.Duration {
+	d := rp.backoff << (retry - 1)
+	if d <= 0 || d > rp.maxBackoff {
+		d = rp.maxBackoff
+	}
+	return rand.N(d) + 1
+}
+
+// bufferBody reads the body of the request into memory so that it
+// can be replayed. It reports false if the body is larger than max,
+// in which case the request is left intact but must not be replayed.
+func bufferBody(r *http.Request, max int64) ([]byte, bool, error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, true, nil
+	}
+	if r.ContentLength > max {
+		return nil, false, nil
+	}
+	b, err := io.ReadAll(io.LimitReader(r.Body, max+1))
+	if err != nil {
+		return nil, false, err
+	}
+	if int64(len(b)) > max {
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(b), r.Body), r.Body}
+		return nil, false, nil
+	}
+	r.Body.Close()
+	return b, true, nil
+}
+
+// roundTrip sends the request with the transport of the upstream,
+// retrying it on other backends according to the retry policy.
+func (u *upstream) roundTrip(r *http.Request, st *proxyState) (*http.Response, error) {
+	retryable := u.retry.retries > 0 && idempotent(r)
+	var body []byte
+	if retryable {
+		var err error
+		if body, retryable, err = bufferBody(r, u.retry.maxBody); err != nil {
+			return nil, err
+		}
+	}
+	target := r.URL
+	for attempt := 0; ; attempt++ {
+		req := r
+		if retryable {
+			req = new(http.Request)
+			*req = *r
+			req.URL = target
+			if body != nil {
+				req.Body = io.NopCloser(bytes.NewReader(body))
+			}
+		}
+		start := time.Now()
+		resp, err := u.transport.RoundTrip(req)
+		st.ttfb = time.Since(start)
+		if req.Context().Err() == nil {
+			// A client which went away tells nothing about the backend.
+			ok := err == nil && !targetFailed(resp.StatusCode)
+			u.report(st.backend, ok)
+			u.breaker.record(ok)
+		}
+		if !retryable || attempt >= u.retry.retries || !u.retry.retryable(resp, err) {
+			return resp, err
+		}
+		if resp != nil {
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 4<<10))
+			resp.Body.Close()
+		}
+		select {
+		case <-time.After(u.retry.delay(attempt + 1)):
+		case <-r.Context().Done():
+			return nil, r.Context().Err()
+		}
+		if b := u.pick(r); b != nil && b != st.backend {
+			target = retarget(target, st.backend, b)
+			st.backend.conns.Add(-1)
+			b.conns.Add(1)
+			st.backend = b
+		}
+	}
+}
+
+// retarget returns the URL of a request to backend from,
+// directed to backend to instead.
+func retarget(u *url.URL, from, to *backend) *url.URL {
+	t := *u
+	t.Scheme = to.url.Scheme
+	t.Host = to.url.Host
+	if from.url.Path != to.url.Path {
+		p := strings.TrimPrefix(u.Path, strings.TrimSuffix(from.url.Path, "/"))
+		t.Path = strings.TrimSuffix(to.url.Path, "/") + p
+		t.RawPath = ""
+	}
+	return &t
+}
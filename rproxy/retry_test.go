@@ -0,0 +1,106 @@
+// Copyright (c) 2014 David R. Jenni. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRetry(t *testing.T) {
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+	ok := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(w, r.Body)
+	}))
+	defer ok.Close()
+	c := &config{
+		Upstreams: map[string]*upstreamConfig{"a": {
+			Targets: []targetConfig{{URL: failing.URL}, {URL: ok.URL}},
+			Retry:   &retryConfig{Retries: 1, Backoff: duration(time.Millisecond)},
+		}},
+		Routes: []*routeConfig{{Upstream: "a"}},
+	}
+	p, err := newReverseProxy(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		r := httptest.NewRequest("PUT", "/", strings.NewReader("body"))
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, r)
+		if w.Code != http.StatusOK || w.Body.String() != "body" {
+			t.Errorf("%d: expected 200 body, got %d %q", i, w.Code, w.Body.String())
+		}
+	}
+
+	r := httptest.NewRequest("POST", "/", strings.NewReader("body"))
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, r) // the round-robin picks the failing target
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected POST not to be retried, got %d", w.Code)
+	}
+}
+
+func TestBreaker(t *testing.T) {
+	b := &breaker{failures: 2, openTime: time.Hour}
+
+	b.record(false)
+	if !b.allow() {
+		t.Errorf("Expected a closed breaker after one failure")
+	}
+	b.record(false)
+	if b.allow() {
+		t.Errorf("Expected an open breaker after two failures")
+	}
+
+	b.until = time.Now()
+	if !b.allow() {
+		t.Errorf("Expected a trial request")
+	}
+	if b.allow() {
+		t.Errorf("Expected a single trial request")
+	}
+	b.record(true)
+	if b.state != breakerClosed || !b.allow() {
+		t.Errorf("Expected a closed breaker after a successful trial, got %v", b.state)
+	}
+}
+
+func TestBreakerStatuses(t *testing.T) {
+	p := newTestProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/error":
+			w.WriteHeader(http.StatusInternalServerError)
+		case "/unavailable":
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}), &config{Upstreams: map[string]*upstreamConfig{"a": {Breaker: &breakerConfig{Failures: 2, Open: duration(time.Hour)}}}})
+	get := func(path string) int {
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w.Code
+	}
+
+	// Errors of the application do not open the breaker.
+	for i := 0; i < 5; i++ {
+		get("/error")
+	}
+	if code := get("/"); code != http.StatusOK {
+		t.Errorf("Expected a closed breaker after 500s, got %d", code)
+	}
+	get("/unavailable")
+	get("/unavailable")
+	if code := get("/"); code != http.StatusServiceUnavailable {
+		t.Errorf("Expected an open breaker after 503s, got %d", code)
+	}
+}
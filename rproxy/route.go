@@ -0,0 +1,117 @@
+// Copyright (c) 2014 David R. Jenni. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net"
+	"net/http"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// route sends the matching requests to an upstream.
+type route struct {
+	name     string
+	host     string
+	prefix   string
+	regex    *regexp.Regexp
+	methods  []string
+	headers  map[string]string
+	upstream *upstream // nil if the requests are split
+	split    []*split
+	affinity string // ip, cookie:Name or "" for none
+
+	stripPrefix bool
+	rewrite     string
+	clientCert  bool
+	cache       bool
+	cacheID     string        // separates the cached responses of the routes
+	limiter     *limiter      // nil disables the limits
+	auth        authenticator // nil lets all clients pass
+	mirror      *mirror       // nil disables the mirroring
+	faults      []*fault
+	inspection  *wsInspection // nil splices websockets uninspected
+	access      []*accessRule
+	maxBody     int64 // largest request body, 0 for no limit
+
+	requestHeaders  headerRules
+	responseHeaders headerRules
+}
+
+// match reports whether the request matches the route. The path
+// of the request is clean, as ServeHTTP redirects the others.
+func (rt *route) match(r *http.Request) bool {
+	if rt.host != "" && !matchHost(rt.host, r.Host) {
+		return false
+	}
+	if !strings.HasPrefix(r.URL.Path, rt.prefix) {
+		return false
+	}
+	if rt.regex != nil && !rt.regex.MatchString(r.URL.Path) {
+		return false
+	}
+	if len(rt.methods) != 0 && !slices.Contains(rt.methods, r.Method) {
+		return false
+	}
+	for k, v := range rt.headers {
+		if r.Header.Get(k) != v {
+			return false
+		}
+	}
+	return true
+}
+
+// rewritePath returns a shallow copy of the request with the
+// path rewritten by the route, or the request itself if the
+// route does not rewrite paths.
+func (rt *route) rewritePath(r *http.Request) *http.Request {
+	if !rt.stripPrefix && rt.rewrite == "" {
+		return r
+	}
+	p := r.URL.Path
+	switch {
+	case rt.rewrite != "":
+		p = rt.regex.ReplaceAllString(p, rt.rewrite)
+	case rt.stripPrefix:
+		p = strings.TrimPrefix(p, rt.prefix)
+	}
+	if !strings.HasPrefix(p, "/") {
+		p = "/" + p
+	}
+	r2 := new(http.Request)
+	*r2 = *r
+	u := *r.URL
+	u.Path = p
+	u.RawPath = ""
+	r2.URL = &u
+	return r2
+}
+
+// cleanPath returns the canonical form of a request path without "."
+// and ".." elements or repeated slashes. A trailing slash is kept.
+func cleanPath(p string) string {
+	if !strings.HasPrefix(p, "/") {
+		return p // such as "*" of OPTIONS
+	}
+	np := path.Clean(p)
+	if strings.HasSuffix(p, "/") && np != "/" {
+		np += "/"
+	}
+	return np
+}
+
+// matchHost reports whether the host of a request matches the
+// pattern, which is a host name or "*." followed by a domain.
+func matchHost(pattern, host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if strings.HasPrefix(pattern, "*.") {
+		return len(host) > len(pattern)-1 && strings.EqualFold(host[len(host)-len(pattern)+1:], pattern[1:])
+	}
+	return strings.EqualFold(host, pattern)
+}
@@ -0,0 +1,144 @@
+// Copyright (c) 2014 David R. Jenni. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func testProxy(t *testing.T, routes ...*routeConfig) *reverseProxy {
+	c := &config{
+		Upstreams: map[string]*upstreamConfig{
+			"a": {Targets: []targetConfig{{URL: "http://a"}}},
+			"b": {Targets: []targetConfig{{URL: "http://b"}}},
+		},
+		Routes: routes,
+	}
+	p, err := newReverseProxy(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestMatch(t *testing.T) {
+	p := testProxy(t,
+		&routeConfig{Host: "*.example.com", Upstream: "a"},
+		&routeConfig{Prefix: "/api/", Methods: []string{"POST"}, Upstream: "a"},
+		&routeConfig{Regex: "^/v[0-9]+/", Headers: map[string]string{"X-Beta": "1"}, Upstream: "a"},
+		&routeConfig{Upstream: "b"},
+	)
+
+	tests := []struct {
+		method, url string
+		header      string
+		want        string
+	}{
+		{"GET", "http://www.example.com/", "", "a"},
+		{"GET", "http://www.example.com:8080/", "", "a"},
+		{"GET", "http://example.com/", "", "b"},
+		{"POST", "http://x/api/users", "", "a"},
+		{"GET", "http://x/api/users", "", "b"},
+		{"GET", "http://x/v2/users", "1", "a"},
+		{"GET", "http://x/v2/users", "", "b"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, tt.url, nil)
+		if tt.header != "" {
+			r.Header.Set("X-Beta", tt.header)
+		}
+		rt := p.match(r)
+		if rt == nil {
+			t.Errorf("%s %s: expected a route", tt.method, tt.url)
+			continue
+		}
+		if rt.name != tt.want {
+			t.Errorf("%s %s: expected %s, got %s", tt.method, tt.url, tt.want, rt.name)
+		}
+	}
+}
+
+func TestNoMatch(t *testing.T) {
+	p := testProxy(t, &routeConfig{Prefix: "/api/", Upstream: "a"})
+
+	if rt := p.match(httptest.NewRequest("GET", "/web/", nil)); rt != nil {
+		t.Errorf("Expected no route, got %s", rt.name)
+	}
+}
+
+func TestCleanPath(t *testing.T) {
+	tests := []struct {
+		path, want string
+	}{
+		{"/", "/"},
+		{"/api/users", "/api/users"},
+		{"/api/users/", "/api/users/"},
+		{"/api/../internal/x", "/internal/x"},
+		{"/api/..", "/"},
+		{"/api/./users//x/", "/api/users/x/"},
+		{"//internal", "/internal"},
+		{"*", "*"},
+	}
+	for _, tt := range tests {
+		if got := cleanPath(tt.path); got != tt.want {
+			t.Errorf("%s: expected %s, got %s", tt.path, tt.want, got)
+		}
+	}
+}
+
+func TestMatchUncleanPath(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.URL.Path)
+	})
+	p := newTestProxy(t, h, &config{Routes: []*routeConfig{
+		{Prefix: "/api/", StripPrefix: true, Upstream: "a"},
+		{Prefix: "/internal/", Upstream: "a"},
+	}})
+
+	// The /api/ route neither matches nor rewrites the path.
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", "/api/../internal/x", nil))
+	if loc := w.Header().Get("Location"); w.Code != http.StatusPermanentRedirect || loc != "/internal/x" {
+		t.Errorf("Expected a redirect to /internal/x, got %d %q", w.Code, loc)
+	}
+	w = httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", "/internal/x", nil))
+	if w.Body.String() != "/internal/x" {
+		t.Errorf("Expected /internal/x at the target, got %q", w.Body.String())
+	}
+}
+
+func TestRewritePath(t *testing.T) {
+	p := testProxy(t,
+		&routeConfig{Prefix: "/api", StripPrefix: true, Upstream: "a"},
+		&routeConfig{Regex: "^/v1/(.*)$", Rewrite: "/v2/$1", Upstream: "b"},
+	)
+
+	tests := []struct{ path, want string }{
+		{"/api/users", "/users"},
+		{"/api", "/"},
+		{"/v1/users", "/v2/users"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", tt.path, nil)
+		r2 := p.match(r).rewritePath(r)
+		if r2.URL.Path != tt.want {
+			t.Errorf("%s: expected %s, got %s", tt.path, tt.want, r2.URL.Path)
+		}
+		if r.URL.Path != tt.path {
+			t.Errorf("%s: original request modified", tt.path)
+		}
+	}
+}
+
+func TestUnknownUpstream(t *testing.T) {
+	c := &config{Routes: []*routeConfig{{Upstream: "x"}}}
+	if _, err := newReverseProxy(c); err == nil {
+		t.Errorf("Expected an error for an unknown upstream")
+	}
+}
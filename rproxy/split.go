@@ -0,0 +1,126 @@
+// Copyright (c) 2014 David R. Jenni. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"hash/fnv"
+	mathrand "math/rand/v2"
+	"net/http"
+	"strings"
+)
+
+// split sends a share of the requests of a route to an upstream.
+type split struct {
+	upstream *upstream
+	weight   int
+	headers  map[string]string // header values which ask for the upstream
+	cookies  map[string]string // cookie values which ask for the upstream
+}
+
+// newSplits returns the splits described by cs.
+func newSplits(cs []*splitConfig, upstreams map[string]*upstream) ([]*split, error) {
+	var ss []*split
+	total := 0
+	for _, c := range cs {
+		u, ok := upstreams[c.Upstream]
+		if !ok {
+			return nil, fmt.Errorf("unknown split upstream %q", c.Upstream)
+		}
+		if c.Weight < 0 {
+			return nil, fmt.Errorf("split %s: negative weight", c.Upstream)
+		}
+		total += c.Weight
+		ss = append(ss, &split{upstream: u, weight: c.Weight, headers: c.Headers, cookies: c.Cookies})
+	}
+	if total == 0 {
+		return nil, fmt.Errorf("split without weight")
+	}
+	return ss, nil
+}
+
+// overrides reports whether the request asks for the upstream
+// of the split with one of its header or cookie values.
+func (s *split) overrides(r *http.Request) bool {
+	for k, v := range s.headers {
+		if r.Header.Get(k) == v {
+			return true
+		}
+	}
+	for k, v := range s.cookies {
+		if c, err := r.Cookie(k); err == nil && c.Value == v {
+			return true
+		}
+	}
+	return false
+}
+
+// checkAffinity checks an affinity key: ip or cookie:Name.
+func checkAffinity(key string) error {
+	if key == "" || key == "ip" {
+		return nil
+	}
+	if name, ok := strings.CutPrefix(key, "cookie:"); ok && name != "" {
+		return nil
+	}
+	return fmt.Errorf("unknown affinity %q", key)
+}
+
+// choose returns the upstream for the request and its affinity key,
+// or "" without affinity. A client without an affinity cookie gets one.
+func (rt *route) choose(w http.ResponseWriter, r *http.Request) (*upstream, string) {
+	key := rt.affinityKey(w, r)
+	if rt.split == nil {
+		return rt.upstream, key
+	}
+	for _, s := range rt.split {
+		if s.overrides(r) {
+			return s.upstream, key
+		}
+	}
+	// The same key keeps its upstream while the weights are unchanged.
+	x := mathrand.Float64()
+	if key != "" {
+		x = hashUnit(key)
+	}
+	total := 0
+	for _, s := range rt.split {
+		total += s.weight
+	}
+	n := x * float64(total)
+	for _, s := range rt.split {
+		if n < float64(s.weight) {
+			return s.upstream, key
+		}
+		n -= float64(s.weight)
+	}
+	return rt.split[len(rt.split)-1].upstream, key // rounding
+}
+
+// affinityKey returns the affinity key of the request: the client
+// IP or the value of the affinity cookie, which is set if missing.
+func (rt *route) affinityKey(w http.ResponseWriter, r *http.Request) string {
+	if rt.affinity == "ip" {
+		return clientIP(r)
+	}
+	name, ok := strings.CutPrefix(rt.affinity, "cookie:")
+	if !ok {
+		return ""
+	}
+	if c, err := r.Cookie(name); err == nil && c.Value != "" {
+		return c.Value
+	}
+	v := rand.Text()
+	http.SetCookie(w, &http.Cookie{Name: name, Value: v, Path: "/", HttpOnly: true, SameSite: http.SameSiteLaxMode})
+	return v
+}
+
+// hashUnit maps the key to [0, 1).
+func hashUnit(key string) float64 {
+	f := fnv.New64a()
+	f.Write([]byte(key))
+	return float64(f.Sum64()>>11) / (1 << 53)
+}
@@ -0,0 +1,211 @@
+// Copyright (c) 2014 David R. Jenni. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// namedTarget returns the URL of a target which answers with its
+// name, also after a websocket handshake.
+func namedTarget(t *testing.T, name string) string {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isWebsocket(r) {
+			io.WriteString(w, name)
+			return
+		}
+		conn, brw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		brw.WriteString(switchProtocols(r) + name + "\n")
+		brw.Flush()
+	}))
+	t.Cleanup(ts.Close)
+	return ts.URL
+}
+
+// splitProxy returns a proxy which sends 10% of the requests
+// to the canary target c and the others to the targets a and b.
+func splitProxy(t *testing.T, affinity string) *reverseProxy {
+	return newTestProxy(t, nil, &config{
+		Upstreams: map[string]*upstreamConfig{
+			"stable": {Targets: []targetConfig{{URL: namedTarget(t, "a")}, {URL: namedTarget(t, "b")}}},
+			"canary": {Targets: []targetConfig{{URL: namedTarget(t, "c")}}},
+		},
+		Routes: []*routeConfig{{
+			Split: []*splitConfig{
+				{Upstream: "stable", Weight: 90},
+				{Upstream: "canary", Weight: 10, Headers: map[string]string{"X-Canary": "1"}, Cookies: map[string]string{"canary": "1"}},
+			},
+			Affinity: affinity,
+		}},
+	})
+}
+
+func TestSplit(t *testing.T) {
+	p := splitProxy(t, "")
+	counts := make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		counts[w.Body.String()]++
+	}
+	if counts["c"] < 50 || counts["c"] > 150 {
+		t.Errorf("Expected about 100 requests to the canary, got %v", counts)
+	}
+
+	header := httptest.NewRequest("GET", "/", nil)
+	header.Header.Set("X-Canary", "1")
+	cookie := httptest.NewRequest("GET", "/", nil)
+	cookie.AddCookie(&http.Cookie{Name: "canary", Value: "1"})
+	for _, r := range []*http.Request{header, cookie} {
+		for i := 0; i < 20; i++ {
+			w := httptest.NewRecorder()
+			p.ServeHTTP(w, r)
+			if w.Body.String() != "c" {
+				t.Fatalf("Expected the override to reach the canary, got %q", w.Body.String())
+			}
+		}
+	}
+}
+
+func TestAffinityIP(t *testing.T) {
+	p := splitProxy(t, "ip")
+	seen := make(map[string]bool)
+	for i := 0; i < 50; i++ {
+		addr := fmt.Sprintf("10.0.0.%d:1234", i)
+		var first string
+		for j := 0; j < 10; j++ {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = addr
+			w := httptest.NewRecorder()
+			p.ServeHTTP(w, r)
+			if j == 0 {
+				first = w.Body.String()
+			} else if w.Body.String() != first {
+				t.Fatalf("%s: expected %q, got %q", addr, first, w.Body.String())
+			}
+		}
+		seen[first] = true
+	}
+	if !seen["a"] || !seen["b"] {
+		t.Errorf("Expected the clients to be spread over a and b, got %v", seen)
+	}
+}
+
+func TestAffinityCookie(t *testing.T) {
+	p := splitProxy(t, "cookie:backend")
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != "backend" || cookies[0].Value == "" {
+		t.Fatalf("Expected an affinity cookie, got %v", cookies)
+	}
+	first := w.Body.String()
+	for i := 0; i < 20; i++ {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.AddCookie(cookies[0])
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, r)
+		if w.Body.String() != first {
+			t.Fatalf("Expected %q, got %q", first, w.Body.String())
+		}
+		if c := w.Header().Get("Set-Cookie"); c != "" {
+			t.Errorf("Expected no new cookie, got %q", c)
+		}
+	}
+}
+
+func TestAffinityDenied(t *testing.T) {
+	p := newTestProxy(t, nil, &config{
+		Upstreams: map[string]*upstreamConfig{"a": {Targets: []targetConfig{{URL: namedTarget(t, "a")}}}},
+		Routes: []*routeConfig{
+			{Prefix: "/cert/", Upstream: "a", ClientCert: true, Affinity: "cookie:backend"},
+			{Upstream: "a", Affinity: "cookie:backend", Access: []*accessRuleConfig{{Action: "deny", Path: "^/private"}}},
+		},
+	})
+	for _, path := range []string{"/cert/", "/private"} {
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != http.StatusForbidden {
+			t.Errorf("%s: expected 403, got %d", path, w.Code)
+		}
+		if c := w.Header().Get("Set-Cookie"); c != "" {
+			t.Errorf("%s: expected no affinity cookie, got %q", path, c)
+		}
+	}
+}
+
+func TestAffinityWebsocket(t *testing.T) {
+	front := httptest.NewServer(splitProxy(t, "cookie:backend"))
+	defer front.Close()
+
+	// handshake returns the target and the affinity cookie.
+	handshake := func(cookie string) (string, string) {
+		conn, err := net.Dial("tcp", front.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		req := "GET /ws HTTP/1.1\r\nHost: front.example\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Key: " + testWSKey + "\r\n"
+		if cookie != "" {
+			req += "Cookie: backend=" + cookie + "\r\n"
+		}
+		io.WriteString(conn, req+"\r\n")
+		br := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusSwitchingProtocols {
+			t.Fatalf("Expected 101, got %d", resp.StatusCode)
+		}
+		name, _ := br.ReadString('\n')
+		for _, c := range resp.Cookies() {
+			if c.Name == "backend" {
+				cookie = c.Value
+			}
+		}
+		return strings.TrimSpace(name), cookie
+	}
+
+	first, cookie := handshake("")
+	if cookie == "" {
+		t.Fatal("Expected an affinity cookie with the handshake")
+	}
+	for i := 0; i < 10; i++ {
+		if name, _ := handshake(cookie); name != first {
+			t.Fatalf("Expected the reconnect to reach %q, got %q", first, name)
+		}
+	}
+}
+
+func TestSplitConfig(t *testing.T) {
+	upstreams := map[string]*upstreamConfig{"a": {Targets: []targetConfig{{URL: "http://a"}}}}
+	tests := []struct {
+		route *routeConfig
+		err   string
+	}{
+		{&routeConfig{Upstream: "a", Split: []*splitConfig{{Upstream: "a", Weight: 1}}}, "upstream and split"},
+		{&routeConfig{Split: []*splitConfig{{Upstream: "x", Weight: 1}}}, "unknown split upstream"},
+		{&routeConfig{Split: []*splitConfig{{Upstream: "a"}}}, "without weight"},
+		{&routeConfig{Upstream: "a", Affinity: "header"}, "unknown affinity"},
+	}
+	for _, test := range tests {
+		_, err := newReverseProxy(&config{Upstreams: upstreams, Routes: []*routeConfig{test.route}})
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("Expected %q, got %v", test.err, err)
+		}
+	}
+}
@@ -0,0 +1,449 @@
+// Copyright (c) 2014 David R. Jenni. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultTCPIdle = time.Hour        // idle timeout of TCP streams
+	defaultUDPIdle = 30 * time.Second // idle timeout of UDP sessions
+	helloTimeout   = 10 * time.Second // timeout reading a TLS client hello
+	maxDatagram    = 64 << 10
+)
+
+// stream is an L4 route: the connections accepted on a TCP or UDP
+// listener are passed to an upstream.
+type stream struct {
+	listen   string
+	protocol string               // tcp or udp
+	upstream *upstream            // nil if a server name must match
+	sni      map[string]*upstream // upstreams by TLS server name, nil for no SNI routing
+	idle     time.Duration        // idle timeout
+	proxy    bool                 // clients start with a PROXY protocol header
+}
+
+// newStream returns the stream described by c.
+func newStream(c *streamConfig, upstreams map[string]*upstream) (*stream, error) {
+	s := &stream{listen: c.Listen, protocol: c.Protocol, idle: time.Duration(c.IdleTimeout), proxy: c.ProxyProtocol}
+	switch s.protocol {
+	case "", "tcp":
+		s.protocol = "tcp"
+		if s.idle == 0 {
+			s.idle = defaultTCPIdle
+		}
+	case "udp":
+		if c.SNI != nil {
+			return nil, fmt.Errorf("stream %s: SNI routing needs tcp", c.Listen)
+		}
+		if c.ProxyProtocol {
+			return nil, fmt.Errorf("stream %s: PROXY protocol needs tcp", c.Listen)
+		}
+		if s.idle == 0 {
+			s.idle = defaultUDPIdle
+		}
+	default:
+		return nil, fmt.Errorf("stream %s: unknown protocol %q", c.Listen, c.Protocol)
+	}
+	lookup := func(name string) (*upstream, error) {
+		u, ok := upstreams[name]
+		if !ok {
+			return nil, fmt.Errorf("stream %s: unknown upstream %q", c.Listen, name)
+		}
+		for _, b := range u.list() {
+			if _, _, err := net.SplitHostPort(b.url.Host); err != nil {
+				return nil, fmt.Errorf("stream %s: target %s needs a port", c.Listen, b.url)
+			}
+		}
+		return u, nil
+	}
+	var err error
+	if c.Upstream != "" {
+		if s.upstream, err = lookup(c.Upstream); err != nil {
+			return nil, err
+		}
+	}
+	if c.SNI != nil {
+		s.sni = make(map[string]*upstream)
+		for name, up := range c.SNI {
+			if s.sni[strings.ToLower(name)], err = lookup(up); err != nil {
+				return nil, err
+			}
+		}
+	} else if s.upstream == nil {
+		return nil, fmt.Errorf("stream %s: no upstream", c.Listen)
+	}
+	return s, nil
+}
+
+// key identifies the listener of the stream.
+func (s *stream) key() string {
+	return s.protocol + " " + s.listen
+}
+
+// route returns the upstream for the TLS server name: the exact
+// name, the most specific wildcard "*.domain" or the default.
+func (s *stream) route(name string) *upstream {
+	name = strings.ToLower(name)
+	if u, ok := s.sni[name]; ok {
+		return u
+	}
+	for i := strings.IndexByte(name, '.'); i >= 0; i = strings.IndexByte(name, '.') {
+		name = name[i+1:]
+		if u, ok := s.sni["*."+name]; ok {
+			return u
+		}
+	}
+	return s.upstream
+}
+
+// listenStreams opens the listeners of the streams.
+func (p *reverseProxy) listenStreams() error {
+	for key, s := range p.current().streams {
+		switch s.protocol {
+		case "tcp":
+			l, err := net.Listen("tcp", s.listen)
+			if err != nil {
+				return err
+			}
+			p.addListener(l)
+			go p.serveTCP(l, key)
+		case "udp":
+			pc, err := net.ListenPacket("udp", s.listen)
+			if err != nil {
+				return err
+			}
+			p.addListener(pc)
+			go p.serveUDP(pc, key)
+		}
+	}
+	return nil
+}
+
+func (p *reverseProxy) addListener(l io.Closer) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.listeners = append(p.listeners, l)
+}
+
+// serveTCP accepts the connections of a TCP stream.
+func (p *reverseProxy) serveTCP(l net.Listener, key string) {
+	for {
+		c, err := l.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		} else if err != nil {
+			log.Printf("Error accepting on %s: %v", key, err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		go p.handleTCP(c, key)
+	}
+}
+
+// handleTCP passes a connection to a target of its stream,
+// chosen by the TLS server name if the stream routes by SNI.
+func (p *reverseProxy) handleTCP(c net.Conn, key string) {
+	defer c.Close()
+	s := p.current().streams[key]
+	if s == nil {
+		return // removed by a reload
+	}
+	p.addConn(c)
+	defer p.removeConn(c)
+	if s.proxy {
+		pc := &proxyConn{Conn: c}
+		if pc.init(); pc.err != nil {
+			return
+		}
+		c = pc
+	}
+
+	u := s.upstream
+	var hello []byte
+	if s.sni != nil {
+		c.SetReadDeadline(time.Now().Add(helloTimeout))
+		name, b, err := readServerName(c)
+		if err != nil {
+			log.Printf("Error reading the TLS client hello of %s: %v", c.RemoteAddr(), err)
+			return
+		}
+		c.SetReadDeadline(time.Time{})
+		if u = s.route(name); u == nil {
+			log.Printf("No upstream for server name %q on %s", name, key)
+			return
+		}
+		hello = b
+	}
+	backend, b, err := u.dialStream("tcp", c.RemoteAddr(), c.LocalAddr())
+	if err != nil {
+		log.Printf("Error connecting to %s: %v", u.name, err)
+		return
+	}
+	defer b.conns.Add(-1)
+	defer backend.Close()
+	if _, err := backend.Write(hello); err != nil {
+		return
+	}
+	splice(c, backend, s.idle)
+}
+
+// dialStream connects to a backend of the upstream for a client
+// which connected to the local address, nil for UDP. The backend
+// counts the connection until it is released by the caller with
+// b.conns.Add(-1).
+func (u *upstream) dialStream(network string, client, local net.Addr) (net.Conn, *backend, error) {
+	if !u.breaker.allow() {
+		return nil, nil, fmt.Errorf("circuit breaker open")
+	}
+	// The balancers pick by request; the hash strategy uses the client IP.
+	b := u.pick(&http.Request{RemoteAddr: client.String(), Header: make(http.Header)})
+	if b == nil {
+		u.breaker.record(false)
+		return nil, nil, fmt.Errorf("no backend available")
+	}
+	c, err := u.dialer.Dial(network, b.url.Host)
+	u.report(b, err == nil)
+	u.breaker.record(err == nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	if network == "tcp" && u.proxyProtocol != 0 {
+		if _, err := c.Write(proxyHeader(u.proxyProtocol, client, local)); err != nil {
+			c.Close()
+			return nil, nil, err
+		}
+	}
+	b.conns.Add(1)
+	return c, b, nil
+}
+
+// activity records the time of the last traffic of a connection.
+type activity struct {
+	last atomic.Int64
+}
+
+func (a *activity) touch() {
+	a.last.Store(time.Now().UnixNano())
+}
+
+// deadline returns the time at which the connection becomes idle.
+func (a *activity) deadline(idle time.Duration) time.Time {
+	return time.Unix(0, a.last.Load()).Add(idle)
+}
+
+// idleReader reads from a connection until the connection,
+// in either direction, is idle for the idle timeout.
+type idleReader struct {
+	c    net.Conn
+	idle time.Duration
+	a    *activity
+}
+
+func (r idleReader) Read(b []byte) (int, error) {
+	for {
+		r.c.SetReadDeadline(r.a.deadline(r.idle))
+		n, err := r.c.Read(b)
+		if n > 0 {
+			r.a.touch()
+		}
+		var ne net.Error
+		if n == 0 && errors.As(err, &ne) && ne.Timeout() && time.Now().Before(r.a.deadline(r.idle)) {
+			continue // the other direction was active
+		}
+		return n, err
+	}
+}
+
+// splice copies between the client and the backend until both
+// directions end or the connection is idle for the idle timeout.
+// An end of one direction is passed on as a half-close.
+func splice(client, backend net.Conn, idle time.Duration) {
+	a := new(activity)
+	a.touch()
+	done := make(chan struct{}, 2)
+	cp := func(dst, src net.Conn) {
+		_, err := io.Copy(dst, idleReader{src, idle, a})
+		if cw, ok := dst.(interface{ CloseWrite() error }); ok && err == nil {
+			cw.CloseWrite()
+		} else {
+			client.Close()
+			backend.Close()
+		}
+		done <- struct{}{}
+	}
+	go cp(backend, client)
+	go cp(client, backend)
+	<-done
+	<-done
+}
+
+// errHello stops the TLS handshake of readServerName.
+var errHello = errors.New("client hello read")
+
+// readServerName reads the TLS client hello from r. It returns the
+// server name the client asks for and the bytes read, which are to
+// be passed on to the target.
+func readServerName(r io.Reader) (string, []byte, error) {
+	var buf bytes.Buffer
+	var name string
+	err := tls.Server(helloConn{io.TeeReader(r, &buf)}, &tls.Config{
+		GetConfigForClient: func(h *tls.ClientHelloInfo) (*tls.Config, error) {
+			name = h.ServerName
+			return nil, errHello
+		},
+	}).Handshake()
+	if !errors.Is(err, errHello) {
+		return "", nil, err
+	}
+	return name, buf.Bytes(), nil
+}
+
+// helloConn is a read-only connection for readServerName.
+type helloConn struct {
+	r io.Reader
+}
+
+func (c helloConn) Read(b []byte) (int, error)         { return c.r.Read(b) }
+func (c helloConn) Write(b []byte) (int, error)        { return 0, io.ErrClosedPipe }
+func (c helloConn) Close() error                       { return nil }
+func (c helloConn) LocalAddr() net.Addr                { return nil }
+func (c helloConn) RemoteAddr() net.Addr               { return nil }
+func (c helloConn) SetDeadline(t time.Time) error      { return nil }
+func (c helloConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c helloConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// udpSession relays the datagrams of a client of a UDP stream.
+type udpSession struct {
+	backend net.Conn
+	a       activity
+}
+
+// serveUDP relays the datagrams of a UDP stream. Every client
+// address gets a session with its own backend connection, which
+// ends when the session is idle for the idle timeout.
+func (p *reverseProxy) serveUDP(pc net.PacketConn, key string) {
+	var mu sync.Mutex
+	sessions := make(map[string]*udpSession)
+	defer func() {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, s := range sessions {
+			s.backend.Close()
+		}
+	}()
+	buf := make([]byte, maxDatagram)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		} else if err != nil {
+			log.Printf("Error reading on %s: %v", key, err)
+			continue
+		}
+		mu.Lock()
+		sess := sessions[addr.String()]
+		mu.Unlock()
+		if sess == nil {
+			st := p.current().streams[key]
+			if st == nil {
+				continue // removed by a reload
+			}
+			backend, b, err := st.upstream.dialStream("udp", addr, nil)
+			if err != nil {
+				log.Printf("Error connecting to %s: %v", st.upstream.name, err)
+				continue
+			}
+			sess = &udpSession{backend: backend}
+			sess.a.touch()
+			mu.Lock()
+			sessions[addr.String()] = sess
+			mu.Unlock()
+			go func() {
+				sess.relay(pc, addr, st.idle)
+				mu.Lock()
+				delete(sessions, addr.String())
+				mu.Unlock()
+				backend.Close()
+				b.conns.Add(-1)
+			}()
+		}
+		sess.a.touch()
+		sess.backend.Write(buf[:n])
+	}
+}
+
+// relay sends the datagrams of the backend to the client
+// until the session is idle for the idle timeout.
+func (s *udpSession) relay(pc net.PacketConn, client net.Addr, idle time.Duration) {
+	buf := make([]byte, maxDatagram)
+	r := idleReader{s.backend, idle, &s.a}
+	for {
+		n, err := r.Read(buf)
+		if err != nil {
+			return
+		}
+		pc.WriteTo(buf[:n], client)
+	}
+}
+
+// addConn registers an active connection of a TCP stream.
+func (p *reverseProxy) addConn(c net.Conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.conns[c] = true
+}
+
+// removeConn unregisters a connection of a TCP stream.
+func (p *reverseProxy) removeConn(c net.Conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.conns, c)
+}
+
+// closeStreams closes the listeners of the streams and waits for
+// their TCP connections to end until ctx is done, then closes the
+// remaining ones. UDP sessions end with their listener.
+func (p *reverseProxy) closeStreams(ctx context.Context) {
+	p.mu.Lock()
+	for _, l := range p.listeners {
+		l.Close()
+	}
+	p.listeners = nil
+	p.mu.Unlock()
+
+	tick := time.NewTicker(100 * time.Millisecond)
+	defer tick.Stop()
+	for {
+		p.mu.Lock()
+		n := len(p.conns)
+		if n > 0 && ctx.Err() != nil {
+			log.Printf("Closing %d connections", n)
+			for c := range p.conns {
+				c.Close()
+			}
+			clear(p.conns)
+			n = 0
+		}
+		p.mu.Unlock()
+		if n == 0 {
+			return
+		}
+		<-tick.C
+	}
+}
@@ -0,0 +1,222 @@
+// Copyright (c) 2014 David R. Jenni. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// streamProxy starts the stream of the configuration and
+// returns the address it listens on.
+func streamProxy(t *testing.T, c *config) (*reverseProxy, net.Addr) {
+	p, err := newReverseProxy(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.listenStreams(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		p.closeStreams(ctx)
+	})
+	switch l := p.listeners[0].(type) {
+	case net.Listener:
+		return p, l.Addr()
+	case net.PacketConn:
+		return p, l.LocalAddr()
+	}
+	panic("unknown listener")
+}
+
+// echoTCP accepts connections and echoes them until EOF.
+func echoTCP(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	return l
+}
+
+func TestStreamTCP(t *testing.T) {
+	l := echoTCP(t)
+	_, addr := streamProxy(t, &config{
+		Upstreams: map[string]*upstreamConfig{"db": {Targets: []targetConfig{{URL: "tcp://" + l.Addr().String()}}}},
+		Streams:   []*streamConfig{{Listen: "127.0.0.1:0", Upstream: "db"}},
+	})
+
+	c, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	io.WriteString(c, "ping")
+	// The half-close reaches the target, whose close reaches the client.
+	c.(*net.TCPConn).CloseWrite()
+	b, err := io.ReadAll(c)
+	if err != nil || string(b) != "ping" {
+		t.Errorf("Expected ping, got %q %v", b, err)
+	}
+}
+
+func TestStreamIdle(t *testing.T) {
+	l := echoTCP(t)
+	_, addr := streamProxy(t, &config{
+		Upstreams: map[string]*upstreamConfig{"db": {Targets: []targetConfig{{URL: "tcp://" + l.Addr().String()}}}},
+		Streams:   []*streamConfig{{Listen: "127.0.0.1:0", Upstream: "db", IdleTimeout: duration(100 * time.Millisecond)}},
+	})
+
+	c, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		time.Sleep(60 * time.Millisecond)
+		io.WriteString(c, "x")
+	}
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b, err := io.ReadAll(c)
+	if err != nil || string(b) != "xxx" {
+		t.Errorf("Expected xxx, got %q %v", b, err)
+	}
+	if d := time.Since(start); d < 250*time.Millisecond {
+		t.Errorf("Expected the active connection to stay open, closed after %v", d)
+	}
+}
+
+func TestStreamSNI(t *testing.T) {
+	backend := func(name string) *httptest.Server {
+		ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, name+" "+r.TLS.ServerName)
+		}))
+		t.Cleanup(ts.Close)
+		return ts
+	}
+	a, b := backend("a"), backend("b")
+	_, addr := streamProxy(t, &config{
+		Upstreams: map[string]*upstreamConfig{
+			"a": {Targets: []targetConfig{{URL: "tcp://" + a.Listener.Addr().String()}}},
+			"b": {Targets: []targetConfig{{URL: "tcp://" + b.Listener.Addr().String()}}},
+		},
+		Streams: []*streamConfig{{Listen: "127.0.0.1:0", SNI: map[string]string{"a.example.com": "a", "*.example.com": "b"}}},
+	})
+
+	tests := []struct {
+		name, want string
+	}{
+		{"a.example.com", "a a.example.com"},
+		{"x.y.example.com", "b x.y.example.com"},
+		{"example.org", ""},
+	}
+	for _, test := range tests {
+		client := &http.Client{Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{ServerName: test.name, InsecureSkipVerify: true},
+		}}
+		resp, err := client.Get("https://" + addr.String() + "/")
+		if test.want == "" {
+			if err == nil {
+				resp.Body.Close()
+				t.Errorf("%s: expected the connection to be closed", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != test.want {
+			t.Errorf("%s: expected %q, got %q", test.name, test.want, body)
+		}
+	}
+}
+
+func TestStreamUDP(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			pc.WriteTo([]byte(strings.ToUpper(string(buf[:n]))), addr)
+		}
+	}()
+	_, addr := streamProxy(t, &config{
+		Upstreams: map[string]*upstreamConfig{"dns": {Targets: []targetConfig{{URL: "udp://" + pc.LocalAddr().String()}}}},
+		Streams:   []*streamConfig{{Listen: "127.0.0.1:0", Protocol: "udp", Upstream: "dns"}},
+	})
+
+	for _, msg := range []string{"a", "b"} {
+		c, err := net.Dial("udp", addr.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		for i := 0; i < 2; i++ {
+			io.WriteString(c, msg)
+			buf := make([]byte, 512)
+			n, err := c.Read(buf)
+			if err != nil || string(buf[:n]) != strings.ToUpper(msg) {
+				t.Errorf("Expected %q, got %q %v", strings.ToUpper(msg), buf[:n], err)
+			}
+		}
+	}
+}
+
+func TestStreamConfig(t *testing.T) {
+	upstreams := map[string]*upstreamConfig{
+		"a": {Targets: []targetConfig{{URL: "tcp://a:1"}}},
+		"n": {Targets: []targetConfig{{URL: "tcp://a"}}},
+	}
+	tests := []struct {
+		stream *streamConfig
+		err    string
+	}{
+		{&streamConfig{Listen: ":1", Upstream: "a"}, ""},
+		{&streamConfig{Listen: ":1", Protocol: "sctp", Upstream: "a"}, "unknown protocol"},
+		{&streamConfig{Listen: ":1", Protocol: "udp", SNI: map[string]string{"x": "a"}}, "SNI routing needs tcp"},
+		{&streamConfig{Listen: ":1", Upstream: "x"}, "unknown upstream"},
+		{&streamConfig{Listen: ":1", Upstream: "n"}, "needs a port"},
+		{&streamConfig{Listen: ":1"}, "no upstream"},
+	}
+	for _, test := range tests {
+		_, err := newReverseProxy(&config{Upstreams: upstreams, Streams: []*streamConfig{test.stream}})
+		if test.err == "" && err != nil || test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+			t.Errorf("%+v: expected error %q, got %v", test.stream, test.err, err)
+		}
+	}
+}
@@ -0,0 +1,216 @@
+// Copyright (c) 2014 David R. Jenni. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// certStore holds the certificates of the listener and selects
+// them by the server name of the TLS client hello.
+type certStore struct {
+	certFile, keyFile string // default certificate
+	dir               string // directory of name.crt and name.key pairs
+
+	mu     sync.RWMutex
+	def    *tls.Certificate
+	byName map[string]*tls.Certificate
+	state  string // names, sizes and modification times of the loaded files
+}
+
+// newCertStore loads the default certificate and the
+// certificates of the directory, if given.
+func newCertStore(certFile, keyFile, dir string) (*certStore, error) {
+	s := &certStore{certFile: certFile, keyFile: keyFile, dir: dir}
+	state, err := s.fileState()
+	if err != nil {
+		return nil, err
+	}
+	return s, s.load(state)
+}
+
+// files returns the certificate and key files of the store.
+func (s *certStore) files() ([][2]string, error) {
+	var pairs [][2]string
+	if s.certFile != "" {
+		pairs = append(pairs, [2]string{s.certFile, s.keyFile})
+	}
+	if s.dir != "" {
+		certs, err := filepath.Glob(filepath.Join(s.dir, "*.crt"))
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range certs {
+			pairs = append(pairs, [2]string{c, strings.TrimSuffix(c, ".crt") + ".key"})
+		}
+	}
+	return pairs, nil
+}
+
+// fileState describes the files of the store to detect changes.
+func (s *certStore) fileState() (string, error) {
+	pairs, err := s.files()
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	for _, p := range pairs {
+		for _, name := range p {
+			fi, err := os.Stat(name)
+			if err != nil {
+				return "", err
+			}
+			fmt.Fprintf(&b, "%s %d %d\n", name, fi.Size(), fi.ModTime().UnixNano())
+		}
+	}
+	return b.String(), nil
+}
+
+// load reads all certificates of the store.
+func (s *certStore) load(state string) error {
+	pairs, err := s.files()
+	if err != nil {
+		return err
+	}
+	var def *tls.Certificate
+	byName := make(map[string]*tls.Certificate)
+	for i, p := range pairs {
+		cert, err := tls.LoadX509KeyPair(p[0], p[1])
+		if err != nil {
+			return err
+		}
+		if cert.Leaf == nil {
+			if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+				return fmt.Errorf("%s: %v", p[0], err)
+			}
+		}
+		if i == 0 {
+			def = &cert
+			if s.certFile != "" {
+				// The default certificate only serves unknown names.
+				continue
+			}
+		}
+		for _, name := range cert.Leaf.DNSNames {
+			byName[strings.ToLower(name)] = &cert
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.def, s.byName, s.state = def, byName, state
+	return nil
+}
+
+// getCertificate returns the certificate for the server name of the
+// client hello, or the default certificate for unknown names.
+func (s *certStore) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	name := strings.ToLower(hello.ServerName)
+	if cert, ok := s.byName[name]; ok {
+		return cert, nil
+	}
+	if i := strings.Index(name, "."); i >= 0 {
+		if cert, ok := s.byName["*"+name[i:]]; ok {
+			return cert, nil
+		}
+	}
+	if s.def == nil {
+		return nil, fmt.Errorf("no certificate for %q", hello.ServerName)
+	}
+	return s.def, nil
+}
+
+// watch reloads the certificates periodically if their files changed.
+func (s *certStore) watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		s.reload()
+	}
+}
+
+// reload loads the certificates if their files changed. A failed
+// reload keeps the previous certificates.
+func (s *certStore) reload() {
+	state, err := s.fileState()
+	if err != nil {
+		log.Printf("Error checking certificates: %v", err)
+		return
+	}
+	s.mu.RLock()
+	changed := state != s.state
+	s.mu.RUnlock()
+	if !changed {
+		return
+	}
+	if err := s.load(state); err != nil {
+		log.Printf("Error reloading certificates: %v", err)
+		return
+	}
+	log.Printf("Reloaded certificates")
+}
+
+// tlsVersions maps the version names of the -tls-min flag.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// newServerTLSConfig returns the TLS configuration of the listener with
+// the given minimum version, comma separated cipher suite names and the
+// PEM file of the CAs which verify client certificates.
+func newServerTLSConfig(certs *certStore, minVersion, ciphers, clientCA string) (*tls.Config, error) {
+	conf := &tls.Config{GetCertificate: certs.getCertificate}
+	if minVersion != "" {
+		v, ok := tlsVersions[minVersion]
+		if !ok {
+			return nil, fmt.Errorf("unknown TLS version %q", minVersion)
+		}
+		conf.MinVersion = v
+	}
+	if ciphers != "" {
+		ids := make(map[string]uint16)
+		for _, c := range tls.CipherSuites() {
+			ids[c.Name] = c.ID
+		}
+		for _, name := range strings.Split(ciphers, ",") {
+			id, ok := ids[strings.TrimSpace(name)]
+			if !ok {
+				return nil, fmt.Errorf("unknown or insecure cipher suite %q", name)
+			}
+			conf.CipherSuites = append(conf.CipherSuites, id)
+		}
+	}
+	if clientCA != "" {
+		pem, err := os.ReadFile(clientCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no certificates", clientCA)
+		}
+		conf.ClientCAs = pool
+		// Routes decide whether they need a client certificate.
+		conf.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return conf, nil
+}
+
+// hasClientCert reports whether the client of the request
+// presented a verified certificate.
+func hasClientCert(r *http.Request) bool {
+	return r.TLS != nil && len(r.TLS.VerifiedChains) > 0
+}
@@ -0,0 +1,229 @@
+// Copyright (c) 2014 David R. Jenni. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCert is a certificate generated for a test.
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// newTestCert returns a certificate for the DNS names, signed by ca or,
+// if ca is nil, a self-signed CA certificate.
+func newTestCert(t *testing.T, ca *testCert, names ...string) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "test"},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	parent, signer := tmpl, key
+	if ca == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+	} else {
+		parent, signer = ca.cert, ca.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert: cert, key: key}
+}
+
+// certPEM returns the PEM encoding of the certificate.
+func (c *testCert) certPEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.cert.Raw})
+}
+
+// write writes the certificate and its key to name.crt and name.key.
+func (c *testCert) write(t *testing.T, name string) {
+	t.Helper()
+	der, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(name+".crt", c.certPEM(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(name+".key", pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// tlsCert returns the certificate for a tls.Config.
+func (c *testCert) tlsCert() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.cert.Raw}, PrivateKey: c.key, Leaf: c.cert}
+}
+
+func TestCertStore(t *testing.T) {
+	dir := t.TempDir()
+	def := newTestCert(t, nil, "default.example")
+	def.write(t, filepath.Join(dir, "default"))
+	certs := filepath.Join(dir, "certs")
+	if err := os.Mkdir(certs, 0755); err != nil {
+		t.Fatal(err)
+	}
+	a := newTestCert(t, nil, "a.example")
+	a.write(t, filepath.Join(certs, "a"))
+	wild := newTestCert(t, nil, "*.b.example")
+	wild.write(t, filepath.Join(certs, "b"))
+
+	s, err := newCertStore(filepath.Join(dir, "default.crt"), filepath.Join(dir, "default.key"), certs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check := func(name string, want *testCert) {
+		t.Helper()
+		cert, err := s.getCertificate(&tls.ClientHelloInfo{ServerName: name})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !cert.Leaf.Equal(want.cert) {
+			t.Errorf("%q: expected the certificate of %v, got %v", name, want.cert.DNSNames, cert.Leaf.DNSNames)
+		}
+	}
+	check("a.example", a)
+	check("A.Example", a)
+	check("x.b.example", wild)
+	check("b.example", def)
+	check("", def)
+	check("default.example", def)
+
+	// A changed certificate is reloaded; a broken one is ignored.
+	a2 := newTestCert(t, nil, "a.example", "c.example")
+	a2.write(t, filepath.Join(certs, "a"))
+	s.reload()
+	check("a.example", a2)
+	check("c.example", a2)
+	if err := os.WriteFile(filepath.Join(certs, "a.crt"), []byte("broken"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s.reload()
+	check("c.example", a2)
+
+	// Without a default certificate, unknown names fail.
+	s, err = newCertStore("", "", filepath.Join(dir, "missing"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.getCertificate(&tls.ClientHelloInfo{ServerName: "a.example"}); err == nil {
+		t.Errorf("Expected an error without certificates")
+	}
+}
+
+func TestServerTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	server := newTestCert(t, nil, "localhost")
+	server.write(t, filepath.Join(dir, "server"))
+	s, err := newCertStore(filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		min, ciphers string
+		ok           bool
+	}{
+		{"1.2", "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256", true},
+		{"1.4", "", false},
+		{"", "TLS_RSA_WITH_RC4_128_SHA", false},
+	}
+	for _, test := range tests {
+		if _, err := newServerTLSConfig(s, test.min, test.ciphers, ""); (err == nil) != test.ok {
+			t.Errorf("%q %q: expected ok %v, got %v", test.min, test.ciphers, test.ok, err)
+		}
+	}
+	if _, err := newServerTLSConfig(s, "", "", filepath.Join(dir, "server.key")); err == nil {
+		t.Errorf("Expected an error for a client CA file without certificates")
+	}
+}
+
+func TestClientCert(t *testing.T) {
+	dir := t.TempDir()
+	server := newTestCert(t, nil, "localhost")
+	server.write(t, filepath.Join(dir, "server"))
+	ca := newTestCert(t, nil)
+	if err := os.WriteFile(filepath.Join(dir, "ca.pem"), ca.certPEM(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	good := newTestCert(t, ca, "client")
+	bad := newTestCert(t, newTestCert(t, nil), "client")
+
+	s, err := newCertStore(filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf, err := newServerTLSConfig(s, "1.2", "", filepath.Join(dir, "ca.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := newTestProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), &config{
+		Routes: []*routeConfig{{Upstream: "a", ClientCert: true}},
+	})
+	front := httptest.NewUnstartedServer(p)
+	front.TLS = conf
+	front.StartTLS()
+	defer front.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(server.cert)
+	get := func(c *testCert) (int, error) {
+		tc := &tls.Config{RootCAs: roots, ServerName: "localhost"}
+		if c != nil {
+			tc.Certificates = []tls.Certificate{c.tlsCert()}
+		}
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: tc}}
+		defer client.CloseIdleConnections()
+		resp, err := client.Get(front.URL)
+		if err != nil {
+			return 0, err
+		}
+		resp.Body.Close()
+		return resp.StatusCode, nil
+	}
+	if code, err := get(good); err != nil || code != http.StatusOK {
+		t.Errorf("Expected 200 with a trusted client certificate, got %d %v", code, err)
+	}
+	if code, err := get(nil); err != nil || code != http.StatusForbidden {
+		t.Errorf("Expected 403 without a client certificate, got %d %v", code, err)
+	}
+	if _, err := get(bad); err == nil {
+		t.Errorf("Expected the handshake to fail with an untrusted client certificate")
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright (c) 2014 David R. Jenni. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestResponseHeaderTimeout(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(200 * time.Millisecond)
+		}
+		io.WriteString(w, "ok")
+	})
+	p := newTestProxy(t, h, &config{Upstreams: map[string]*upstreamConfig{"a": {
+		Transport: &transportConfig{ResponseHeaderTimeout: duration(50 * time.Millisecond), MaxConns: 4},
+	}}})
+
+	for path, status := range map[string]int{"/": http.StatusOK, "/slow": http.StatusBadGateway} {
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != status {
+			t.Errorf("%s: expected %d, got %d", path, status, w.Code)
+		}
+	}
+
+	for _, c := range []*transportConfig{{DialTimeout: -1}, {MaxConns: -1}} {
+		_, err := newReverseProxy(&config{
+			Upstreams: map[string]*upstreamConfig{"a": {Targets: []targetConfig{{URL: "http://a"}}, Transport: c}},
+		})
+		if err == nil {
+			t.Errorf("Expected an error for %+v", c)
+		}
+	}
+}
+
+// silentWebsocket answers an upgrade with 101 and discards the frames.
+func silentWebsocket(w http.ResponseWriter, r *http.Request) {
+	conn, brw, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	brw.WriteString(switchProtocols(r))
+	brw.Flush()
+	io.Copy(io.Discard, brw)
+}
+
+func TestWebsocketIdle(t *testing.T) {
+	// Without inspection bytes are passed; with it, the pings of
+	// the proxy do not keep the websocket open.
+	for _, ws := range []*websocketConfig{nil, {Ping: duration(50 * time.Millisecond)}} {
+		p := newTestProxy(t, http.HandlerFunc(silentWebsocket), &config{
+			Upstreams: map[string]*upstreamConfig{"a": {
+				Transport: &transportConfig{WebsocketIdleTimeout: duration(200 * time.Millisecond)},
+			}},
+			Routes: []*routeConfig{{Upstream: "a", Websocket: ws}},
+		})
+		front := httptest.NewServer(p)
+		conn, br := dialWebsocket(t, front.Listener.Addr().String())
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		start := time.Now()
+		time.Sleep(100 * time.Millisecond)
+		conn.Write(maskedFrame(opText, true, "hello"))
+		b, err := io.ReadAll(br)
+		if d := time.Since(start); d < 300*time.Millisecond {
+			t.Errorf("%+v: expected the websocket to be closed after 200ms idle, closed after %v", ws, d)
+		}
+		b = bytes.ReplaceAll(b, []byte{0x89, 0x00}, nil) // pings
+		if want := []byte{0x88, 0x02, 0x03, 0xe9}; err != nil || !bytes.Equal(b, want) {
+			t.Errorf("%+v: expected close frame %x, got %x %v", ws, want, b, err)
+		}
+		conn.Close()
+		front.Close()
+	}
+}
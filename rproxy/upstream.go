@@ -0,0 +1,354 @@
+// Copyright (c) 2014 David R. Jenni. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// backend is a target of an upstream.
+type backend struct {
+	url    *url.URL
+	weight atomic.Int64 // changed by the admin API
+	conns  atomic.Int64 // number of active connections
+
+	mu           sync.Mutex
+	draining     bool      // receives no new requests
+	down         bool      // failed the last health check
+	failures     int       // consecutive failures
+	ejections    int       // consecutive ejections
+	ejectedUntil time.Time // end of the current ejection
+}
+
+// upstream is a named pool of backends.
+type upstream struct {
+	name     string
+	mu       sync.RWMutex
+	backends []*backend // replaced, never modified, by the admin API
+	balancer balancer
+	eject    ejection
+	ejecting sync.Mutex   // keeps concurrent ejections from taking out all backends
+	health   *healthCheck // nil disables the health checks
+	retry    retryPolicy
+	breaker  breaker
+
+	tls           *tls.Config // TLS configuration for https targets, nil for the defaults
+	transport     *http.Transport
+	dialer        *net.Dialer
+	wsIdle        time.Duration // idle timeout of websockets, 0 for none
+	rewriteHost   bool
+	proxyProtocol int // version of the PROXY protocol header sent to the backends, 0 for none
+
+	config *upstreamConfig // configuration, compared on reload
+	stop   chan struct{}   // closed when the upstream is replaced
+}
+
+// newUpstream returns an upstream with the given targets and weights
+// which are balanced with the given strategy. The hash strategy uses
+// the value of the header hashKey or, if empty, the client IP.
+func newUpstream(targets []string, weights []int, strategy, hashKey string) (*upstream, error) {
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("no targets")
+	}
+	if len(weights) != 0 && len(weights) != len(targets) {
+		return nil, fmt.Errorf("%d weights for %d targets", len(weights), len(targets))
+	}
+	u := &upstream{stop: make(chan struct{})}
+	for i, t := range targets {
+		w := 1
+		if len(weights) != 0 {
+			w = weights[i]
+		}
+		b, err := newBackend(t, w)
+		if err != nil {
+			return nil, err
+		}
+		u.backends = append(u.backends, b)
+	}
+	var err error
+	u.balancer, err = newBalancer(strategy, hashKey)
+	if err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// newBackend returns the backend of a target URL, http, https, tcp or
+// udp, with the weight.
+func newBackend(target string, weight int) (*backend, error) {
+	t, err := url.Parse(target)
+	if err != nil || t.Host == "" {
+		return nil, fmt.Errorf("invalid target %q", target)
+	}
+	switch t.Scheme {
+	case "http", "https", "tcp", "udp":
+	default:
+		return nil, fmt.Errorf("%s: unknown scheme %q", target, t.Scheme)
+	}
+	if weight <= 0 {
+		return nil, fmt.Errorf("%s: weight must be positive", target)
+	}
+	b := &backend{url: t}
+	b.weight.Store(int64(weight))
+	return b, nil
+}
+
+// schemeKind returns the protocol of the targets of a scheme.
+func schemeKind(scheme string) string {
+	if scheme == "https" {
+		return "http"
+	}
+	return scheme
+}
+
+// pick selects an available backend for the request. It returns
+// nil if there is no backend available.
+func (u *upstream) pick(r *http.Request) *backend {
+	bs := u.available()
+	if len(bs) == 0 {
+		return nil
+	}
+	return u.balancer.pick(bs, r)
+}
+
+// pickKey selects the available backend for an affinity key, which
+// keeps its backend as long as the backend is available. It returns
+// nil if there is no backend available.
+func (u *upstream) pickKey(key string) *backend {
+	bs := u.available()
+	if len(bs) == 0 {
+		return nil
+	}
+	return rendezvous(bs, key)
+}
+
+// available returns the available backends of the upstream.
+func (u *upstream) available() []*backend {
+	var bs []*backend
+	for _, b := range u.list() {
+		if b.available() {
+			bs = append(bs, b)
+		}
+	}
+	return bs
+}
+
+// list returns the backends of the upstream.
+func (u *upstream) list() []*backend {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	return u.backends
+}
+
+// find returns the backend with the given URL, or nil.
+func (u *upstream) find(target string) *backend {
+	for _, b := range u.list() {
+		if b.url.String() == target {
+			return b
+		}
+	}
+	return nil
+}
+
+// add adds a backend with the given URL and weight.
+func (u *upstream) add(target string, weight int) error {
+	b, err := newBackend(target, weight)
+	if err != nil {
+		return err
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if schemeKind(b.url.Scheme) != schemeKind(u.backends[0].url.Scheme) {
+		return fmt.Errorf("%s: scheme does not match the other targets", target)
+	}
+	for _, o := range u.backends {
+		if o.url.String() == b.url.String() {
+			return fmt.Errorf("%s: duplicate target", target)
+		}
+	}
+	u.backends = append(u.backends[:len(u.backends):len(u.backends)], b)
+	return nil
+}
+
+// remove removes the backend with the given URL. Requests which
+// are in flight to the backend are completed.
+func (u *upstream) remove(target string) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for i, b := range u.backends {
+		if b.url.String() != target {
+			continue
+		}
+		if len(u.backends) == 1 {
+			return fmt.Errorf("%s: last target", target)
+		}
+		u.backends = slices.Delete(slices.Clone(u.backends), i, i+1)
+		if f, ok := u.balancer.(forgetter); ok {
+			f.forget(b)
+		}
+		return nil
+	}
+	return fmt.Errorf("%s: unknown target", target)
+}
+
+// close stops the health checks of a replaced upstream
+// and closes its idle connections.
+func (u *upstream) close() {
+	close(u.stop)
+	u.transport.CloseIdleConnections()
+}
+
+// dialContext connects to a target and sends the PROXY protocol
+// header of the upstream, if any.
+func (u *upstream) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	c, err := u.dialer.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if err := u.sendProxyHeader(ctx, c); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// balancer selects one of the given backends for a request.
+type balancer interface {
+	pick(bs []*backend, r *http.Request) *backend
+}
+
+// forgetter is a balancer with state about the backends, which
+// is dropped when a backend is removed.
+type forgetter interface {
+	forget(b *backend)
+}
+
+// newBalancer returns the balancer for the given strategy.
+func newBalancer(strategy, hashKey string) (balancer, error) {
+	switch strategy {
+	case "", "round-robin":
+		return &roundRobin{}, nil
+	case "weighted":
+		return &weighted{current: make(map[*backend]int)}, nil
+	case "least-conn":
+		return leastConn{}, nil
+	case "hash":
+		return hash{key: hashKey}, nil
+	}
+	return nil, fmt.Errorf("unknown balancing strategy %q", strategy)
+}
+
+// roundRobin selects the backends in turn.
+type roundRobin struct {
+	n atomic.Uint64
+}
+
+func (rr *roundRobin) pick(bs []*backend, r *http.Request) *backend {
+	return bs[(rr.n.Add(1)-1)%uint64(len(bs))]
+}
+
+// weighted selects the backends in turn proportionally to their
+// weights, using the smooth weighted round-robin of nginx.
+type weighted struct {
+	mu      sync.Mutex
+	current map[*backend]int
+}
+
+func (wr *weighted) pick(bs []*backend, r *http.Request) *backend {
+	wr.mu.Lock()
+	defer wr.mu.Unlock()
+	var best *backend
+	total := 0
+	for _, b := range bs {
+		w := int(b.weight.Load())
+		wr.current[b] += w
+		total += w
+		if best == nil || wr.current[b] > wr.current[best] {
+			best = b
+		}
+	}
+	wr.current[best] -= total
+	return best
+}
+
+func (wr *weighted) forget(b *backend) {
+	wr.mu.Lock()
+	defer wr.mu.Unlock()
+	delete(wr.current, b)
+}
+
+// leastConn selects the backend with the fewest active
+// connections relative to its weight.
+type leastConn struct{}
+
+func (leastConn) pick(bs []*backend, r *http.Request) *backend {
+	best := bs[0]
+	for _, b := range bs[1:] {
+		if b.conns.Load()*best.weight.Load() < best.conns.Load()*b.weight.Load() {
+			best = b
+		}
+	}
+	return best
+}
+
+// hash selects the backend by weighted rendezvous hashing of a
+// header or, without it, the client IP, so that a key keeps its backend as long
+// as the backend is available.
+type hash struct {
+	key string // header name, or "" for the client IP
+}
+
+func (h hash) pick(bs []*backend, r *http.Request) *backend {
+	var key string
+	if h.key != "" {
+		key = r.Header.Get(h.key)
+	}
+	if key == "" {
+		// Requests without the header are spread by their client.
+		key = clientIP(r)
+	}
+	return rendezvous(bs, key)
+}
+
+// rendezvous selects the backend for the key by weighted rendezvous hashing.
+func rendezvous(bs []*backend, key string) *backend {
+	var best *backend
+	bestScore := math.Inf(-1)
+	for _, b := range bs {
+		f := fnv.New64a()
+		f.Write([]byte(key))
+		f.Write([]byte(b.url.String()))
+		// Map the hash to (0, 1) and weight it.
+		x := (float64(f.Sum64()>>11) + 0.5) / (1 << 53)
+		if score := -float64(b.weight.Load()) / math.Log(x); score > bestScore {
+			best, bestScore = b, score
+		}
+	}
+	return best
+}
+
+// clientIP returns the IP address of the client of a request.
+func clientIP(r *http.Request) string {
+	if client, ok := r.Context().Value(clientKey{}).(netip.AddrPort); ok {
+		return client.Addr().String()
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
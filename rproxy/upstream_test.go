@@ -0,0 +1,240 @@
+// Copyright (c) 2014 David R. Jenni. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRoundRobin(t *testing.T) {
+	u, err := newUpstream([]string{"http://a", "http://b"}, nil, "round-robin", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("GET", "/", nil)
+
+	for i, want := range []string{"a", "b", "a", "b"} {
+		if got := u.pick(r).url.Host; got != want {
+			t.Errorf("%d: expected %s, got %s", i, want, got)
+		}
+	}
+}
+
+func TestWeighted(t *testing.T) {
+	u, err := newUpstream([]string{"http://a", "http://b"}, []int{3, 1}, "weighted", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("GET", "/", nil)
+
+	n := make(map[string]int)
+	for i := 0; i < 8; i++ {
+		n[u.pick(r).url.Host]++
+	}
+	if n["a"] != 6 || n["b"] != 2 {
+		t.Errorf("Expected a: 6, b: 2, got a: %d, b: %d", n["a"], n["b"])
+	}
+
+	b := u.backends[1]
+	if err := u.remove(b.url.String()); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := u.balancer.(*weighted).current[b]; ok {
+		t.Errorf("Expected the weight of the removed target to be dropped")
+	}
+}
+
+func TestLeastConn(t *testing.T) {
+	u, err := newUpstream([]string{"http://a", "http://b"}, nil, "least-conn", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("GET", "/", nil)
+
+	u.backends[0].conns.Add(2)
+	u.backends[1].conns.Add(1)
+	if got := u.pick(r).url.Host; got != "b" {
+		t.Errorf("Expected b, got %s", got)
+	}
+}
+
+func TestHash(t *testing.T) {
+	u, err := newUpstream([]string{"http://a", "http://b", "http://c"}, nil, "hash", "X-User")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("X-User", "alice")
+
+	first := u.pick(r)
+	for i := 0; i < 5; i++ {
+		if b := u.pick(r); b != first {
+			t.Errorf("Expected %s, got %s", first.url, b.url)
+		}
+	}
+
+	// Clients without the header are spread by their IP.
+	seen := make(map[*backend]bool)
+	for i := 0; i < 50; i++ {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = fmt.Sprintf("10.0.0.%d:1234", i)
+		seen[u.pick(r)] = true
+	}
+	if len(seen) != 3 {
+		t.Errorf("Expected clients without the header on all 3 targets, got %d", len(seen))
+	}
+}
+
+func TestInvalidWeights(t *testing.T) {
+	if _, err := newUpstream([]string{"http://a", "http://b"}, []int{1}, "weighted", ""); err == nil {
+		t.Errorf("Expected an error for missing weights")
+	}
+	if _, err := newUpstream([]string{"http://a"}, []int{0}, "weighted", ""); err == nil {
+		t.Errorf("Expected an error for a zero weight")
+	}
+}
+
+func TestEjection(t *testing.T) {
+	u, err := newUpstream([]string{"http://a", "http://b"}, nil, "round-robin", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.eject = ejection{failures: 2, duration: time.Hour}
+	r := httptest.NewRequest("GET", "/", nil)
+
+	a, b := u.backends[0], u.backends[1]
+	u.report(a, false)
+	if !a.available() {
+		t.Errorf("Expected a to be available after one failure")
+	}
+	u.report(a, false)
+	if a.available() {
+		t.Errorf("Expected a to be ejected after two failures")
+	}
+	for i := 0; i < 3; i++ {
+		if got := u.pick(r).url.Host; got != "b" {
+			t.Errorf("Expected b, got %s", got)
+		}
+	}
+	// The last available backend stays.
+	u.report(b, false)
+	u.report(b, false)
+	if !b.available() {
+		t.Errorf("Expected b, the last available backend, not to be ejected")
+	}
+}
+
+func TestEjectionSingleTarget(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/error":
+			w.WriteHeader(http.StatusInternalServerError)
+		case "/unavailable":
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	})
+	p := newTestProxy(t, h, &config{Upstreams: map[string]*upstreamConfig{"a": {Eject: &ejectConfig{After: 2}}}})
+
+	// Neither errors of the application nor failures of the only
+	// target eject it.
+	for _, path := range []string{"/error", "/unavailable"} {
+		for i := 0; i < 5; i++ {
+			p.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+		}
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		if w.Code != http.StatusOK {
+			t.Errorf("After %s: expected %d, got %d", path, http.StatusOK, w.Code)
+		}
+	}
+}
+
+func TestEjectionClientAbort(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	})
+	other := httptest.NewServer(h)
+	defer other.Close()
+	p := newTestProxy(t, h, &config{Upstreams: map[string]*upstreamConfig{"a": {
+		Targets: []targetConfig{{URL: other.URL}},
+		Eject:   &ejectConfig{After: 1, Time: duration(time.Hour)},
+		Breaker: &breakerConfig{Failures: 1, Open: duration(time.Hour)},
+	}}})
+
+	// Clients which give up mid-request neither eject the
+	// backends nor open the breaker.
+	for i := 0; i < 4; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		p.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil).WithContext(ctx))
+		cancel()
+	}
+	u := p.current().upstreams["a"]
+	for _, b := range u.backends {
+		if !b.available() {
+			t.Errorf("Expected %s to stay in rotation", b.url)
+		}
+	}
+	if !u.breaker.allow() {
+		t.Errorf("Expected a closed breaker")
+	}
+}
+
+func TestHealthCheck(t *testing.T) {
+	var status atomic.Int32
+	status.Store(http.StatusOK)
+	var probes, inflight, maxInflight atomic.Int32
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/healthz" {
+			probes.Add(1)
+			if n := inflight.Add(1); n > maxInflight.Load() {
+				maxInflight.Store(n)
+			}
+			defer inflight.Add(-1)
+			time.Sleep(30 * time.Millisecond) // slower than the interval
+		}
+		w.WriteHeader(int(status.Load()))
+	})
+	p := newTestProxy(t, h, &config{Upstreams: map[string]*upstreamConfig{"a": {
+		Health: &healthConfig{Path: "/healthz", Interval: duration(10 * time.Millisecond), Timeout: duration(time.Second), Status: http.StatusOK},
+	}}})
+	u := p.current().upstreams["a"]
+	defer u.close()
+	go u.checkHealth()
+	b := u.backends[0]
+
+	wait := func(available bool) {
+		t.Helper()
+		// Two probes make sure that one started after the change.
+		n := probes.Load() + 2
+		for deadline := time.Now().Add(5 * time.Second); probes.Load() < n || b.available() != available; {
+			if time.Now().After(deadline) {
+				t.Fatalf("Expected available %v", available)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+	wait(true)
+	status.Store(http.StatusServiceUnavailable)
+	wait(false)
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 without available target, got %d", w.Code)
+	}
+	status.Store(http.StatusOK)
+	wait(true)
+	if n := maxInflight.Load(); n != 1 {
+		t.Errorf("Expected one probe at a time, got %d", n)
+	}
+}
@@ -0,0 +1,471 @@
+// Copyright (c) 2014 David R. Jenni. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// isWebsocket reports whether the request is a websocket upgrade.
+func isWebsocket(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
+}
+
+// wsGUID is appended to the key of a websocket handshake (RFC 6455).
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// wsAccept returns the Sec-WebSocket-Accept value for a key.
+func wsAccept(key string) string {
+	sum := sha1.Sum([]byte(key + wsGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// acceptsWebsocket reports whether the 101 response of the target
+// completes the websocket handshake of the request.
+func acceptsWebsocket(resp *http.Response, r *http.Request) bool {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	return strings.EqualFold(resp.Header.Get("Upgrade"), "websocket") &&
+		hasToken(resp.Header, "Connection", "upgrade") &&
+		key != "" && resp.Header.Get("Sec-WebSocket-Accept") == wsAccept(key)
+}
+
+// hasToken reports whether the comma separated values of the
+// header contain the token, ignoring case.
+func hasToken(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (p *reverseProxy) handleWebsocket(w http.ResponseWriter, r *http.Request, st *proxyState) {
+	st.websocket = true
+	pr := &httputil.ProxyRequest{In: r, Out: r.Clone(r.Context())}
+	for _, h := range forwardedHeaders {
+		pr.Out.Header.Del(h)
+	}
+	p.rewrite(pr)
+
+	start := time.Now()
+	dst, err := st.upstream.dial(r.Context(), st.backend.url)
+	if err != nil {
+		if r.Context().Err() == nil {
+			st.upstream.report(st.backend, false)
+			st.upstream.breaker.record(false)
+		}
+		log.Printf("Error dialing target: %v", err)
+		http.Error(w, "Error dialing target.", http.StatusBadGateway)
+		return
+	}
+	defer dst.Close()
+
+	err = pr.Out.Write(dst)
+	if err != nil {
+		log.Printf("Error copying request to target: %v", err)
+		http.Error(w, "Error copying request to target.", http.StatusBadGateway)
+		return
+	}
+	if t := st.upstream.transport.ResponseHeaderTimeout; t > 0 {
+		dst.SetReadDeadline(time.Now().Add(t))
+	}
+	br := bufio.NewReader(dst)
+	resp, err := http.ReadResponse(br, pr.Out)
+	dst.SetReadDeadline(time.Time{})
+	if err != nil {
+		if r.Context().Err() == nil {
+			st.upstream.report(st.backend, false)
+			st.upstream.breaker.record(false)
+		}
+		log.Printf("Error reading response from target: %v", err)
+		http.Error(w, "Error reading response from target.", http.StatusBadGateway)
+		return
+	}
+	st.ttfb = time.Since(start)
+	if resp.StatusCode == http.StatusSwitchingProtocols && !acceptsWebsocket(resp, r) {
+		st.upstream.report(st.backend, false)
+		st.upstream.breaker.record(false)
+		log.Printf("Error upgrading to websocket: invalid handshake from %s", st.backend.url)
+		http.Error(w, "Invalid websocket handshake from target.", http.StatusBadGateway)
+		return
+	}
+	ok := !targetFailed(resp.StatusCode)
+	st.upstream.report(st.backend, ok)
+	st.upstream.breaker.record(ok)
+	st.route.responseHeaders.apply(resp.Header)
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		// The target refused the upgrade; pass on its answer.
+		defer resp.Body.Close()
+		copyHeader(w.Header(), resp.Header)
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+		return
+	}
+
+	src, brw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		log.Printf("Hijack error: %v", err)
+		return
+	}
+	defer src.Close()
+	p.metrics.websocket(st.route.name, 1)
+	defer p.metrics.websocket(st.route.name, -1)
+
+	// Headers of the proxy, like the affinity cookie, are sent as well.
+	copyHeader(resp.Header, w.Header())
+	fmt.Fprintf(brw, "HTTP/1.1 %s\r\n", resp.Status)
+	resp.Header.Write(brw)
+	brw.WriteString("\r\n")
+	if err := brw.Flush(); err != nil {
+		log.Printf("Error copying response to client: %v", err)
+		return
+	}
+
+	s := p.addSession(src, dst)
+	defer p.removeSession(s)
+	var toBackend, toClient frameTracker
+	if st.dropAfter > 0 {
+		var messages atomic.Int64
+		drop := func() {
+			if messages.Add(1) == int64(st.dropAfter) {
+				src.Close()
+				dst.Close()
+			}
+		}
+		toBackend.onMessage, toClient.onMessage = drop, drop
+	}
+	// The trackers follow the bytes which were passed on.
+	client := &wsWriter{w: io.MultiWriter(src, &toClient), conn: src}
+	backend := &wsWriter{w: io.MultiWriter(dst, &toBackend), conn: dst, masked: true}
+	a := new(activity)
+	a.touch()
+	if idle := st.upstream.wsIdle; idle > 0 {
+		stop := make(chan struct{})
+		defer close(stop)
+		go s.closeIdle(idle, a, stop)
+	}
+	errc := make(chan error, 2)
+	cp := func(n *int64, copy func() (int64, error)) {
+		var err error
+		*n, err = copy()
+		errc <- err
+	}
+	if ins := st.route.inspection; ins != nil {
+		if ins.ping > 0 {
+			stop := make(chan struct{})
+			defer close(stop)
+			go keepalive(ins.ping, a, stop, client, backend)
+		}
+		fromClient := &frameCopier{ins: ins, p: p, r: r, st: st, from: "client", a: a}
+		fromBackend := &frameCopier{ins: ins, p: p, r: r, st: st, from: "backend", a: a}
+		go cp(&st.received, func() (int64, error) { return fromClient.copy(backend, brw, client) })
+		go cp(&st.sent, func() (int64, error) { return fromBackend.copy(client, br, backend) })
+	} else {
+		go cp(&st.received, func() (int64, error) { return io.Copy(backend.w, touchReader{brw, a}) })
+		go cp(&st.sent, func() (int64, error) { return io.Copy(client.w, touchReader{br, a}) })
+	}
+	<-errc
+	if s.closing.Load() {
+		// Both reads were interrupted; say goodbye between frames.
+		<-errc
+		if toClient.boundary() {
+			client.close(closeGoingAway)
+		}
+		if toBackend.boundary() {
+			backend.close(closeGoingAway)
+		}
+		src.Close()
+		dst.Close()
+		return
+	}
+	// Unblock the other direction and wait for its byte count.
+	src.Close()
+	dst.Close()
+	<-errc
+}
+
+// wsSession is an active websocket session.
+type wsSession struct {
+	client, backend net.Conn
+	closing         atomic.Bool
+}
+
+// addSession registers a websocket session.
+func (p *reverseProxy) addSession(client, backend net.Conn) *wsSession {
+	s := &wsSession{client: client, backend: backend}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.websockets[s] = true
+	return s
+}
+
+// removeSession unregisters a websocket session.
+func (p *reverseProxy) removeSession(s *wsSession) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.websockets, s)
+}
+
+// interrupt makes the session close between frames by
+// interrupting the reads of both directions.
+func (s *wsSession) interrupt() {
+	s.closing.Store(true)
+	now := time.Now()
+	s.client.SetReadDeadline(now)
+	s.backend.SetReadDeadline(now)
+}
+
+// closeIdle interrupts the session once it is idle for the idle
+// timeout, until stop is closed.
+func (s *wsSession) closeIdle(idle time.Duration, a *activity, stop <-chan struct{}) {
+	t := time.NewTimer(idle)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-stop:
+			return
+		}
+		if d := a.deadline(idle); time.Now().Before(d) {
+			t.Reset(time.Until(d))
+			continue
+		}
+		log.Printf("Closing websocket idle for %v", idle)
+		s.interrupt()
+		return
+	}
+}
+
+// touchReader records the traffic read from r.
+type touchReader struct {
+	r io.Reader
+	a *activity
+}
+
+func (r touchReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	if n > 0 {
+		r.a.touch()
+	}
+	return n, err
+}
+
+// closeWebsockets waits for the websocket sessions to end until
+// ctx is done, then closes the remaining ones with a close frame
+// and waits for them to finish.
+func (p *reverseProxy) closeWebsockets(ctx context.Context) {
+	tick := time.NewTicker(100 * time.Millisecond)
+	defer tick.Stop()
+	closed := false
+	for {
+		p.mu.Lock()
+		n := len(p.websockets)
+		if n > 0 && ctx.Err() != nil && !closed {
+			log.Printf("Closing %d websockets", n)
+			for s := range p.websockets {
+				s.interrupt()
+			}
+			closed = true
+		}
+		p.mu.Unlock()
+		if n == 0 {
+			return
+		}
+		<-tick.C
+	}
+}
+
+// Websocket opcodes and close statuses.
+const (
+	opText  = 0x1
+	opClose = 0x8
+	opPing  = 0x9
+
+	closeGoingAway = 1001 // rproxy shuts down
+	closeTooBig    = 1009 // a message is larger than allowed
+)
+
+// wsWriter writes the frames to one side of a websocket.
+type wsWriter struct {
+	mu     sync.Mutex // held while a frame is written
+	w      io.Writer  // the connection and its frame tracker
+	conn   net.Conn
+	masked bool // frames sent by rproxy are masked, as to the backend
+	closed bool // a close frame was sent
+}
+
+// control writes a control frame between two frames. Nothing
+// is written after a close frame.
+func (w *wsWriter) control(opcode byte, payload []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return net.ErrClosed
+	}
+	w.closed = opcode == opClose
+	frame := []byte{0x80 | opcode, byte(len(payload))}
+	payload = slices.Clone(payload)
+	if w.masked {
+		var key [4]byte
+		rand.Read(key[:])
+		frame[1] |= 0x80
+		frame = append(frame, key[:]...)
+		for i := range payload {
+			payload[i] ^= key[i%4]
+		}
+	}
+	w.conn.SetWriteDeadline(time.Now().Add(time.Second))
+	defer w.conn.SetWriteDeadline(time.Time{})
+	_, err := w.conn.Write(append(frame, payload...))
+	return err
+}
+
+// close writes a close frame with the status.
+func (w *wsWriter) close(status int) error {
+	return w.control(opClose, binary.BigEndian.AppendUint16(nil, uint16(status)))
+}
+
+// frameTracker follows the frame boundaries of a websocket stream
+// by parsing the frame headers and skipping the payloads.
+type frameTracker struct {
+	header    []byte // incomplete header of the next frame
+	remaining uint64 // payload bytes of the current frame
+	final     bool   // the current frame ends a data message
+	onMessage func() // called at the end of every data message, if set
+}
+
+func (t *frameTracker) Write(b []byte) (int, error) {
+	n := len(b)
+	for len(b) > 0 {
+		if t.remaining > 0 {
+			k := min(uint64(len(b)), t.remaining)
+			t.remaining -= k
+			b = b[k:]
+			if t.remaining == 0 {
+				t.frameEnd()
+			}
+			continue
+		}
+		t.header = append(t.header, b[0])
+		b = b[1:]
+		if size, ok := payloadSize(t.header); ok {
+			t.remaining = size
+			// FIN set and not a control frame.
+			t.final = t.header[0]&0x80 != 0 && t.header[0]&0x08 == 0
+			t.header = t.header[:0]
+			if size == 0 {
+				t.frameEnd()
+			}
+		}
+	}
+	return n, nil
+}
+
+// frameEnd is called at the end of every frame.
+func (t *frameTracker) frameEnd() {
+	if t.final && t.onMessage != nil {
+		t.onMessage()
+	}
+}
+
+// boundary reports whether the stream is between two frames.
+func (t *frameTracker) boundary() bool {
+	return t.remaining == 0 && len(t.header) == 0
+}
+
+// payloadSize returns the payload size of the frame with the
+// header h, or false if h is incomplete.
+func payloadSize(h []byte) (uint64, bool) {
+	if len(h) < 2 {
+		return 0, false
+	}
+	size, n := uint64(h[1]&0x7f), 2
+	switch size {
+	case 126:
+		n += 2
+	case 127:
+		n += 8
+	}
+	if h[1]&0x80 != 0 {
+		n += 4 // masking key
+	}
+	if len(h) < n {
+		return 0, false
+	}
+	switch size {
+	case 126:
+		size = uint64(binary.BigEndian.Uint16(h[2:]))
+	case 127:
+		size = binary.BigEndian.Uint64(h[2:])
+	}
+	return size, true
+}
+
+// dial connects to the target, using TLS for https targets.
+func (u *upstream) dial(ctx context.Context, target *url.URL) (net.Conn, error) {
+	c, err := u.dialContext(ctx, "tcp", hostPort(target))
+	if err != nil {
+		return nil, err
+	}
+	if target.Scheme != "https" {
+		return c, nil
+	}
+	conf := &tls.Config{}
+	if u.tls != nil {
+		conf = u.tls.Clone()
+	}
+	conf.ServerName = target.Hostname()
+	conf.NextProtos = []string{"http/1.1"}
+	tc := tls.Client(c, conf)
+	hctx, cancel := context.WithTimeout(ctx, u.transport.TLSHandshakeTimeout)
+	defer cancel()
+	if err := tc.HandshakeContext(hctx); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return tc, nil
+}
+
+// hostPort returns the address of the target, with the
+// default port of its scheme if it has none.
+func hostPort(target *url.URL) string {
+	if target.Port() != "" {
+		return target.Host
+	}
+	if target.Scheme == "https" {
+		return net.JoinHostPort(target.Hostname(), "443")
+	}
+	return net.JoinHostPort(target.Hostname(), "80")
+}
+
+// copyHeader adds all values of src to dst.
+func copyHeader(dst, src http.Header) {
+	for k, vv := range src {
+		for _, v := range vv {
+			dst.Add(k, v)
+		}
+	}
+}
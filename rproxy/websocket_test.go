@@ -0,0 +1,225 @@
+// Copyright (c) 2014 David R. Jenni. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// testWSKey is the Sec-WebSocket-Key sent by the test clients.
+const testWSKey = "dGhlIHNhbXBsZSBub25jZQ=="
+
+// switchProtocols returns the answer of a target which accepts the
+// websocket upgrade of r.
+func switchProtocols(r *http.Request) string {
+	return "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: " +
+		wsAccept(r.Header.Get("Sec-WebSocket-Key")) + "\r\n\r\n"
+}
+
+// echoWebsocket answers an upgrade with 101 and echoes
+// the headers of interest followed by the raw stream.
+func echoWebsocket(w http.ResponseWriter, r *http.Request) {
+	if !isWebsocket(r) {
+		http.Error(w, "not a websocket", http.StatusBadRequest)
+		return
+	}
+	conn, brw, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	brw.WriteString(switchProtocols(r))
+	brw.WriteString(r.Host + "\n" + r.Header.Get("X-Forwarded-For") + "\n" + r.Header.Get("X-Forwarded-Host") + "\n")
+	brw.Flush()
+	io.Copy(conn, brw)
+}
+
+// echoFrames answers an upgrade with 101 and echoes the frames.
+func echoFrames(w http.ResponseWriter, r *http.Request) {
+	conn, brw, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	brw.WriteString(switchProtocols(r))
+	brw.Flush()
+	io.Copy(conn, brw)
+}
+
+func dialWebsocket(t *testing.T, addr string) (net.Conn, *bufio.Reader) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(conn, "GET /ws HTTP/1.1\r\nHost: front.example\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Key: "+testWSKey+"\r\nX-Forwarded-For: 6.6.6.6\r\n\r\n")
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("Expected 101, got %d", resp.StatusCode)
+	}
+	return conn, br
+}
+
+func TestWebsocketTLS(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(echoWebsocket))
+	defer ts.Close()
+	for _, rewriteHost := range []bool{false, true} {
+		c := &config{
+			Upstreams: map[string]*upstreamConfig{"a": {Targets: []targetConfig{{URL: ts.URL}}, RewriteHost: rewriteHost}},
+			Routes:    []*routeConfig{{Upstream: "a"}},
+		}
+		p, err := newReverseProxy(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		roots := x509.NewCertPool()
+		roots.AddCert(ts.Certificate())
+		p.current().upstreams["a"].tls = &tls.Config{RootCAs: roots}
+		front := httptest.NewServer(p)
+
+		conn, br := dialWebsocket(t, front.Listener.Addr().String())
+		host := "front.example"
+		if rewriteHost {
+			host = ts.Listener.Addr().String()
+		}
+		for _, w := range []string{host, "127.0.0.1", "front.example"} {
+			line, err := br.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.TrimSpace(line); got != w {
+				t.Errorf("rewriteHost %v: expected %q, got %q", rewriteHost, w, got)
+			}
+		}
+		io.WriteString(conn, "ping\n")
+		if line, _ := br.ReadString('\n'); line != "ping\n" {
+			t.Errorf("Expected ping, got %q", line)
+		}
+		conn.Close()
+		front.Close()
+	}
+}
+
+func TestWebsocketRefused(t *testing.T) {
+	p := newTestProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "no", http.StatusForbidden)
+	}), &config{})
+
+	r := httptest.NewRequest("GET", "/ws", nil)
+	r.Header.Set("Upgrade", "websocket")
+	r.Header.Set("Connection", "Upgrade")
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected 403, got %d", w.Code)
+	}
+}
+
+func TestWebsocketHandshake(t *testing.T) {
+	// The example of RFC 6455.
+	if got := wsAccept(testWSKey); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("Expected the accept value of RFC 6455, got %q", got)
+	}
+
+	answers := []string{
+		"HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: x\r\n\r\n",
+		"HTTP/1.1 101 Switching Protocols\r\nUpgrade: h2c\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: " + wsAccept(testWSKey) + "\r\n\r\n",
+		"HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nSec-WebSocket-Accept: " + wsAccept(testWSKey) + "\r\n\r\n",
+	}
+	for _, answer := range answers {
+		p := newTestProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			conn, brw, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			brw.WriteString(answer)
+			brw.Flush()
+			io.Copy(io.Discard, brw)
+		}), &config{})
+
+		r := httptest.NewRequest("GET", "/ws", nil)
+		r.Header.Set("Upgrade", "websocket")
+		r.Header.Set("Connection", "Upgrade")
+		r.Header.Set("Sec-WebSocket-Key", testWSKey)
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, r)
+		if w.Code != http.StatusBadGateway {
+			t.Errorf("%q: expected 502, got %d", answer, w.Code)
+		}
+	}
+}
+
+func TestHostPort(t *testing.T) {
+	tests := []struct{ url, want string }{
+		{"http://a", "a:80"},
+		{"https://a", "a:443"},
+		{"https://a:8443", "a:8443"},
+		{"http://[::1]", "[::1]:80"},
+	}
+	for _, tt := range tests {
+		u := mustParse(t, tt.url)
+		if got := hostPort(u); got != tt.want {
+			t.Errorf("%s: expected %s, got %s", tt.url, tt.want, got)
+		}
+	}
+}
+
+func mustParse(t *testing.T, s string) *url.URL {
+	u, err := url.Parse(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+func TestFrameTracker(t *testing.T) {
+	var ft frameTracker
+	frames := [][]byte{
+		{0x81, 0x03, 'a', 'b', 'c'},
+		append([]byte{0x82, 0x7e, 0x01, 0x00}, make([]byte, 256)...),
+		{0x81, 0x82, 1, 2, 3, 4, 'x', 'y'},
+	}
+	for _, f := range frames {
+		// Feed the frame byte by byte.
+		for i := range f {
+			ft.Write(f[i : i+1])
+			if ft.boundary() != (i == len(f)-1) {
+				t.Fatalf("Frame %x: unexpected boundary %v after %d bytes", f[:2], ft.boundary(), i+1)
+			}
+		}
+	}
+	ft.Write(bytes.Join(frames, nil))
+	if !ft.boundary() {
+		t.Errorf("Expected a boundary after whole frames")
+	}
+}
+
+func TestFrameTrackerMessages(t *testing.T) {
+	messages := 0
+	ft := frameTracker{onMessage: func() { messages++ }}
+	ft.Write([]byte{
+		0x01, 0x01, 'a', // first fragment
+		0x89, 0x00, // ping between the fragments
+		0x80, 0x01, 'b', // last fragment
+		0x82, 0x00, // empty binary message
+	})
+	if messages != 2 {
+		t.Errorf("Expected 2 messages, got %d", messages)
+	}
+}
@@ -0,0 +1,214 @@
+// Copyright (c) 2014 David R. Jenni. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	maxLoggedMessage = 64 << 10 // longer messages are logged truncated
+	maxLogLine       = 256      // longer messages are truncated in the log
+)
+
+// errTooBig is returned by frameCopier.copy for a message
+// which is larger than allowed.
+var errTooBig = errors.New("message too big")
+
+// wsInspection configures the inspection of the websocket frames of a route.
+type wsInspection struct {
+	log        bool          // logs text messages
+	tee        bool          // writes text messages to the tee of the proxy
+	maxMessage int64         // largest message in bytes, 0 for no limit
+	ping       time.Duration // idle time before pings are sent, 0 for never
+}
+
+// wsTee writes the text messages of websockets as JSON lines.
+type wsTee struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// wsTeeEntry is a line of a wsTee.
+type wsTeeEntry struct {
+	Time      time.Time `json:"time"`
+	Route     string    `json:"route"`
+	Client    string    `json:"client"`
+	From      string    `json:"from"` // client or backend
+	Text      string    `json:"text"`
+	Truncated bool      `json:"truncated,omitempty"`
+}
+
+func (t *wsTee) write(e *wsTeeEntry) {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, err := t.w.Write(append(b, '\n')); err != nil {
+		log.Printf("Error writing websocket tee: %v", err)
+	}
+}
+
+// frameCopier copies the frames of one direction of a websocket
+// and assembles its messages to log, tee and limit them.
+type frameCopier struct {
+	ins  *wsInspection
+	p    *reverseProxy
+	r    *http.Request // the handshake
+	st   *proxyState
+	from string    // client or backend
+	a    *activity // traffic in either direction
+
+	opcode byte   // opcode of the current message
+	size   int64  // size of the current message
+	msg    []byte // logged part of the current message
+}
+
+// copy copies the frames from src to dst until src ends. Messages
+// over the maximum size are answered with a close frame to both
+// the sender, written to back, and the receiver.
+func (c *frameCopier) copy(dst *wsWriter, src io.Reader, back *wsWriter) (int64, error) {
+	var n int64
+	h := make([]byte, 14)
+	buf := make([]byte, 32<<10)
+	for {
+		hl := 2
+		if _, err := io.ReadFull(src, h[:hl]); err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			return n, err
+		}
+		switch h[1] & 0x7f {
+		case 126:
+			hl += 2
+		case 127:
+			hl += 8
+		}
+		if h[1]&0x80 != 0 {
+			hl += 4
+		}
+		if _, err := io.ReadFull(src, h[2:hl]); err != nil {
+			return n, err
+		}
+		c.a.touch()
+		size, _ := payloadSize(h[:hl])
+		fin, opcode := h[0]&0x80 != 0, h[0]&0x0f
+		var key []byte
+		if h[1]&0x80 != 0 {
+			key = h[hl-4 : hl]
+		}
+		data := opcode < opClose
+		if data {
+			if opcode != 0 {
+				c.opcode, c.size, c.msg = opcode, 0, c.msg[:0]
+			}
+			c.size += int64(size)
+			if c.ins.maxMessage > 0 && c.size > c.ins.maxMessage {
+				log.Printf("Closing websocket of %s: message from the %s over %d bytes", clientIP(c.r), c.from, c.ins.maxMessage)
+				back.close(closeTooBig)
+				dst.close(closeTooBig)
+				return n, errTooBig
+			}
+		}
+
+		dst.mu.Lock()
+		m, err := dst.w.Write(h[:hl])
+		n += int64(m)
+		for off := uint64(0); err == nil && off < size; {
+			k, rerr := src.Read(buf[:min(size-off, uint64(len(buf)))])
+			if k > 0 {
+				c.a.touch()
+				if data && c.opcode == opText {
+					c.record(buf[:k], key, off)
+				}
+				m, err = dst.w.Write(buf[:k])
+				n += int64(m)
+				off += uint64(k)
+			}
+			if err == nil {
+				err = rerr
+			}
+		}
+		dst.mu.Unlock()
+		if err != nil {
+			return n, err
+		}
+		if data && fin && c.opcode == opText {
+			c.message()
+		}
+	}
+}
+
+// record adds the payload at offset off of the current frame,
+// unmasked with key, to the logged part of the message.
+func (c *frameCopier) record(p, key []byte, off uint64) {
+	if !c.ins.log && !c.ins.tee {
+		return
+	}
+	for i := 0; i < len(p) && len(c.msg) < maxLoggedMessage; i++ {
+		b := p[i]
+		if key != nil {
+			b ^= key[(off+uint64(i))%4]
+		}
+		c.msg = append(c.msg, b)
+	}
+}
+
+// message logs and tees a complete text message.
+func (c *frameCopier) message() {
+	truncated := c.size > int64(len(c.msg))
+	if c.ins.log {
+		text := string(c.msg[:min(len(c.msg), maxLogLine)])
+		log.Printf("Websocket message from the %s of %s on %s: %q (%d bytes)", c.from, clientIP(c.r), c.st.route.name, text, c.size)
+	}
+	if c.ins.tee && c.p.wsTee != nil {
+		c.p.wsTee.write(&wsTeeEntry{
+			Time:      time.Now(),
+			Route:     c.st.route.name,
+			Client:    clientIP(c.r),
+			From:      c.from,
+			Text:      string(c.msg),
+			Truncated: truncated,
+		})
+	}
+}
+
+// keepalive sends pings to both sides of a websocket whenever
+// it is idle for the interval, until stop is closed. The pings
+// are not recorded as activity, so that only the answers keep
+// the websocket from its idle timeout.
+func keepalive(interval time.Duration, a *activity, stop <-chan struct{}, sides ...*wsWriter) {
+	t := time.NewTimer(interval)
+	defer t.Stop()
+	last := time.Now() // of the last ping
+	for {
+		select {
+		case <-t.C:
+		case <-stop:
+			return
+		}
+		next := a.deadline(interval)
+		if d := last.Add(interval); d.After(next) {
+			next = d
+		}
+		if !time.Now().Before(next) {
+			for _, w := range sides {
+				w.control(opPing, nil)
+			}
+			last = time.Now()
+			next = last.Add(interval)
+		}
+		t.Reset(time.Until(next))
+	}
+}
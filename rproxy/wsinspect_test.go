@@ -0,0 +1,99 @@
+// Copyright (c) 2014 David R. Jenni. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// maskedFrame returns a frame as sent by a client.
+func maskedFrame(opcode byte, fin bool, payload string) []byte {
+	key := []byte{1, 2, 3, 4}
+	b := []byte{opcode, 0x80 | byte(len(payload))}
+	if fin {
+		b[0] |= 0x80
+	}
+	b = append(b, key...)
+	for i := range len(payload) {
+		b = append(b, payload[i]^key[i%4])
+	}
+	return b
+}
+
+// lineWriter sends every write to a channel.
+type lineWriter chan string
+
+func (w lineWriter) Write(b []byte) (int, error) {
+	w <- string(b)
+	return len(b), nil
+}
+
+// inspectionProxy returns the address of a proxy inspecting the
+// websockets of a target which echoes the frames.
+func inspectionProxy(t *testing.T, c *websocketConfig, tee io.Writer) string {
+	p := newTestProxy(t, http.HandlerFunc(echoFrames), &config{Routes: []*routeConfig{{Upstream: "a", Websocket: c}}})
+	if tee != nil {
+		p.wsTee = &wsTee{w: tee}
+	}
+	front := httptest.NewServer(p)
+	t.Cleanup(front.Close)
+	return front.Listener.Addr().String()
+}
+
+func TestWebsocketInspection(t *testing.T) {
+	tee := make(lineWriter, 2)
+	addr := inspectionProxy(t, &websocketConfig{Tee: true, MaxMessage: 10}, tee)
+	conn, br := dialWebsocket(t, addr)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// A fragmented message with a ping between the fragments.
+	var msg []byte
+	msg = append(msg, maskedFrame(opText, false, "hel")...)
+	msg = append(msg, maskedFrame(opPing, true, "")...)
+	msg = append(msg, maskedFrame(0, true, "lo")...)
+	conn.Write(msg)
+	echo := make([]byte, len(msg))
+	if _, err := io.ReadFull(br, echo); err != nil || !bytes.Equal(echo, msg) {
+		t.Fatalf("Expected the frames to pass unchanged, got %x %v", echo, err)
+	}
+	for _, from := range []string{"client", "backend"} {
+		var e wsTeeEntry
+		if err := json.Unmarshal([]byte(<-tee), &e); err != nil {
+			t.Fatal(err)
+		}
+		if e.From != from || e.Text != "hello" || e.Route != "a" {
+			t.Errorf("Expected hello from the %s, got %+v", from, e)
+		}
+	}
+
+	conn.Write(maskedFrame(opText, true, "hello world"))
+	b, _ := io.ReadAll(br)
+	if want := []byte{0x88, 0x02, 0x03, 0xf1}; !bytes.Equal(b, want) {
+		t.Errorf("Expected close frame %x for a message over the limit, got %x", want, b)
+	}
+}
+
+func TestWebsocketPing(t *testing.T) {
+	addr := inspectionProxy(t, &websocketConfig{Ping: duration(50 * time.Millisecond)}, nil)
+	conn, br := dialWebsocket(t, addr)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	start := time.Now()
+	ping := make([]byte, 2)
+	if _, err := io.ReadFull(br, ping); err != nil || !bytes.Equal(ping, []byte{0x89, 0x00}) {
+		t.Fatalf("Expected a ping, got %x %v", ping, err)
+	}
+	if d := time.Since(start); d < 40*time.Millisecond {
+		t.Errorf("Expected the ping after 50ms idle, got it after %v", d)
+	}
+}